@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/metrics"
 )
 
 func main() {
@@ -14,17 +19,30 @@ func main() {
 	// This enables "Horizontal Scaling" simulation by running multiple instances on different ports.
 	port := flag.String("port", "8080", "Port to run the server on")
 	name := flag.String("name", "Server-1", "Name of this server instance")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests on shutdown")
 	flag.Parse()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Metrics for every instance, scraped from /metrics. Comparing them
+	// across instances shows how evenly the load balancer spreads the work.
+	reg := metrics.NewRegistry()
+	httpMetrics := metrics.NewHTTPMetrics(reg, "scaling")
+	http.Handle("/metrics", reg)
+
+	http.Handle("/", httpMetrics.Wrap("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello from %s running on port %s\n", *name, *port)
+	})))
+
+	// Health endpoint used by the load balancer's active health checker.
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
 	})
 
 	// 2. Simulate a heavy CPU task.
 	// This represents a request that consumes significant resources.
-	http.HandleFunc("/heavy", func(w http.ResponseWriter, r *http.Request) {
+	http.Handle("/heavy", httpMetrics.Wrap("/heavy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		
+
 		// Simulate work: Check for primes up to a large number
 		count := 0
 		for i := 2; i < 50000; i++ {
@@ -35,12 +53,32 @@ func main() {
 
 		duration := time.Since(start)
 		msg := fmt.Sprintf("[%s] Heavy calculation done! Found %d primes. Took %v\n", *name, count, duration)
-		fmt.Print(msg) // Log to server console
+		fmt.Print(msg)     // Log to server console
 		fmt.Fprint(w, msg) // Send to client
-	})
+	})))
 
-	fmt.Printf("Starting %s on port %s...\n", *name, *port)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
+	// 3. Graceful shutdown.
+	// On SIGINT/SIGTERM we stop accepting new connections but let requests
+	// that are already running finish, so rolling this instance behind the
+	// load balancer does not fail any client request.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: ":" + *port}
+	go func() {
+		fmt.Printf("Starting %s on port %s...\n", *name, *port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	fmt.Printf("%s shutting down, waiting up to %v for in-flight requests...\n", *name, *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("%s forced to stop: %v\n", *name, err)
+	}
 }
 
 // isPrime is a simple (and purposefully inefficient) CPU-bound function.
@@ -55,4 +93,3 @@ func isPrime(n int) bool {
 	}
 	return true
 }
-
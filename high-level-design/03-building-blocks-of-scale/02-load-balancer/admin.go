@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BackendStatus is the admin API view of a backend.
+type BackendStatus struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Alive    bool   `json:"alive"`
+	Draining bool   `json:"draining"`
+	InFlight int64  `json:"in_flight"`
+	Breaker  string `json:"circuit_breaker"`
+}
+
+func statusOf(b *Backend) BackendStatus {
+	return BackendStatus{
+		ID:       b.ID(),
+		URL:      b.URL.String(),
+		Weight:   b.Weight(),
+		Alive:    b.IsAlive(),
+		Draining: b.IsDraining(),
+		InFlight: b.InFlight(),
+		Breaker:  b.BreakerState().String(),
+	}
+}
+
+// NewAdminHandler exposes the pool over HTTP:
+//
+//	GET    /backends              list backends with health and connection stats
+//	POST   /backends              add a backend: {"url": "...", "weight": 1}
+//	POST   /backends/drain?url=   stop routing new requests to a backend;
+//	                              with &wait=30s, block until its in-flight
+//	                              requests have completed (or the wait expires)
+//	POST   /backends/undrain?url= put a drained backend back into rotation
+//	DELETE /backends?url=         remove a backend from the pool
+//	GET    /listeners             list listeners and their algorithms
+//	GET    /metrics               Prometheus metrics
+//
+// Changes made here are not written back to the config file, so the next
+// reload replaces them with whatever the file says.
+func NewAdminHandler(lb *LoadBalancer) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /backends", func(w http.ResponseWriter, r *http.Request) {
+		var statuses []BackendStatus
+		for _, b := range lb.pool.Backends() {
+			statuses = append(statuses, statusOf(b))
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+
+	mux.HandleFunc("POST /backends", func(w http.ResponseWriter, r *http.Request) {
+		var bc BackendConfig
+		if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := lb.pool.AddBackend(bc.URL, bc.Weight)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("LB: Admin added backend %s (weight %d)\n", b.URL, b.Weight())
+		writeJSON(w, http.StatusCreated, statusOf(b))
+	})
+
+	mux.HandleFunc("POST /backends/drain", func(w http.ResponseWriter, r *http.Request) {
+		b := lb.pool.Lookup(r.URL.Query().Get("url"))
+		if b == nil {
+			http.Error(w, "no such backend", http.StatusNotFound)
+			return
+		}
+		// Validate the whole request before changing anything.
+		var timeout time.Duration
+		if wait := r.URL.Query().Get("wait"); wait != "" {
+			var err error
+			timeout, err = time.ParseDuration(wait)
+			if err != nil || timeout <= 0 {
+				http.Error(w, "invalid wait: want a positive duration such as 30s", http.StatusBadRequest)
+				return
+			}
+		}
+		b.Drain()
+		fmt.Printf("LB: Admin is draining backend %s\n", b.URL)
+
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			if err := b.WaitDrained(ctx); err != nil {
+				// Still draining: 202 tells the caller to poll GET /backends.
+				writeJSON(w, http.StatusAccepted, statusOf(b))
+				return
+			}
+			fmt.Printf("LB: Backend %s is drained\n", b.URL)
+		}
+		writeJSON(w, http.StatusOK, statusOf(b))
+	})
+
+	mux.HandleFunc("POST /backends/undrain", func(w http.ResponseWriter, r *http.Request) {
+		b := lb.pool.Lookup(r.URL.Query().Get("url"))
+		if b == nil {
+			http.Error(w, "no such backend", http.StatusNotFound)
+			return
+		}
+		b.Undrain()
+		fmt.Printf("LB: Admin put backend %s back into rotation\n", b.URL)
+		writeJSON(w, http.StatusOK, statusOf(b))
+	})
+
+	mux.HandleFunc("DELETE /backends", func(w http.ResponseWriter, r *http.Request) {
+		backendUrl := r.URL.Query().Get("url")
+		if !lb.pool.RemoveBackend(backendUrl) {
+			http.Error(w, "no such backend", http.StatusNotFound)
+			return
+		}
+		fmt.Printf("LB: Admin removed backend %s\n", backendUrl)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /listeners", func(w http.ResponseWriter, r *http.Request) {
+		listeners := make(map[string]string)
+		for _, l := range lb.Listeners() {
+			listeners[l.Addr] = l.Algorithm()
+		}
+		writeJSON(w, http.StatusOK, listeners)
+	})
+
+	mux.Handle("GET /metrics", lbStats.registry)
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
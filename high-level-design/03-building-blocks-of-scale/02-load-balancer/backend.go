@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is a single upstream server together with its liveness state.
+// The state is shared by the active health checker and by passive failure
+// reports coming from the reverse proxy, so both paths agree on whether the
+// backend should receive traffic.
+type Backend struct {
+	URL          *url.URL
+	ReverseProxy *httputil.ReverseProxy
+
+	id      string // Opaque, stable identifier handed out in sticky cookies
+	breaker *CircuitBreaker
+
+	inFlight int64 // Requests currently being proxied, updated atomically
+
+	mu        sync.RWMutex
+	weight    int // Relative capacity, used by weighted balancers
+	alive     bool
+	draining  bool // Draining backends finish in-flight requests but get no new ones
+	successes int  // consecutive successful checks
+	failures  int  // consecutive failed checks
+}
+
+// backendID derives a stable identifier from the backend's URL, so a
+// sticky cookie survives balancer restarts and config reloads.
+func backendID(u *url.URL) string {
+	h := fnv.New64a()
+	h.Write([]byte(u.String()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// ID returns the backend's opaque identifier.
+func (b *Backend) ID() string {
+	return b.id
+}
+
+// Weight returns the backend's relative capacity (at least 1).
+func (b *Backend) Weight() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.weight < 1 {
+		return 1
+	}
+	return b.weight
+}
+
+// SetWeight changes the backend's relative capacity.
+func (b *Backend) SetWeight(weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.weight = weight
+}
+
+// InFlight returns the number of requests currently being proxied.
+func (b *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&b.inFlight)
+}
+
+// ServeHTTP proxies the request and keeps the in-flight count accurate for
+// the whole duration of the call, including while the body is streamed.
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&b.inFlight, 1)
+	defer atomic.AddInt64(&b.inFlight, -1)
+	b.ReverseProxy.ServeHTTP(w, r)
+}
+
+// BreakerState returns the state of the backend's circuit breaker.
+func (b *Backend) BreakerState() BreakerState {
+	return b.breaker.State()
+}
+
+// IsAlive reports whether the backend is currently eligible for traffic.
+func (b *Backend) IsAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.alive
+}
+
+// IsDraining reports whether the backend has been taken out of rotation.
+func (b *Backend) IsDraining() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.draining
+}
+
+// Drain stops new requests from being routed to the backend.
+// Requests that are already in flight are allowed to complete.
+func (b *Backend) Drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = true
+}
+
+// Undrain puts a drained backend back into rotation.
+func (b *Backend) Undrain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = false
+}
+
+// WaitDrained blocks until the backend has no requests in flight or ctx is
+// done. Together with Drain it lets an operator roll a backend without
+// failing any client request: drain, wait, restart, undrain.
+func (b *Backend) WaitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for b.InFlight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// RecordSuccess counts a successful check and brings a dead backend back
+// once it has passed healthyThreshold checks in a row.
+// It returns true if the liveness state changed.
+func (b *Backend) RecordSuccess(healthyThreshold int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.successes++
+	if !b.alive && b.successes >= healthyThreshold {
+		b.alive = true
+		return true
+	}
+	return false
+}
+
+// RecordFailure counts a failed check and ejects the backend once it has
+// failed unhealthyThreshold checks in a row.
+// It returns true if the liveness state changed.
+func (b *Backend) RecordFailure(unhealthyThreshold int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.successes = 0
+	b.failures++
+	if b.alive && b.failures >= unhealthyThreshold {
+		b.alive = false
+		return true
+	}
+	return false
+}
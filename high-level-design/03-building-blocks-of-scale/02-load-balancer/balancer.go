@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer picks the backend that should serve a request.
+// backends only contains backends that are currently eligible for traffic
+// and is never empty.
+type Balancer interface {
+	Next(backends []*Backend, r *http.Request) *Backend
+}
+
+// NewBalancer builds a Balancer from its name, e.g. "least-connections".
+// The header hash takes the header name after a colon: "header-hash:X-User-ID".
+// The consistent hash takes its key source: "consistent-hash:header:X-User-ID"
+// or "consistent-hash:path:2".
+func NewBalancer(name string) (Balancer, error) {
+	algo, arg, _ := strings.Cut(name, ":")
+	switch algo {
+	case "round-robin":
+		return &RoundRobin{}, nil
+	case "weighted-round-robin":
+		return &WeightedRoundRobin{}, nil
+	case "least-connections":
+		return &LeastConnections{}, nil
+	case "p2c":
+		return &PowerOfTwoChoices{}, nil
+	case "ip-hash":
+		return &HashBalancer{}, nil
+	case "header-hash":
+		if arg == "" {
+			return nil, fmt.Errorf("header-hash needs a header name, e.g. header-hash:X-User-ID")
+		}
+		return &HashBalancer{Header: arg}, nil
+	case "consistent-hash":
+		return newConsistentHash(arg)
+	}
+	return nil, fmt.Errorf("unknown balancing algorithm %q", name)
+}
+
+// --- Round Robin ---
+
+// RoundRobin hands requests to each backend in turn.
+type RoundRobin struct {
+	current uint64
+}
+
+func (rr *RoundRobin) Next(backends []*Backend, r *http.Request) *Backend {
+	// Atomically increment the counter to ensure thread safety.
+	// We use modulo to wrap around the list of backends.
+	next := atomic.AddUint64(&rr.current, 1)
+	return backends[next%uint64(len(backends))]
+}
+
+// --- Smooth Weighted Round Robin ---
+
+// WeightedRoundRobin is nginx's "smooth" weighted round robin.
+// With weights 5, 1, 1 it produces a, a, b, a, c, a, a instead of sending
+// five requests in a row to the heaviest backend.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (w *WeightedRoundRobin) Next(backends []*Backend, r *http.Request) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.current == nil {
+		w.current = make(map[*Backend]int)
+	}
+
+	// Every round each backend gains its weight, the richest one wins and
+	// pays back the total. Over time each backend wins in proportion to
+	// its weight, and the wins are spread out evenly.
+	var best *Backend
+	total := 0
+	for _, b := range backends {
+		weight := b.Weight()
+		total += weight
+		w.current[b] += weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	w.current[best] -= total
+
+	// Forget backends that have left the pool.
+	if len(w.current) > len(backends) {
+		present := make(map[*Backend]bool, len(backends))
+		for _, b := range backends {
+			present[b] = true
+		}
+		for b := range w.current {
+			if !present[b] {
+				delete(w.current, b)
+			}
+		}
+	}
+	return best
+}
+
+// --- Least Outstanding Requests ---
+
+// LeastConnections sends the request to the backend with the fewest
+// requests in flight, relative to its weight.
+type LeastConnections struct {
+	offset uint64
+}
+
+func (lc *LeastConnections) Next(backends []*Backend, r *http.Request) *Backend {
+	// Start the scan at a rotating offset so ties (e.g. an idle pool) are
+	// spread across backends instead of always picking the first one.
+	start := atomic.AddUint64(&lc.offset, 1)
+	n := uint64(len(backends))
+
+	var best *Backend
+	for i := uint64(0); i < n; i++ {
+		b := backends[(start+i)%n]
+		if best == nil || loadOf(b) < loadOf(best) {
+			best = b
+		}
+	}
+	return best
+}
+
+// --- Power of Two Random Choices ---
+
+// PowerOfTwoChoices samples two distinct backends at random and keeps the
+// less loaded one. It gets close to least-connections without having to
+// look at every backend, and avoids herding onto a single "best" backend.
+type PowerOfTwoChoices struct{}
+
+func (PowerOfTwoChoices) Next(backends []*Backend, r *http.Request) *Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	i := rand.IntN(len(backends))
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++ // Make sure the two choices are distinct
+	}
+	a, b := backends[i], backends[j]
+	if loadOf(b) < loadOf(a) {
+		return b
+	}
+	return a
+}
+
+// --- Client IP / Header Hash ---
+
+// HashBalancer pins a client to a backend by hashing a request attribute.
+// With Header set it hashes that header (falling back to the client IP
+// when the header is missing); otherwise it hashes the client IP.
+// The mapping changes whenever the set of available backends changes.
+type HashBalancer struct {
+	Header string
+}
+
+func (hb *HashBalancer) Next(backends []*Backend, r *http.Request) *Backend {
+	key := ""
+	if hb.Header != "" {
+		key = r.Header.Get(hb.Header)
+	}
+	if key == "" {
+		key = clientIP(r)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return backends[h.Sum32()%uint32(len(backends))]
+}
+
+// clientIP returns the IP of the peer that sent the request.
+// X-Forwarded-For is deliberately ignored: clients can set it to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loadOf is the number of in-flight requests scaled by weight, so a backend
+// with weight 2 is considered as busy as a weight 1 backend when it has
+// twice as many requests in flight.
+func loadOf(b *Backend) float64 {
+	return float64(b.InFlight()) / float64(b.Weight())
+}
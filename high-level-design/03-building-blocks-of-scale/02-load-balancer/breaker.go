@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through while counting failures.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every request until OpenDuration has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets a few probe requests through to decide whether
+	// the backend has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig controls when a backend's circuit breaker trips.
+type BreakerConfig struct {
+	ConsecutiveFailures int      `json:"consecutive_failures"` // Trip after this many failures in a row
+	ErrorRate           float64  `json:"error_rate"`           // ...or when this fraction of requests in Window failed
+	MinRequests         int      `json:"min_requests"`         // Minimum requests in Window before ErrorRate applies
+	Window              Duration `json:"window"`               // Length of the error rate window
+	OpenDuration        Duration `json:"open_duration"`        // How long to reject requests before probing
+	HalfOpenProbes      int      `json:"half_open_probes"`     // Successful probes needed to close again
+}
+
+// DefaultBreakerConfig returns sensible defaults for local experiments.
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ConsecutiveFailures: 5,
+		ErrorRate:           0.5,
+		MinRequests:         20,
+		Window:              Duration(10 * time.Second),
+		OpenDuration:        Duration(5 * time.Second),
+		HalfOpenProbes:      1,
+	}
+}
+
+// CircuitBreaker protects one backend. Unlike health checks, which look at
+// a dedicated endpoint, the breaker looks at real traffic: a backend that
+// answers /healthz but fails half of its requests is still cut off.
+//
+//	closed --(failures)--> open --(OpenDuration)--> half-open
+//	   ^                                                |
+//	   +----------(HalfOpenProbes successes)------------+
+//	                  (any failure: back to open)
+type CircuitBreaker struct {
+	name string
+
+	mu          sync.Mutex
+	config      BreakerConfig
+	state       BreakerState
+	consecutive int       // Consecutive failures while closed
+	total       int       // Requests in the current window
+	failures    int       // Failures in the current window
+	windowStart time.Time // Start of the current window
+	openedAt    time.Time
+	probes      int // Half-open probes in flight
+	successes   int // Successful half-open probes
+}
+
+func NewCircuitBreaker(name string, config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{name: name, config: config, windowStart: time.Now()}
+}
+
+// SetConfig replaces the thresholds; the current state is kept.
+func (cb *CircuitBreaker) SetConfig(config BreakerConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.config = config
+}
+
+// State returns the current state.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Ready reports whether Allow would currently let a request through,
+// without reserving a half-open probe. It is used to filter candidates.
+func (cb *CircuitBreaker) Ready() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		return time.Since(cb.openedAt) >= time.Duration(cb.config.OpenDuration)
+	case BreakerHalfOpen:
+		return cb.probes < cb.config.HalfOpenProbes
+	}
+	return true
+}
+
+// Allow reports whether a request may be sent to the backend. Every
+// allowed request must be followed by exactly one call to Record or Release.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if time.Since(cb.openedAt) < time.Duration(cb.config.OpenDuration) {
+			return false
+		}
+		cb.transition(BreakerHalfOpen)
+		cb.probes = 1
+		return true
+	case BreakerHalfOpen:
+		if cb.probes >= cb.config.HalfOpenProbes {
+			return false
+		}
+		cb.probes++
+		return true
+	}
+	return true
+}
+
+// Record reports the outcome of a request that Allow let through.
+func (cb *CircuitBreaker) Record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerHalfOpen:
+		cb.probes--
+		if !success {
+			cb.transition(BreakerOpen)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.config.HalfOpenProbes {
+			cb.transition(BreakerClosed)
+		}
+
+	case BreakerClosed:
+		if time.Since(cb.windowStart) > time.Duration(cb.config.Window) {
+			cb.total, cb.failures, cb.windowStart = 0, 0, time.Now()
+		}
+		cb.total++
+		if success {
+			cb.consecutive = 0
+			return
+		}
+		cb.consecutive++
+		cb.failures++
+
+		rate := float64(cb.failures) / float64(cb.total)
+		if cb.consecutive >= cb.config.ConsecutiveFailures ||
+			(cb.total >= cb.config.MinRequests && rate >= cb.config.ErrorRate) {
+			cb.transition(BreakerOpen)
+		}
+	}
+	// Results arriving while open belong to requests sent before the
+	// breaker tripped; they carry no new information.
+}
+
+// Release gives back a request that Allow let through without counting
+// it, for requests whose outcome says nothing about the backend (e.g. the
+// client went away). A half-open probe slot is freed for the next request.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
+
+// transition moves to a new state and resets the counters. Caller holds mu.
+func (cb *CircuitBreaker) transition(to BreakerState) {
+	from := cb.state
+	cb.state = to
+	cb.consecutive, cb.total, cb.failures, cb.windowStart = 0, 0, 0, time.Now()
+	cb.probes, cb.successes = 0, 0
+	if to == BreakerOpen {
+		cb.openedAt = time.Now()
+	}
+	lbStats.breakerTransitions.With(cb.name, to.String()).Inc()
+	fmt.Printf("LB: Circuit breaker for %s: %s -> %s\n", cb.name, from, to)
+}
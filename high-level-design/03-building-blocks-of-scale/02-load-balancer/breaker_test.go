@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	cb := NewCircuitBreaker("test", BreakerConfig{
+		ConsecutiveFailures: 3,
+		ErrorRate:           1,
+		MinRequests:         100,
+		Window:              Duration(time.Minute),
+		OpenDuration:        Duration(20 * time.Millisecond),
+		HalfOpenProbes:      2,
+	})
+
+	// closed -> open after ConsecutiveFailures failures in a row.
+	for range 2 {
+		cb.Allow()
+		cb.Record(false)
+	}
+	cb.Allow()
+	cb.Record(true) // A success resets the streak
+	for range 3 {
+		if cb.State() != BreakerClosed {
+			t.Fatalf("state = %s before the third failure in a row, want closed", cb.State())
+		}
+		cb.Allow()
+		cb.Record(false)
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %s after 3 failures in a row, want open", cb.State())
+	}
+	if cb.Allow() || cb.Ready() {
+		t.Fatal("open breaker let a request through before OpenDuration")
+	}
+
+	// open -> half-open once OpenDuration has passed.
+	time.Sleep(30 * time.Millisecond)
+	if !cb.Ready() || !cb.Allow() {
+		t.Fatal("breaker still rejects requests after OpenDuration")
+	}
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("state = %s after OpenDuration, want half-open", cb.State())
+	}
+	if !cb.Allow() {
+		t.Fatal("second half-open probe rejected, HalfOpenProbes is 2")
+	}
+	if cb.Allow() || cb.Ready() {
+		t.Fatal("half-open breaker let more than HalfOpenProbes requests through")
+	}
+
+	// half-open -> open on any failure.
+	cb.Record(true)
+	cb.Record(false)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %s after a failed probe, want open", cb.State())
+	}
+
+	// half-open -> closed after HalfOpenProbes successes.
+	time.Sleep(30 * time.Millisecond)
+	for range 2 {
+		if !cb.Allow() {
+			t.Fatal("half-open probe rejected")
+		}
+		cb.Record(true)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("state = %s after %d successful probes, want closed", cb.State(), 2)
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	cb := NewCircuitBreaker("test", BreakerConfig{
+		ConsecutiveFailures: 100,
+		ErrorRate:           0.5,
+		MinRequests:         10,
+		Window:              Duration(time.Minute),
+		OpenDuration:        Duration(time.Minute),
+		HalfOpenProbes:      1,
+	})
+
+	// Alternate successes and failures: never two failures in a row, but
+	// half of the requests fail.
+	for i := range 9 {
+		cb.Allow()
+		cb.Record(i%2 == 0)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("state = %s below MinRequests, want closed", cb.State())
+	}
+	cb.Allow()
+	cb.Record(false)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %s at a 50%% error rate over MinRequests, want open", cb.State())
+	}
+}
+
+func TestBreakerReleaseDoesNotCloseHalfOpen(t *testing.T) {
+	pool := &ServerPool{breaker: BreakerConfig{
+		ConsecutiveFailures: 1,
+		ErrorRate:           1,
+		MinRequests:         100,
+		Window:              Duration(time.Minute),
+		OpenDuration:        Duration(10 * time.Millisecond),
+		HalfOpenProbes:      1,
+	}}
+	b, err := pool.AddBackend("http://localhost:8081", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.breaker.Allow()
+	b.breaker.Record(false)
+	time.Sleep(20 * time.Millisecond)
+	if !b.breaker.Allow() || b.BreakerState() != BreakerHalfOpen {
+		t.Fatal("breaker did not let a half-open probe through")
+	}
+
+	// The client cancels the probe: neither a success nor a failure.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	pool.handleError(b, httptest.NewRecorder(), r, context.Canceled)
+	if b.BreakerState() != BreakerHalfOpen {
+		t.Fatalf("state = %s after a cancelled probe, want half-open", b.BreakerState())
+	}
+	if !b.IsAlive() {
+		t.Fatal("a cancelled request counted as a backend failure")
+	}
+
+	// The probe slot is free again for the next request.
+	if !b.breaker.Allow() {
+		t.Fatal("cancelled probe still holds its half-open slot")
+	}
+	b.breaker.Record(true)
+	if b.BreakerState() != BreakerClosed {
+		t.Fatalf("state = %s after a successful probe, want closed", b.BreakerState())
+	}
+}
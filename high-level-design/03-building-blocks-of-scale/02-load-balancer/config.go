@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Config is the on-disk description of the load balancer.
+//
+//	{
+//	  "admin_addr": ":9000",
+//	  "listeners": [{"addr": ":8000", "algorithm": "round-robin"}],
+//	  "backends": [{"url": "http://localhost:8081", "weight": 2}],
+//	  "health_check": {"path": "/healthz", "interval": "2s", ...},
+//	  "retry": {"max_attempts": 3, "per_try_timeout": "5s", ...},
+//	  "circuit_breaker": {"consecutive_failures": 5, ...},
+//	  "shutdown_timeout": "30s"
+//	}
+type Config struct {
+	AdminAddr   string            `json:"admin_addr"`
+	Listeners   []ListenerConfig  `json:"listeners"`
+	Backends    []BackendConfig   `json:"backends"`
+	HealthCheck HealthCheckConfig `json:"health_check"`
+
+	Retry          RetryConfig   `json:"retry"`
+	CircuitBreaker BreakerConfig `json:"circuit_breaker"`
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// when a listener is stopped or the process receives SIGTERM.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// ListenerConfig is one address the balancer accepts traffic on.
+type ListenerConfig struct {
+	Addr      string `json:"addr"`
+	Algorithm string `json:"algorithm"`
+	// Mode is "http" (default, layer 7) or "tcp" (layer 4).
+	Mode string `json:"mode,omitempty"`
+	// StickyCookie enables cookie-based session affinity when set (HTTP only).
+	StickyCookie string `json:"sticky_cookie,omitempty"`
+	// IdleTimeout closes TCP sessions with no traffic in either direction.
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// RateLimit enables per-client rate limiting when set. In TCP mode it
+	// limits new connections per client IP.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+}
+
+func (lc ListenerConfig) mode() string {
+	if lc.Mode == "" {
+		return ModeHTTP
+	}
+	return lc.Mode
+}
+
+// BackendConfig is one upstream server.
+type BackendConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Duration is a time.Duration that reads and writes as "2s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads and validates the config file at path.
+// Missing health check settings fall back to DefaultHealthCheckConfig.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		HealthCheck:     DefaultHealthCheckConfig(),
+		Retry:           DefaultRetryConfig(),
+		CircuitBreaker:  DefaultBreakerConfig(),
+		ShutdownTimeout: Duration(30 * time.Second),
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c Config) validate() error {
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("at least one listener is required")
+	}
+	addrs := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if addrs[l.Addr] {
+			return fmt.Errorf("listener %s is defined twice", l.Addr)
+		}
+		addrs[l.Addr] = true
+		if _, err := NewBalancer(l.Algorithm); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Addr, err)
+		}
+		if rl := l.RateLimit; rl != nil {
+			if rl.Rate <= 0 || rl.Burst < 1 || rl.IdleTTL <= 0 {
+				return fmt.Errorf("listener %s: rate_limit needs a positive rate, burst and idle_ttl", l.Addr)
+			}
+		}
+		switch l.mode() {
+		case ModeHTTP:
+		case ModeTCP:
+			if l.StickyCookie != "" {
+				return fmt.Errorf("listener %s: sticky_cookie needs HTTP mode", l.Addr)
+			}
+		default:
+			return fmt.Errorf("listener %s: unknown mode %q", l.Addr, l.Mode)
+		}
+	}
+	urls := make(map[string]bool)
+	backendMode := "" // ModeHTTP or ModeTCP, from the backend URL schemes
+	for _, b := range c.Backends {
+		u, err := parseBackendURL(b.URL)
+		if err != nil {
+			return err
+		}
+		if urls[u.String()] {
+			return fmt.Errorf("backend %s is defined twice", u)
+		}
+		urls[u.String()] = true
+		var mode string
+		switch u.Scheme {
+		case "http", "https":
+			mode = ModeHTTP
+		case "tcp":
+			mode = ModeTCP
+		default:
+			return fmt.Errorf("backend %s: scheme must be http, https or tcp", u)
+		}
+		if backendMode != "" && mode != backendMode {
+			return fmt.Errorf("backends mix http(s):// and tcp:// URLs")
+		}
+		backendMode = mode
+	}
+	if c.HealthCheck.Type != HealthCheckHTTP && c.HealthCheck.Type != HealthCheckTCP {
+		return fmt.Errorf("health_check type must be %q or %q", HealthCheckHTTP, HealthCheckTCP)
+	}
+
+	// Every listener shares the one pool, so the backends, the listeners and
+	// the health check must all speak the same protocol: an HTTP listener
+	// cannot reverse-proxy to a tcp:// backend, and an HTTP health check
+	// would eject a backend that does not speak HTTP.
+	if backendMode != "" {
+		healthType := HealthCheckHTTP
+		if backendMode == ModeTCP {
+			healthType = HealthCheckTCP
+		}
+		if c.HealthCheck.Type != healthType {
+			return fmt.Errorf("%s backends need a %q health_check, got %q", backendMode, healthType, c.HealthCheck.Type)
+		}
+		for _, l := range c.Listeners {
+			if l.mode() != backendMode {
+				return fmt.Errorf("listener %s: %s mode cannot serve %s backends", l.Addr, l.mode(), backendMode)
+			}
+		}
+	}
+	if c.HealthCheck.Interval <= 0 || c.HealthCheck.Timeout <= 0 {
+		return fmt.Errorf("health_check interval and timeout must be positive")
+	}
+	if c.Retry.MaxAttempts < 1 || c.Retry.PerTryTimeout <= 0 {
+		return fmt.Errorf("retry max_attempts must be at least 1 and per_try_timeout positive")
+	}
+	if c.CircuitBreaker.ConsecutiveFailures < 1 || c.CircuitBreaker.HalfOpenProbes < 1 {
+		return fmt.Errorf("circuit_breaker consecutive_failures and half_open_probes must be at least 1")
+	}
+	if c.CircuitBreaker.ErrorRate <= 0 || c.CircuitBreaker.ErrorRate > 1 {
+		return fmt.Errorf("circuit_breaker error_rate must be above 0 and at most 1")
+	}
+	if c.CircuitBreaker.MinRequests < 1 {
+		return fmt.Errorf("circuit_breaker min_requests must be at least 1")
+	}
+	return nil
+}
+
+// WatchConfig calls reload whenever the process receives SIGHUP or the file
+// at path is modified. Changes are detected by polling the modification
+// time, which keeps the balancer free of platform-specific file watchers.
+func WatchConfig(ctx context.Context, path string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+
+	lastMod := modTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			fmt.Println("LB: SIGHUP received, reloading config")
+			reload()
+		case <-poll.C:
+			if m := modTime(path); !m.Equal(lastMod) {
+				lastMod = m
+				fmt.Println("LB: Config file changed, reloading")
+				reload()
+			}
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
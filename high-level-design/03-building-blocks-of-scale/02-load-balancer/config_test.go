@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadExampleConfigs(t *testing.T) {
+	for _, path := range []string{"lb.json", "lb-tcp.json"} {
+		if _, err := LoadConfig(path); err != nil {
+			t.Errorf("LoadConfig(%s): %v", path, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() Config {
+		return Config{
+			Listeners:      []ListenerConfig{{Addr: ":8000", Algorithm: "round-robin"}},
+			Backends:       []BackendConfig{{URL: "http://localhost:8081"}},
+			HealthCheck:    DefaultHealthCheckConfig(),
+			Retry:          DefaultRetryConfig(),
+			CircuitBreaker: DefaultBreakerConfig(),
+		}
+	}
+	tcp := func(c *Config) {
+		c.Listeners[0].Mode = ModeTCP
+		c.Backends[0].URL = "tcp://localhost:8081"
+		c.HealthCheck.Type = HealthCheckTCP
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*Config)
+		err    string // Substring of the expected error, "" if valid
+	}{
+		{"http", func(c *Config) {}, ""},
+		{"https backend", func(c *Config) { c.Backends[0].URL = "https://localhost:8443" }, ""},
+		{"tcp", tcp, ""},
+		{"unknown scheme", func(c *Config) { c.Backends[0].URL = "ftp://localhost:21" }, "scheme"},
+		{"mixed backends", func(c *Config) {
+			c.Backends = append(c.Backends, BackendConfig{URL: "tcp://localhost:8082"})
+		}, "mix"},
+		{"tcp backend with http health check", func(c *Config) {
+			tcp(c)
+			c.HealthCheck.Type = HealthCheckHTTP
+		}, "health_check"},
+		{"tcp backend behind http listener", func(c *Config) {
+			tcp(c)
+			c.Listeners[0].Mode = ModeHTTP
+		}, "listener :8000"},
+		{"http backend with tcp health check", func(c *Config) { c.HealthCheck.Type = HealthCheckTCP }, "health_check"},
+		{"http backend behind tcp listener", func(c *Config) { c.Listeners[0].Mode = ModeTCP }, "listener :8000"},
+		{"zero error rate", func(c *Config) { c.CircuitBreaker.ErrorRate = 0 }, "error_rate"},
+		{"error rate above 1", func(c *Config) { c.CircuitBreaker.ErrorRate = 1.5 }, "error_rate"},
+		{"error rate of 1", func(c *Config) { c.CircuitBreaker.ErrorRate = 1 }, ""},
+		{"zero min requests", func(c *Config) { c.CircuitBreaker.MinRequests = 0 }, "min_requests"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := valid()
+			tc.modify(&c)
+			err := c.validate()
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("validate accepted the config, want an error about %s", tc.err)
+			case tc.err != "" && !strings.Contains(err.Error(), tc.err):
+				t.Fatalf("error %q does not mention %s", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health check types.
+const (
+	HealthCheckHTTP = "http" // GET Path, expect a 2xx or 3xx answer
+	HealthCheckTCP  = "tcp"  // Open a connection, for non-HTTP backends
+)
+
+// HealthCheckConfig controls how backends are probed.
+type HealthCheckConfig struct {
+	Type               string   `json:"type"`                // "http" or "tcp"
+	Path               string   `json:"path"`                // HTTP path to probe, e.g. "/healthz"
+	Interval           Duration `json:"interval"`            // Time between two rounds of probes
+	Timeout            Duration `json:"timeout"`             // Per-probe timeout
+	HealthyThreshold   int      `json:"healthy_threshold"`   // Consecutive successes before a dead backend is revived
+	UnhealthyThreshold int      `json:"unhealthy_threshold"` // Consecutive failures before a live backend is ejected
+}
+
+// DefaultHealthCheckConfig returns sensible defaults for local experiments.
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Type:               HealthCheckHTTP,
+		Path:               "/healthz",
+		Interval:           Duration(2 * time.Second),
+		Timeout:            Duration(1 * time.Second),
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// HealthChecker actively probes every backend in a pool on a fixed interval.
+// It reads the pool's health check settings before every round, so a config
+// reload takes effect without restarting the checker.
+type HealthChecker struct {
+	pool   *ServerPool
+	client *http.Client
+}
+
+func NewHealthChecker(pool *ServerPool) *HealthChecker {
+	return &HealthChecker{
+		pool:   pool,
+		client: &http.Client{},
+	}
+}
+
+// Start runs health checks until ctx is cancelled.
+func (hc *HealthChecker) Start(ctx context.Context) {
+	for {
+		config := hc.pool.HealthConfig()
+		hc.checkAll(ctx, config)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(config.Interval)):
+		}
+	}
+}
+
+// checkAll probes all backends concurrently so one slow backend does not
+// delay the verdict on the others.
+func (hc *HealthChecker) checkAll(ctx context.Context, config HealthCheckConfig) {
+	var wg sync.WaitGroup
+	for _, b := range hc.pool.Backends() {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			if err := hc.probe(ctx, b, config); err != nil {
+				lbStats.healthCheckFails.With(b.URL.String()).Inc()
+				hc.pool.MarkFailure(b, err)
+			} else {
+				hc.pool.MarkSuccess(b)
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// probe performs a single GET against the backend's health path.
+// Any 2xx or 3xx response counts as healthy. TCP checks only verify that
+// the backend accepts connections.
+func (hc *HealthChecker) probe(ctx context.Context, b *Backend, config HealthCheckConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.Timeout))
+	defer cancel()
+
+	if config.Type == HealthCheckTCP {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", b.URL.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	u := *b.URL
+	u.Path = config.Path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unhealthy status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	pool := &ServerPool{breaker: DefaultBreakerConfig()}
+	b, err := pool.AddBackend(srv.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := HealthCheckConfig{
+		Type:               HealthCheckHTTP,
+		Path:               "/healthz",
+		Timeout:            Duration(time.Second),
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+	pool.SetHealthConfig(config)
+	hc := NewHealthChecker(pool)
+	check := func() { hc.checkAll(context.Background(), config) }
+
+	// A live backend survives UnhealthyThreshold-1 failed checks...
+	healthy.Store(false)
+	for i := range 2 {
+		check()
+		if !b.IsAlive() {
+			t.Fatalf("backend ejected after %d failed checks, threshold is 3", i+1)
+		}
+	}
+	// ...and a success in between resets the count.
+	healthy.Store(true)
+	check()
+	healthy.Store(false)
+	check()
+	check()
+	if !b.IsAlive() {
+		t.Fatal("failures before a successful check counted towards the threshold")
+	}
+	check()
+	if b.IsAlive() {
+		t.Fatal("backend still alive after 3 failed checks in a row")
+	}
+	if len(pool.Available()) != 0 {
+		t.Fatal("dead backend is still available")
+	}
+
+	// A dead backend needs HealthyThreshold successes to come back.
+	healthy.Store(true)
+	check()
+	if b.IsAlive() {
+		t.Fatal("backend revived after 1 successful check, threshold is 2")
+	}
+	check()
+	if !b.IsAlive() {
+		t.Fatal("backend still dead after 2 successful checks")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	pool := &ServerPool{breaker: DefaultBreakerConfig()}
+	b, err := pool.AddBackend(srv.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := HealthCheckConfig{Type: HealthCheckTCP, Timeout: Duration(time.Second), HealthyThreshold: 1, UnhealthyThreshold: 1}
+	hc := NewHealthChecker(pool)
+
+	// A TCP check only cares that the port accepts connections, so the
+	// 404 from the handler does not matter.
+	if err := hc.probe(context.Background(), b, config); err != nil {
+		t.Fatalf("TCP probe of a listening backend: %v", err)
+	}
+	srv.Close()
+	if err := hc.probe(context.Background(), b, config); err == nil {
+		t.Fatal("TCP probe of a closed backend succeeded")
+	}
+}
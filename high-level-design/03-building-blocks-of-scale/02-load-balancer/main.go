@@ -1,74 +1,601 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"sync/atomic"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/metrics"
 )
 
 // ServerPool manages the list of backends and the current status.
+// Backends can be added and removed at runtime (config reload, admin API),
+// so every access goes through the mutex.
 type ServerPool struct {
-	backends []*url.URL
-	current  uint64
+	mu       sync.RWMutex
+	backends []*Backend
+	health   HealthCheckConfig
+	breaker  BreakerConfig
 }
 
-// AddBackend adds a new backend URL to the pool.
-func (s *ServerPool) AddBackend(backendUrl string) {
+// parseBackendURL validates a backend address such as "http://localhost:8081".
+func parseBackendURL(backendUrl string) (*url.URL, error) {
 	u, err := url.Parse(backendUrl)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("backend %q must be an absolute URL", backendUrl)
+	}
+	return u, nil
+}
+
+// AddBackend adds a new backend URL to the pool.
+// Backends start out alive so traffic flows before the first health check.
+func (s *ServerPool) AddBackend(backendUrl string, weight int) (*Backend, error) {
+	u, err := parseBackendURL(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.backends {
+		if b.URL.String() == u.String() {
+			return nil, fmt.Errorf("backend %s already exists", u)
+		}
+	}
+
+	b := &Backend{URL: u, id: backendID(u), weight: weight, alive: true}
+	b.breaker = NewCircuitBreaker(u.String(), s.breaker)
+	b.ReverseProxy = httputil.NewSingleHostReverseProxy(u)
+	b.ReverseProxy.ModifyResponse = b.recordOutcome
+	b.ReverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.handleError(b, w, r, err)
+	}
+	s.backends = append(s.backends, b)
+	return b, nil
+}
+
+// RemoveBackend takes a backend out of the pool. Requests already being
+// proxied to it keep their reference and complete normally.
+func (s *ServerPool) RemoveBackend(backendUrl string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.backends {
+		if b.URL.String() == backendUrl {
+			s.backends = append(s.backends[:i:i], s.backends[i+1:]...)
+			return true
+		}
 	}
-	s.backends = append(s.backends, u)
+	return false
 }
 
-// GetNextBackend returns the next backend to serve a request using Round Robin.
-func (s *ServerPool) GetNextBackend() *url.URL {
-	// Atomically increment the counter to ensure thread safety.
-	// We use modulo to wrap around the list of backends.
-	next := atomic.AddUint64(&s.current, 1)
-	index := int(next % uint64(len(s.backends)))
-	return s.backends[index]
+// Lookup returns the backend with the given URL, or nil.
+func (s *ServerPool) Lookup(backendUrl string) *Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, b := range s.backends {
+		if b.URL.String() == backendUrl {
+			return b
+		}
+	}
+	return nil
 }
 
-// lbHandler is the main HTTP handler for our Load Balancer.
-func lbHandler(w http.ResponseWriter, r *http.Request) {
-	// 1. Choose a backend
-	target := serverPool.GetNextBackend()
+// Backends returns all backends, alive or not.
+func (s *ServerPool) Backends() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Backend(nil), s.backends...)
+}
 
-	// 2. Create a Reverse Proxy
-	// This standard library tool will forward the request to the target
-	// and send the response back to the client.
-	proxy := httputil.NewSingleHostReverseProxy(target)
+// HealthConfig returns the current health check settings.
+func (s *ServerPool) HealthConfig() HealthCheckConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.health
+}
 
-	// Optional: Log the routing decision
-	fmt.Printf("LB: Balancing request to %s\n", target)
+// SetHealthConfig replaces the health check settings.
+func (s *ServerPool) SetHealthConfig(config HealthCheckConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = config
+}
 
-	// 3. Serve the request using the proxy
-	// The Update of the request URL to the target happens inside ServeHTTP
-	proxy.ServeHTTP(w, r)
+// SetBreakerConfig replaces the circuit breaker thresholds of every backend.
+func (s *ServerPool) SetBreakerConfig(config BreakerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breaker = config
+	for _, b := range s.backends {
+		b.breaker.SetConfig(config)
+	}
 }
 
-var serverPool ServerPool
+// MarkSuccess records a successful check against b.
+func (s *ServerPool) MarkSuccess(b *Backend) {
+	if b.RecordSuccess(s.HealthConfig().HealthyThreshold) {
+		fmt.Printf("LB: Backend %s is UP\n", b.URL)
+	}
+}
 
-func main() {
-	// Define our backend servers (these must match the ports we run our scaling app on)
-	serverPool.AddBackend("http://localhost:8081")
-	serverPool.AddBackend("http://localhost:8082")
-	serverPool.AddBackend("http://localhost:8083")
+// MarkFailure records a failed check or proxy attempt against b.
+func (s *ServerPool) MarkFailure(b *Backend, err error) {
+	if b.RecordFailure(s.HealthConfig().UnhealthyThreshold) {
+		fmt.Printf("LB: Backend %s is DOWN (%v)\n", b.URL, err)
+	}
+}
 
-	// Start the Load Balancer on port 8000
-	port := ":8000"
-	fmt.Printf("Load Balancer started on port %s\n", port)
-	fmt.Println("Forwarding traffic to:")
-	for _, b := range serverPool.backends {
-		fmt.Printf(" - %s\n", b)
+// Available returns the backends that may currently receive traffic:
+// healthy, not draining, and not cut off by their circuit breaker.
+func (s *ServerPool) Available() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	available := make([]*Backend, 0, len(s.backends))
+	for _, b := range s.backends {
+		if b.IsAlive() && !b.IsDraining() && b.breaker.Ready() {
+			available = append(available, b)
+		}
 	}
+	return available
+}
+
+// Listener modes: layer 7 (HTTP reverse proxy) or layer 4 (TCP splice).
+const (
+	ModeHTTP = "http"
+	ModeTCP  = "tcp"
+)
+
+// Listener is one address the load balancer accepts traffic on.
+// Each listener has its own balancing algorithm over the shared pool.
+type Listener struct {
+	Addr string
+	Mode string
+	pool *ServerPool
 
-	// Route all traffic to our load balancer handler
-	http.HandleFunc("/", lbHandler)
-	log.Fatal(http.ListenAndServe(port, nil))
+	mu           sync.RWMutex
+	algorithm    string
+	balancer     Balancer
+	stickyCookie string
+	retry        RetryConfig
+	budget       *RetryBudget
+	idleTimeout  time.Duration // TCP mode only
+	limiter      *RateLimiter  // nil when rate limiting is off
+}
+
+// SetBalancer swaps the balancing algorithm. Requests already routed are
+// unaffected; the next request uses the new algorithm.
+func (l *Listener) SetBalancer(algorithm string, balancer Balancer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.algorithm = algorithm
+	l.balancer = balancer
+}
+
+// Algorithm returns the name of the balancing algorithm in use.
+func (l *Listener) Algorithm() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.algorithm
+}
+
+func (l *Listener) currentBalancer() Balancer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.balancer
+}
+
+// SetRetry changes the retry policy. The retry budget is only reset when
+// the policy actually changes.
+func (l *Listener) SetRetry(config RetryConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.budget == nil || l.retry != config {
+		l.retry = config
+		l.budget = NewRetryBudget(config)
+	}
+}
+
+func (l *Listener) retryPolicy() (RetryConfig, *RetryBudget) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.retry, l.budget
+}
+
+// SetIdleTimeout sets how long a TCP session may stay silent before it is closed.
+func (l *Listener) SetIdleTimeout(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idleTimeout = d
+}
+
+// IdleTimeout returns the TCP idle timeout; zero means no timeout.
+func (l *Listener) IdleTimeout() time.Duration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.idleTimeout
+}
+
+// ServeHTTP is the main HTTP handler for our Load Balancer.
+//
+// Idempotent requests that fail before anything reached the client (the
+// backend is unreachable, timed out, or answered 502/503/504) are retried
+// on a different backend, as long as attempts and the retry budget allow.
+func (l *Listener) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	w := metrics.NewStatusRecorder(rw)
+	backend := "none"
+	defer func() {
+		code := w.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		lbStats.requests.With(l.Addr, backend, strconv.Itoa(code)).Inc()
+		lbStats.duration.With(l.Addr, backend).Observe(time.Since(start).Seconds())
+	}()
+
+	if !l.allowRequest(w, r) {
+		return
+	}
+
+	policy, budget := l.retryPolicy()
+	budget.Deposit()
+
+	body, retryable, err := bufferBody(r, policy.MaxBodyBytes)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	retryable = retryable && isIdempotent(r.Method)
+
+	tried := make(map[*Backend]bool)
+	for attempt := 1; ; attempt++ {
+		// 1. Choose a healthy backend we have not tried yet
+		backends := untried(l.pool.Available(), tried)
+		if len(backends) == 0 {
+			// The whole pool is down (or every backend already failed
+			// this request): tell the client to retry later.
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		target := l.stickyBackend(r, backends)
+		if target == nil {
+			target = l.currentBalancer().Next(backends, r)
+			l.setStickyCookie(w, target)
+		}
+		if !target.breaker.Allow() {
+			// Lost a race for the last half-open probe; pick another one.
+			tried[target] = true
+			attempt--
+			continue
+		}
+
+		// This is the last attempt if nothing would allow another one.
+		final := !retryable || attempt >= policy.MaxAttempts ||
+			len(backends) == 1 || !budget.CanRetry()
+
+		backend = target.URL.String()
+
+		// Optional: Log the routing decision
+		fmt.Printf("LB[%s]: Balancing request to %s (attempt %d, in flight: %d)\n", l.Addr, target.URL, attempt, target.InFlight())
+
+		// 2. Serve the request using the backend's Reverse Proxy
+		// This standard library tool will forward the request to the target
+		// and send the response back to the client.
+		ok, err := l.try(w, r, target, body, time.Duration(policy.PerTryTimeout), final)
+		if ok || r.Context().Err() != nil {
+			return
+		}
+		tried[target] = true
+		if !budget.Withdraw() {
+			// Someone else spent the last token since CanRetry.
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		lbStats.retries.With(l.Addr).Inc()
+		fmt.Printf("LB[%s]: Attempt %d on %s failed (%v), retrying\n", l.Addr, attempt, target.URL, err)
+	}
 }
 
+// untried filters out the backends that already failed this request.
+func untried(backends []*Backend, tried map[*Backend]bool) []*Backend {
+	if len(tried) == 0 {
+		return backends
+	}
+	remaining := backends[:0]
+	for _, b := range backends {
+		if !tried[b] {
+			remaining = append(remaining, b)
+		}
+	}
+	return remaining
+}
+
+// server is what a listener runs on: an *http.Server or a *TCPServer.
+type server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// LoadBalancer ties the pool, the listeners and the admin API together and
+// knows how to move from one Config to the next without a restart.
+type LoadBalancer struct {
+	pool *ServerPool
+
+	mu              sync.Mutex
+	listeners       map[string]*Listener
+	servers         map[string]server
+	shutdownTimeout time.Duration
+	errs            chan error
+}
+
+func NewLoadBalancer() *LoadBalancer {
+	lb := &LoadBalancer{
+		pool:      &ServerPool{},
+		listeners: make(map[string]*Listener),
+		servers:   make(map[string]server),
+		errs:      make(chan error, 1),
+	}
+	lbStats.registerPool(lb.pool)
+	return lb
+}
+
+// Apply brings the running balancer in line with cfg.
+//
+//   - Backends are matched by URL: new ones are added, missing ones are
+//     removed and weights are updated in place (keeping health state).
+//   - Listeners are matched by address: new ones start, removed ones shut
+//     down gracefully, and an algorithm change swaps the balancer.
+//     Switching a listener between HTTP and TCP mode needs a restart.
+//
+// Apply is all or nothing: everything that can fail, including binding the
+// new listeners' addresses, happens before anything is changed, so a
+// rejected config leaves the balancer as it was. In-flight requests are
+// never interrupted.
+func (lb *LoadBalancer) Apply(cfg Config) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	// 1. Check everything that can fail
+	backendURLs := make([]*url.URL, len(cfg.Backends))
+	for i, bc := range cfg.Backends {
+		u, err := parseBackendURL(bc.URL)
+		if err != nil {
+			return err
+		}
+		backendURLs[i] = u
+	}
+	balancers := make([]Balancer, len(cfg.Listeners))
+	for i, lc := range cfg.Listeners {
+		if l, ok := lb.listeners[lc.Addr]; ok && l.Mode != lc.mode() {
+			return fmt.Errorf("listener %s: changing mode from %s to %s requires a restart", lc.Addr, l.Mode, lc.mode())
+		}
+		balancer, err := NewBalancer(lc.Algorithm)
+		if err != nil {
+			return err
+		}
+		balancers[i] = balancer
+	}
+
+	// 2. Bind the new listeners. If one address is taken, release the
+	// others and reject the whole config.
+	bound := make(map[string]net.Listener)
+	for _, lc := range cfg.Listeners {
+		if _, ok := lb.listeners[lc.Addr]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			for _, ln := range bound {
+				ln.Close()
+			}
+			return fmt.Errorf("listener %s: %w", lc.Addr, err)
+		}
+		bound[lc.Addr] = ln
+	}
+
+	lb.pool.SetHealthConfig(cfg.HealthCheck)
+	lb.pool.SetBreakerConfig(cfg.CircuitBreaker)
+	lb.shutdownTimeout = time.Duration(cfg.ShutdownTimeout)
+
+	// 3. Backends
+	wanted := make(map[string]bool)
+	for i, bc := range cfg.Backends {
+		u := backendURLs[i]
+		wanted[u.String()] = true
+		if b := lb.pool.Lookup(u.String()); b != nil {
+			b.SetWeight(bc.Weight)
+			continue
+		}
+		if _, err := lb.pool.AddBackend(u.String(), bc.Weight); err != nil {
+			// Only a duplicate URL gets here, which validate rejects.
+			fmt.Printf("LB: Skipping backend %s: %v\n", u, err)
+			continue
+		}
+		fmt.Printf("LB: Added backend %s (weight %d)\n", u, bc.Weight)
+	}
+	for _, b := range lb.pool.Backends() {
+		if !wanted[b.URL.String()] {
+			lb.pool.RemoveBackend(b.URL.String())
+			fmt.Printf("LB: Removed backend %s\n", b.URL)
+		}
+	}
+
+	// 4. Listeners
+	wantedAddrs := make(map[string]bool)
+	for i, lc := range cfg.Listeners {
+		wantedAddrs[lc.Addr] = true
+		balancer := balancers[i]
+
+		if l, ok := lb.listeners[lc.Addr]; ok {
+			l.SetStickyCookie(lc.StickyCookie)
+			l.SetRetry(cfg.Retry)
+			l.SetIdleTimeout(time.Duration(lc.IdleTimeout))
+			l.SetRateLimit(lc.RateLimit)
+			// Keep the existing balancer (and its state) if nothing changed.
+			if l.Algorithm() != lc.Algorithm {
+				l.SetBalancer(lc.Algorithm, balancer)
+				fmt.Printf("LB: Listener %s now uses %s\n", lc.Addr, lc.Algorithm)
+			}
+			continue
+		}
+
+		l := &Listener{Addr: lc.Addr, Mode: lc.mode(), pool: lb.pool}
+		l.SetBalancer(lc.Algorithm, balancer)
+		l.SetStickyCookie(lc.StickyCookie)
+		l.SetRetry(cfg.Retry)
+		l.SetIdleTimeout(time.Duration(lc.IdleTimeout))
+		l.SetRateLimit(lc.RateLimit)
+
+		ln := bound[lc.Addr]
+		var serve func() error
+		if l.Mode == ModeTCP {
+			srv := NewTCPServer(l)
+			lb.servers[lc.Addr] = srv
+			serve = func() error { return srv.Serve(ln) }
+		} else {
+			srv := &http.Server{Addr: lc.Addr, Handler: l}
+			lb.servers[lc.Addr] = srv
+			serve = func() error { return srv.Serve(ln) }
+		}
+		lb.listeners[lc.Addr] = l
+
+		fmt.Printf("Load Balancer listening on %s (%s) using %s\n", lc.Addr, l.Mode, lc.Algorithm)
+		go func() {
+			if err := serve(); err != nil && err != http.ErrServerClosed {
+				lb.errs <- err
+			}
+		}()
+	}
+	for addr, srv := range lb.servers {
+		if wantedAddrs[addr] {
+			continue
+		}
+		delete(lb.listeners, addr)
+		delete(lb.servers, addr)
+		fmt.Printf("LB: Stopping listener %s\n", addr)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), lb.shutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(ctx); err != nil {
+				fmt.Printf("LB: Listener %s did not drain in time: %v\n", addr, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Shutdown gracefully stops every listener: they stop accepting new
+// connections and wait for in-flight requests to complete, until ctx
+// expires. Listeners are shut down in parallel so they share one deadline.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	lb.mu.Lock()
+	servers := make(map[string]server, len(lb.servers))
+	for addr, srv := range lb.servers {
+		servers[addr] = srv
+	}
+	lb.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for addr, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("listener %s: %w", addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs // nil if every listener drained
+}
+
+// Listeners returns a snapshot of the active listeners.
+func (lb *LoadBalancer) Listeners() []*Listener {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	listeners := make([]*Listener, 0, len(lb.listeners))
+	for _, l := range lb.listeners {
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+func main() {
+	configPath := flag.String("config", "lb.json", "Path to the load balancer config file (JSON)")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// ctx is cancelled on SIGINT/SIGTERM, which starts the graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	lb := NewLoadBalancer()
+	if err := lb.Apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	// Start probing backends in the background
+	checker := NewHealthChecker(lb.pool)
+	go checker.Start(ctx)
+
+	// Reload on SIGHUP or when the file changes. A broken config is
+	// reported and ignored: the balancer keeps running with the last good one.
+	go WatchConfig(ctx, *configPath, func() {
+		cfg, err := LoadConfig(*configPath)
+		if err == nil {
+			err = lb.Apply(cfg)
+		}
+		if err != nil {
+			fmt.Printf("LB: Reload failed, keeping previous config: %v\n", err)
+		}
+	})
+
+	// The admin API lets operators inspect and change the pool at runtime.
+	// Its address is only read at startup.
+	admin := &http.Server{Addr: cfg.AdminAddr, Handler: NewAdminHandler(lb)}
+	if cfg.AdminAddr != "" {
+		fmt.Printf("Admin API listening on %s\n", cfg.AdminAddr)
+		go func() {
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				lb.errs <- err
+			}
+		}()
+	}
+
+	select {
+	case err := <-lb.errs:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// Graceful shutdown: stop accepting connections, then give in-flight
+	// requests until the deadline to complete.
+	timeout := time.Duration(cfg.ShutdownTimeout)
+	fmt.Printf("LB: Shutting down, waiting up to %v for in-flight requests...\n", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := lb.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("LB: Forced shutdown: %v\n", err)
+	}
+	admin.Shutdown(shutdownCtx)
+	fmt.Println("LB: Bye.")
+}
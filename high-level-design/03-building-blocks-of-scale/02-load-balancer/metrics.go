@@ -0,0 +1,75 @@
+package main
+
+import (
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/metrics"
+)
+
+// lbMetrics are the load balancer's metrics, served on the admin API's
+// /metrics endpoint in Prometheus text format.
+type lbMetrics struct {
+	registry *metrics.Registry
+
+	requests           *metrics.Counter   // Client requests by listener, backend and status code
+	duration           *metrics.Histogram // Client-observed latency by listener and backend
+	retries            *metrics.Counter   // Retries by listener
+	backendErrors      *metrics.Counter   // Failed attempts by backend and reason
+	healthCheckFails   *metrics.Counter   // Failed active health checks by backend
+	breakerTransitions *metrics.Counter   // Circuit breaker state changes by backend and new state
+	tcpConnections     *metrics.Counter   // Spliced TCP connections by listener and backend
+	rateLimited        *metrics.Counter   // Requests rejected with 429 by listener
+}
+
+var lbStats = newLBMetrics()
+
+func newLBMetrics() *lbMetrics {
+	reg := metrics.NewRegistry()
+	return &lbMetrics{
+		registry:           reg,
+		requests:           reg.NewCounter("lb_requests_total", "HTTP requests answered, by listener, backend and status code.", "listener", "backend", "code"),
+		duration:           reg.NewHistogram("lb_request_duration_seconds", "HTTP request latency including retries, by listener and backend.", metrics.DefaultBuckets, "listener", "backend"),
+		retries:            reg.NewCounter("lb_retries_total", "Requests retried on another backend, by listener.", "listener"),
+		backendErrors:      reg.NewCounter("lb_backend_errors_total", "Failed proxy attempts, by backend and reason.", "backend", "reason"),
+		healthCheckFails:   reg.NewCounter("lb_health_check_failures_total", "Failed active health checks, by backend.", "backend"),
+		breakerTransitions: reg.NewCounter("lb_circuit_breaker_transitions_total", "Circuit breaker state changes, by backend and new state.", "backend", "state"),
+		tcpConnections:     reg.NewCounter("lb_tcp_connections_total", "TCP connections spliced to a backend, by listener and backend.", "listener", "backend"),
+		rateLimited:        reg.NewCounter("lb_rate_limited_total", "Requests or connections rejected by the per-client rate limit, by listener.", "listener"),
+	}
+}
+
+// registerPool adds gauges that read the pool's live state at scrape time.
+func (m *lbMetrics) registerPool(pool *ServerPool) {
+	m.registry.NewGaugeFunc("lb_backend_up", "1 if the backend passes health checks, 0 otherwise.", []string{"backend"},
+		func(emit func(float64, ...string)) {
+			for _, b := range pool.Backends() {
+				emit(boolToFloat(b.IsAlive()), b.URL.String())
+			}
+		})
+	m.registry.NewGaugeFunc("lb_backend_draining", "1 if the backend is draining, 0 otherwise.", []string{"backend"},
+		func(emit func(float64, ...string)) {
+			for _, b := range pool.Backends() {
+				emit(boolToFloat(b.IsDraining()), b.URL.String())
+			}
+		})
+	m.registry.NewGaugeFunc("lb_backend_in_flight", "Requests (or TCP connections) currently proxied to the backend.", []string{"backend"},
+		func(emit func(float64, ...string)) {
+			for _, b := range pool.Backends() {
+				emit(float64(b.InFlight()), b.URL.String())
+			}
+		})
+	m.registry.NewGaugeFunc("lb_circuit_breaker_state", "1 for the circuit breaker's current state, 0 for the others.", []string{"backend", "state"},
+		func(emit func(float64, ...string)) {
+			for _, b := range pool.Backends() {
+				current := b.BreakerState()
+				for _, s := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+					emit(boolToFloat(s == current), b.URL.String(), s.String())
+				}
+			}
+		})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
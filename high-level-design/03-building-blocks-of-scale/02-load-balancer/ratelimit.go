@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits how fast a single client may send requests.
+// Clients are told apart by KeyHeader (e.g. an API key) when present,
+// otherwise by IP address.
+type RateLimitConfig struct {
+	Rate      float64  `json:"rate"`       // Sustained requests per second per client
+	Burst     int      `json:"burst"`      // Requests a client may send at once after being idle
+	KeyHeader string   `json:"key_header"` // Optional header identifying the client
+	IdleTTL   Duration `json:"idle_ttl"`   // Forget clients idle for this long
+}
+
+// RateLimiter is a per-client token bucket, the same idea as the ticker in
+// 02-design-patterns/12-rate-limiting but with one bucket per client and
+// room for bursts. Each bucket holds up to Burst tokens and refills at Rate
+// tokens per second; a request spends one token or is rejected.
+//
+// Buckets of clients that have been quiet for IdleTTL are dropped, so
+// memory is bounded by the number of recently active clients. A bucket that
+// has been idle for Burst/Rate seconds is full anyway, so with IdleTTL above
+// that, dropping it loses nothing.
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // Last refill, also used to detect idle clients
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    config,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// RateLimitResult describes the client's quota after a call to Allow.
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // Whole tokens left
+	RetryAfter time.Duration // Until the next token, when not allowed
+	Reset      time.Duration // Until the bucket is full again
+}
+
+// Allow spends a token from key's bucket if one is available.
+func (rl *RateLimiter) Allow(key string) RateLimitResult {
+	now := time.Now()
+	burst := float64(rl.config.Burst)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	// Refill for the time elapsed since the last request.
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.config.Rate)
+	b.last = now
+
+	result := RateLimitResult{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = rl.timeToRefill(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = rl.timeToRefill(burst - b.tokens)
+	return result
+}
+
+func (rl *RateLimiter) timeToRefill(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.config.Rate * float64(time.Second))
+}
+
+// sweep drops idle buckets, at most once per IdleTTL. Caller holds mu.
+func (rl *RateLimiter) sweep(now time.Time) {
+	ttl := time.Duration(rl.config.IdleTTL)
+	if now.Sub(rl.lastSweep) < ttl {
+		return
+	}
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) >= ttl {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Key returns the identity a request is rate limited under.
+func (rl *RateLimiter) Key(r *http.Request) string {
+	if rl.config.KeyHeader != "" {
+		if key := r.Header.Get(rl.config.KeyHeader); key != "" {
+			return "key:" + key
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// writeHeaders sets the RateLimit-* headers from the IETF draft
+// (draft-ietf-httpapi-ratelimit-headers) and, when rejected, Retry-After.
+func (rl *RateLimiter) writeHeaders(w http.ResponseWriter, res RateLimitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(rl.config.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// SetRateLimit enables per-client rate limiting on the listener, or
+// disables it when config is nil. Existing buckets are kept if the
+// limits did not change.
+func (l *Listener) SetRateLimit(config *RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case config == nil:
+		l.limiter = nil
+	case l.limiter == nil || l.limiter.config != *config:
+		l.limiter = NewRateLimiter(*config)
+	}
+}
+
+func (l *Listener) rateLimiter() *RateLimiter {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limiter
+}
+
+// allowRequest applies the listener's rate limit, answering 429 itself when
+// the client is over its limit. It returns false if the request must stop.
+func (l *Listener) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	rl := l.rateLimiter()
+	if rl == nil {
+		return true
+	}
+	res := rl.Allow(rl.Key(r))
+	rl.writeHeaders(w, res)
+	if !res.Allowed {
+		lbStats.rateLimited.With(l.Addr).Inc()
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
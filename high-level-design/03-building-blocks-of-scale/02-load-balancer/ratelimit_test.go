@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{Rate: 50, Burst: 3, IdleTTL: Duration(time.Minute)})
+
+	// A fresh client may send Burst requests at once.
+	for i := range 3 {
+		res := rl.Allow("alice")
+		if !res.Allowed {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("request %d: Remaining = %d, want %d", i+1, res.Remaining, 2-i)
+		}
+	}
+	res := rl.Allow("alice")
+	if res.Allowed {
+		t.Fatal("request past the burst allowed")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > 20*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want at most one token interval (20ms)", res.RetryAfter)
+	}
+
+	// Buckets are per client.
+	if !rl.Allow("bob").Allowed {
+		t.Fatal("another client was throttled by alice's bucket")
+	}
+
+	// 50 per second is one token every 20ms.
+	time.Sleep(50 * time.Millisecond)
+	if !rl.Allow("alice").Allowed {
+		t.Fatal("bucket did not refill")
+	}
+
+	// The bucket never holds more than Burst tokens, however long it idles.
+	time.Sleep(200 * time.Millisecond)
+	allowed := 0
+	for rl.Allow("alice").Allowed {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Fatalf("idle bucket allowed %d requests, want Burst (3)", allowed)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryConfig controls how failed requests are retried on other backends.
+type RetryConfig struct {
+	MaxAttempts      int      `json:"max_attempts"`        // Including the first try; 1 disables retries
+	PerTryTimeout    Duration `json:"per_try_timeout"`     // Deadline for each attempt, including the body
+	BudgetRatio      float64  `json:"budget_ratio"`        // Retries allowed as a fraction of requests
+	MinRetriesPerSec float64  `json:"min_retries_per_sec"` // Retries always allowed at low traffic
+	MaxBodyBytes     int64    `json:"max_body_bytes"`      // Larger request bodies are streamed, not retried
+}
+
+// DefaultRetryConfig returns sensible defaults for local experiments.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:      3,
+		PerTryTimeout:    Duration(5 * time.Second),
+		BudgetRatio:      0.2,
+		MinRetriesPerSec: 5,
+		MaxBodyBytes:     1 << 20,
+	}
+}
+
+// RetryBudget caps retries to a fraction of the traffic, so that when the
+// whole pool is struggling retries do not multiply the load on it (a retry
+// storm). Every request deposits BudgetRatio tokens, every retry spends one,
+// and MinRetriesPerSec tokens trickle in so low-traffic listeners can still
+// retry. The balance is capped at ten seconds' worth of the trickle.
+type RetryBudget struct {
+	mu       sync.Mutex
+	config   RetryConfig
+	tokens   float64
+	lastFill time.Time
+}
+
+func NewRetryBudget(config RetryConfig) *RetryBudget {
+	return &RetryBudget{config: config, tokens: config.MinRetriesPerSec, lastFill: time.Now()}
+}
+
+// Deposit records an incoming request.
+func (rb *RetryBudget) Deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.refill()
+	rb.tokens = min(rb.tokens+rb.config.BudgetRatio, rb.capacity())
+}
+
+// CanRetry reports whether a retry would currently be allowed.
+func (rb *RetryBudget) CanRetry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.refill()
+	return rb.tokens >= 1
+}
+
+// Withdraw spends one retry. It returns false if the budget is exhausted.
+func (rb *RetryBudget) Withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.refill()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+func (rb *RetryBudget) capacity() float64 {
+	return max(rb.config.MinRetriesPerSec, 1) * 10
+}
+
+// refill adds the trickle for the time since the last call. Caller holds mu.
+func (rb *RetryBudget) refill() {
+	now := time.Now()
+	rb.tokens = min(rb.tokens+now.Sub(rb.lastFill).Seconds()*rb.config.MinRetriesPerSec, rb.capacity())
+	rb.lastFill = now
+}
+
+// attempt carries per-try state from the listener to the backend's
+// ReverseProxy hooks through the outgoing request's context.
+type attempt struct {
+	// final is true if no retry will follow this attempt, so errors must be
+	// written to the client instead of being swallowed.
+	final bool
+	// err is the error that made a non-final attempt fail.
+	err error
+}
+
+type attemptKey struct{}
+
+func attemptFrom(ctx context.Context) *attempt {
+	a, _ := ctx.Value(attemptKey{}).(*attempt)
+	return a
+}
+
+// errRetryableStatus is returned from ModifyResponse to turn a 502/503/504
+// answer into a retry instead of passing it on to the client.
+var errRetryableStatus = errors.New("retryable status")
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// isIdempotent reports whether the method may safely be sent twice.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory so it can be replayed on
+// another backend. It returns retryable=false (and leaves the body
+// streamable) when the body is larger than limit.
+func bufferBody(r *http.Request, limit int64) (body []byte, retryable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		// Too big to buffer: stitch the consumed prefix back in front of
+		// the rest of the body and send it once.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return buf, true, nil
+}
+
+// try sends one attempt of r to target. It returns true if a response (good
+// or bad) was written to the client, false if the attempt failed silently
+// and may be retried.
+func (l *Listener) try(w http.ResponseWriter, r *http.Request, target *Backend, body []byte, timeout time.Duration, final bool) (bool, error) {
+	a := &attempt{final: final}
+	ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), attemptKey{}, a), timeout)
+	defer cancel()
+
+	out := r.Clone(ctx)
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+	}
+
+	target.ServeHTTP(w, out)
+	return a.err == nil, a.err
+}
+
+// recordOutcome feeds a response into the backend's circuit breaker and
+// decides whether a non-final attempt should be retried instead.
+// It is installed as the ReverseProxy's ModifyResponse hook.
+func (b *Backend) recordOutcome(resp *http.Response) error {
+	failed := resp.StatusCode >= 500
+	b.breaker.Record(!failed)
+
+	a := attemptFrom(resp.Request.Context())
+	if failed && a != nil && !a.final && isRetryableStatus(resp.StatusCode) {
+		return fmt.Errorf("%w %d", errRetryableStatus, resp.StatusCode)
+	}
+	return nil
+}
+
+// handleError is the ReverseProxy's ErrorHandler. It runs before anything
+// was written to the client, so a non-final attempt can still be retried.
+func (s *ServerPool) handleError(b *Backend, w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errRetryableStatus):
+		// Already counted by recordOutcome.
+		lbStats.backendErrors.With(b.URL.String(), "status").Inc()
+	case errors.Is(err, context.Canceled):
+		// The client went away; that says nothing about the backend.
+		b.breaker.Release()
+	default:
+		reason := "connection"
+		if errors.Is(err, context.DeadlineExceeded) {
+			reason = "timeout"
+		}
+		lbStats.backendErrors.With(b.URL.String(), reason).Inc()
+		// Passive health checking: a failed proxy attempt counts the same
+		// as a failed probe, so a crashed backend is ejected without
+		// waiting for the next health check round.
+		s.MarkFailure(b, err)
+		b.breaker.Record(false)
+	}
+
+	if a := attemptFrom(r.Context()); a != nil && !a.final {
+		a.err = err
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetExhaustion(t *testing.T) {
+	rb := NewRetryBudget(RetryConfig{BudgetRatio: 0.25, MinRetriesPerSec: 0})
+
+	// With no trickle the budget starts empty.
+	if rb.CanRetry() || rb.Withdraw() {
+		t.Fatal("empty budget allowed a retry")
+	}
+
+	// Eight requests earn two retries, and not a third one.
+	for range 8 {
+		rb.Deposit()
+	}
+	for i := range 2 {
+		if !rb.Withdraw() {
+			t.Fatalf("retry %d rejected after 8 requests at a 0.25 ratio", i+1)
+		}
+	}
+	if rb.CanRetry() || rb.Withdraw() {
+		t.Fatal("budget allowed more retries than a quarter of the requests")
+	}
+}
+
+func TestRetryBudgetTrickle(t *testing.T) {
+	rb := NewRetryBudget(RetryConfig{MinRetriesPerSec: 100})
+
+	// The budget starts with one second's worth of the trickle.
+	for i := range 100 {
+		if !rb.Withdraw() {
+			t.Fatalf("retry %d rejected, want 100 to start with", i+1)
+		}
+	}
+	if rb.Withdraw() {
+		t.Fatal("retry allowed after the initial budget was spent")
+	}
+
+	// 100 per second is one every 10ms.
+	time.Sleep(30 * time.Millisecond)
+	if !rb.Withdraw() {
+		t.Fatal("trickle did not refill the budget")
+	}
+}
+
+func TestRetryBudgetCapacity(t *testing.T) {
+	rb := NewRetryBudget(RetryConfig{BudgetRatio: 1, MinRetriesPerSec: 1})
+
+	// The balance is capped at ten seconds' worth of the trickle.
+	for range 100 {
+		rb.Deposit()
+	}
+	retries := 0
+	for rb.Withdraw() {
+		retries++
+	}
+	if retries != 10 {
+		t.Fatalf("got %d retries from a full budget, want 10", retries)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HashRing is the consistent hash ring from
+// 05-advanced-concepts/01-consistent-hashing, holding backends instead of
+// node names. Each backend gets replicas*weight virtual nodes so heavier
+// backends own a proportionally larger arc of the ring.
+type HashRing struct {
+	// Sorted list of hash values (keys) on the ring.
+	keys []int
+	// Map from hash value to backend.
+	hashMap map[int]*Backend
+	// Number of virtual nodes per unit of weight.
+	replicas int
+}
+
+func NewHashRing(replicas int, backends []*Backend) *HashRing {
+	h := &HashRing{
+		replicas: replicas,
+		hashMap:  make(map[int]*Backend),
+	}
+	for _, b := range backends {
+		for i := 0; i < h.replicas*b.Weight(); i++ {
+			// Create virtual node key: "http://host:8081#1", "#2", etc.
+			virtualNodeKey := b.URL.String() + "#" + strconv.Itoa(i)
+			hash := ringHash(virtualNodeKey)
+			h.keys = append(h.keys, hash)
+			h.hashMap[hash] = b
+		}
+	}
+	// Keep the keys sorted for binary search.
+	sort.Ints(h.keys)
+	return h
+}
+
+// Get finds the closest backend clockwise for a given key.
+func (h *HashRing) Get(key string) *Backend {
+	if len(h.keys) == 0 {
+		return nil
+	}
+
+	hash := ringHash(key)
+
+	// Binary Search: Find the first key on the ring >= hash
+	idx := sort.Search(len(h.keys), func(i int) bool {
+		return h.keys[i] >= hash
+	})
+
+	// Wrap around: If we reached the end of the slice, go to the start (0).
+	if idx == len(h.keys) {
+		idx = 0
+	}
+	return h.hashMap[h.keys[idx]]
+}
+
+// ringHash places a key on the ring. Virtual node keys differ only in a
+// few trailing bytes, and CRC32 is linear, so on its own it clusters them
+// and leaves some backends with twice the arc of others. The murmur3
+// finalizer scatters those nearby checksums across the whole ring.
+func ringHash(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return int(h)
+}
+
+// ConsistentHash routes requests by a key taken from the request, so the
+// same key keeps hitting the same backend. Unlike HashBalancer, adding or
+// removing a backend only remaps the keys on that backend's arcs.
+type ConsistentHash struct {
+	// Header to read the key from, e.g. "X-User-ID".
+	Header string
+	// PathSegment is the 1-based path segment to use as the key when Header
+	// is empty, e.g. 2 picks "42" out of "/users/42/orders".
+	PathSegment int
+
+	mu        sync.Mutex
+	ring      *HashRing
+	signature string // Backends (and weights) the ring was built from
+}
+
+// ringReplicas is the number of virtual nodes per unit of backend weight.
+const ringReplicas = 100
+
+// newConsistentHash parses "header:<Name>" or "path:<N>".
+func newConsistentHash(arg string) (Balancer, error) {
+	source, value, _ := strings.Cut(arg, ":")
+	switch source {
+	case "header":
+		if value != "" {
+			return &ConsistentHash{Header: value}, nil
+		}
+	case "path":
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return &ConsistentHash{PathSegment: n}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid consistent-hash key source %q, expected header:<Name> or path:<N>", arg)
+}
+
+func (ch *ConsistentHash) Next(backends []*Backend, r *http.Request) *Backend {
+	key := ch.key(r)
+	if key == "" {
+		key = clientIP(r)
+	}
+	return ch.ringFor(backends).Get(key)
+}
+
+// key extracts the routing key from the request, or "" if it is missing.
+func (ch *ConsistentHash) key(r *http.Request) string {
+	if ch.Header != "" {
+		return r.Header.Get(ch.Header)
+	}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if ch.PathSegment <= len(segments) {
+		return segments[ch.PathSegment-1]
+	}
+	return ""
+}
+
+// ringFor returns a ring over exactly the given backends, rebuilding it
+// only when the set of available backends (or their weights) changed.
+func (ch *ConsistentHash) ringFor(backends []*Backend) *HashRing {
+	var sb strings.Builder
+	for _, b := range backends {
+		sb.WriteString(b.URL.String())
+		sb.WriteByte('*')
+		sb.WriteString(strconv.Itoa(b.Weight()))
+		sb.WriteByte(',')
+	}
+	signature := sb.String()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.ring == nil || ch.signature != signature {
+		ch.ring = NewHashRing(ringReplicas, backends)
+		ch.signature = signature
+	}
+	return ch.ring
+}
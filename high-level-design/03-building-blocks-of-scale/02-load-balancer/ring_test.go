@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func testBackends(t *testing.T, n int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, n)
+	for i := range backends {
+		u, err := url.Parse(fmt.Sprintf("http://localhost:%d", 8081+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = &Backend{URL: u, weight: 1, alive: true}
+	}
+	return backends
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	backends := testBackends(t, 5)
+	ring := NewHashRing(ringReplicas, backends)
+
+	const keys = 50000
+	counts := make(map[*Backend]int)
+	for i := range keys {
+		counts[ring.Get("user-"+strconv.Itoa(i))]++
+	}
+
+	// With 100 virtual nodes each backend should get close to its share.
+	share := keys / len(backends)
+	for _, b := range backends {
+		if c := counts[b]; c < share*7/10 || c > share*13/10 {
+			t.Errorf("%s got %d keys, want about %d", b.URL, c, share)
+		}
+	}
+}
+
+func TestHashRingWeights(t *testing.T) {
+	backends := testBackends(t, 2)
+	backends[0].SetWeight(3)
+	ring := NewHashRing(ringReplicas, backends)
+
+	counts := make(map[*Backend]int)
+	for i := range 40000 {
+		counts[ring.Get("user-"+strconv.Itoa(i))]++
+	}
+	ratio := float64(counts[backends[0]]) / float64(counts[backends[1]])
+	if ratio < 2 || ratio > 4 {
+		t.Errorf("weight 3 vs 1 split the keys %d/%d, want about 3:1", counts[backends[0]], counts[backends[1]])
+	}
+}
+
+func TestHashRingRemoval(t *testing.T) {
+	backends := testBackends(t, 5)
+	before := NewHashRing(ringReplicas, backends)
+	removed := backends[2]
+	after := NewHashRing(ringReplicas, append(backends[:2:2], backends[3:]...))
+
+	const keys = 20000
+	moved := 0
+	for i := range keys {
+		key := "user-" + strconv.Itoa(i)
+		was, is := before.Get(key), after.Get(key)
+		if is == removed {
+			t.Fatalf("key %s still maps to the removed backend", key)
+		}
+		if was != removed && was != is {
+			t.Fatalf("key %s moved from %s to %s, but only keys of the removed backend should move", key, was.URL, is.URL)
+		}
+		if was != is {
+			moved++
+		}
+	}
+
+	// Only the removed backend's share (about a fifth) is remapped.
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Errorf("%d of %d keys moved, want about %d", moved, keys, keys/5)
+	}
+}
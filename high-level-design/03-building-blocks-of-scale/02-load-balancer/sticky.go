@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Sticky sessions pin a client to the backend that served its first
+// request by handing out a cookie naming that backend. The cookie is
+// honoured for as long as the backend is available; once it is down or
+// draining the client is rebalanced and gets a new cookie.
+//
+// The cookie holds the backend's opaque ID rather than its address, so
+// clients do not learn anything about the internal network.
+
+// SetStickyCookie enables cookie-based affinity with the given cookie name.
+// An empty name disables it.
+func (l *Listener) SetStickyCookie(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stickyCookie = name
+}
+
+// StickyCookie returns the affinity cookie name, or "" if disabled.
+func (l *Listener) StickyCookie() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stickyCookie
+}
+
+// stickyBackend returns the backend named by the request's affinity cookie
+// if it is among the available backends.
+func (l *Listener) stickyBackend(r *http.Request, backends []*Backend) *Backend {
+	name := l.StickyCookie()
+	if name == "" {
+		return nil
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil
+	}
+	for _, b := range backends {
+		if b.ID() == cookie.Value {
+			return b
+		}
+	}
+	return nil
+}
+
+// setStickyCookie tells the client which backend to come back to.
+func (l *Listener) setStickyCookie(w http.ResponseWriter, b *Backend) {
+	name := l.StickyCookie()
+	if name == "" {
+		return
+	}
+	// A previous attempt of this request may have picked a backend that
+	// then failed; only the backend that actually answers should stick.
+	w.Header().Del("Set-Cookie")
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    b.ID(),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TCPServer is the layer 4 counterpart of an HTTP listener. It never looks
+// inside the byte stream: each client connection is spliced to one backend
+// for its whole lifetime. That makes it usable in front of databases, caches
+// and any other non-HTTP service, at the cost of per-request features such
+// as retries on 5xx, sticky cookies or header-based routing.
+//
+// It shares the pool, health state, circuit breakers and balancers with the
+// HTTP listeners. Backends are addressed as "tcp://host:port".
+type TCPServer struct {
+	listener *Listener
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	closing  bool
+	doneConn chan struct{} // Signalled whenever a connection finishes
+}
+
+func NewTCPServer(l *Listener) *TCPServer {
+	return &TCPServer{
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+		doneConn: make(chan struct{}, 1),
+	}
+}
+
+// ListenAndServe accepts connections until Shutdown is called.
+func (t *TCPServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", t.listener.Addr)
+	if err != nil {
+		return err
+	}
+	return t.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown is called.
+func (t *TCPServer) Serve(ln net.Listener) error {
+	t.mu.Lock()
+	if t.closing {
+		t.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	t.ln = ln
+	t.mu.Unlock()
+
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			if t.isClosing() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		if !t.track(client) {
+			client.Close()
+			continue
+		}
+		go func() {
+			defer t.untrack(client)
+			t.handle(client)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for active ones to end on
+// their own. When ctx expires, the remaining connections are closed.
+func (t *TCPServer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	if t.ln != nil {
+		t.ln.Close()
+	}
+	t.mu.Unlock()
+
+	for {
+		t.mu.Lock()
+		active := len(t.conns)
+		t.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+
+		select {
+		case <-t.doneConn:
+		case <-ctx.Done():
+			t.mu.Lock()
+			for c := range t.conns {
+				c.Close()
+			}
+			t.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// handle picks a backend, connects to it and splices the two connections.
+// Dial failures are retried on other backends: nothing has been sent yet,
+// so this is always safe, even for non-idempotent protocols.
+func (t *TCPServer) handle(client net.Conn) {
+	defer client.Close()
+	l := t.listener
+
+	// Balancers take an *http.Request; a TCP connection only has a peer
+	// address, which is enough for ip-hash and the consistent hash fallback.
+	req := &http.Request{RemoteAddr: client.RemoteAddr().String(), Header: http.Header{}, URL: &url.URL{}}
+
+	if rl := l.rateLimiter(); rl != nil && !rl.Allow(rl.Key(req)).Allowed {
+		lbStats.rateLimited.With(l.Addr).Inc()
+		fmt.Printf("LB[%s]: Rate limit exceeded for %s, closing\n", l.Addr, client.RemoteAddr())
+		return
+	}
+	policy, _ := l.retryPolicy()
+
+	tried := make(map[*Backend]bool)
+	for {
+		backends := untried(l.pool.Available(), tried)
+		if len(backends) == 0 {
+			fmt.Printf("LB[%s]: No backend available for %s, closing\n", l.Addr, client.RemoteAddr())
+			return
+		}
+		target := l.currentBalancer().Next(backends, req)
+		tried[target] = true
+		if !target.breaker.Allow() {
+			continue
+		}
+
+		dialer := net.Dialer{Timeout: time.Duration(policy.PerTryTimeout)}
+		backend, err := dialer.Dial("tcp", target.URL.Host)
+		if err != nil {
+			target.breaker.Record(false)
+			lbStats.backendErrors.With(target.URL.String(), "connection").Inc()
+			l.pool.MarkFailure(target, err)
+			fmt.Printf("LB[%s]: Dial %s failed (%v), trying another backend\n", l.Addr, target.URL, err)
+			continue
+		}
+		target.breaker.Record(true)
+
+		fmt.Printf("LB[%s]: Splicing %s <-> %s\n", l.Addr, client.RemoteAddr(), target.URL)
+		lbStats.tcpConnections.With(l.Addr, target.URL.String()).Inc()
+		atomic.AddInt64(&target.inFlight, 1)
+		splice(client, backend, l.IdleTimeout())
+		atomic.AddInt64(&target.inFlight, -1)
+		return
+	}
+}
+
+// splice copies bytes in both directions until both sides are done.
+//
+// Half-close: when one side finishes sending (EOF), only the write half of
+// the other connection is closed, so the peer sees EOF but can still send
+// its reply. The connections are fully closed once both directions end, or
+// when no byte moved in either direction for idleTimeout.
+func splice(client, backend net.Conn, idleTimeout time.Duration) {
+	defer backend.Close()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(backend, client, &lastActive)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(client, backend, &lastActive)
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if idleTimeout <= 0 {
+		<-done
+		return
+	}
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, lastActive.Load()))
+			if idle >= idleTimeout {
+				// Unblock both copy loops.
+				client.Close()
+				backend.Close()
+				<-done
+				return
+			}
+		}
+	}
+}
+
+// pipe copies src to dst, recording activity, then half-closes dst.
+func pipe(dst, src net.Conn, lastActive *atomic.Int64) {
+	_, err := io.Copy(dst, activityReader{src, lastActive})
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		// A reset from one side ends the whole session.
+		dst.Close()
+		src.Close()
+		return
+	}
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// activityReader stamps lastActive every time bytes are read.
+type activityReader struct {
+	r          io.Reader
+	lastActive *atomic.Int64
+}
+
+func (a activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *TCPServer) isClosing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closing
+}
+
+func (t *TCPServer) track(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *TCPServer) untrack(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	select {
+	case t.doneConn <- struct{}{}:
+	default:
+	}
+}
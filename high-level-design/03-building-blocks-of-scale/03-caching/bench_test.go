@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// rwMutexCache is the cache this package started with: one map behind one
+// RWMutex, no expiry and no eviction. Reads share the lock, so it is the
+// baseline the sharded cache has to beat.
+type rwMutexCache struct {
+	store map[string]User
+	mutex sync.RWMutex
+}
+
+func (c *rwMutexCache) Get(id string) (User, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	user, ok := c.store[id]
+	return user, ok
+}
+
+func (c *rwMutexCache) Set(id string, user User) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.store[id] = user
+}
+
+const benchKeys = 10000
+
+// benchCache runs a read-heavy workload against a cache: 90% Get, 10% Set,
+// spread over benchKeys keys, from perProc × GOMAXPROCS goroutines.
+func benchCache(b *testing.B, perProc int, get func(string) (User, bool), set func(string, User)) {
+	ids := make([]string, benchKeys)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+		set(ids[i], User{ID: ids[i]})
+	}
+	var seed atomic.Int64
+
+	b.SetParallelism(perProc)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			id := ids[rng.Intn(benchKeys)]
+			if rng.Intn(10) == 0 {
+				set(id, User{ID: id})
+			} else {
+				get(id)
+			}
+		}
+	})
+}
+
+// BenchmarkCache compares the original RWMutex cache with the sharded
+// cache, with a single shard (a plain mutex, since every Get updates the
+// eviction policy) and with the default 16. Run with:
+//
+//	go test -bench Cache -cpu 1,4,8
+//
+// goroutines-per-proc is the multiplier given to SetParallelism: with
+// -cpu 8, goroutines-per-proc=64 runs 512 goroutines. The -N suffix Go
+// appends to each name is GOMAXPROCS.
+func BenchmarkCache(b *testing.B) {
+	for _, perProc := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("goroutines-per-proc=%d/rwmutex", perProc), func(b *testing.B) {
+			cache := &rwMutexCache{store: make(map[string]User)}
+			benchCache(b, perProc, cache.Get, cache.Set)
+		})
+		for _, shards := range []int{1, defaultShards} {
+			b.Run(fmt.Sprintf("goroutines-per-proc=%d/shards=%d", perProc, shards), func(b *testing.B) {
+				cache := NewCache(CacheConfig[string, User]{MaxEntries: benchKeys, Shards: shards})
+				defer cache.Close()
+				benchCache(b, perProc, cache.Get, cache.Set)
+			})
+		}
+	}
+}
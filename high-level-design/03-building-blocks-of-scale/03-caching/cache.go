@@ -0,0 +1,502 @@
+package main
+
+import (
+	"errors"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig controls the size, expiry and sharding of a Cache.
+// The zero value is an unbounded, 16-shard cache whose entries never expire.
+type CacheConfig[K comparable, V any] struct {
+	DefaultTTL    time.Duration // TTL used by Set; 0 means entries never expire
+	MaxEntries    int           // Maximum number of entries; 0 means unbounded
+	MaxBytes      int           // Maximum estimated size in bytes; 0 means unbounded
+	SweepInterval time.Duration // How often expired entries are purged in the background; 0 disables
+
+	// Shards is the number of independently locked partitions. More shards
+	// means less lock contention; 1 gives a classic single-lock cache.
+	Shards int
+	// NewPolicy creates the eviction policy of each shard, sized for the
+	// shard's capacity. Defaults to LRU.
+	NewPolicy func(capacity int) EvictionPolicy[K]
+	// Sizer estimates the memory an entry takes, for MaxBytes.
+	// Defaults to a flat 64 bytes per entry.
+	Sizer func(key K, value V) int
+
+	// RefreshAhead, between 0 and 1, makes GetOrLoad reload an entry in the
+	// background once that fraction of its TTL has passed, so hot keys are
+	// renewed before they expire in front of a caller. 0 disables.
+	RefreshAhead float64
+	// NegativeTTL is how long GetOrLoad remembers that a loader returned
+	// ErrNotFound, sparing the backing store repeated lookups of missing
+	// keys. 0 disables.
+	NegativeTTL time.Duration
+}
+
+// ErrNotFound is returned by loaders, and by GetOrLoad, for keys that do
+// not exist in the backing store.
+var ErrNotFound = errors.New("not found")
+
+const (
+	defaultShards    = 16
+	defaultEntrySize = 64
+)
+
+// entry is a cached value together with its expiry and estimated size.
+type entry[V any] struct {
+	value     V
+	expiresAt time.Time // Zero means no expiry
+	size      int
+
+	missing    bool      // Negative entry: the key is known not to exist
+	refreshAt  time.Time // When refresh-ahead kicks in; zero means never
+	refreshing bool      // A background refresh is in flight
+}
+
+func (e *entry[V]) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// Cache simulates a fast in-memory store (like Redis).
+//
+// Keys are spread over several shards by hash, each with its own lock, map
+// and eviction policy, so goroutines working on different keys rarely wait
+// for each other. Size limits are split evenly between the shards, which
+// makes eviction slightly less precise than with one global policy.
+//
+// Expired entries are removed in two ways, like Redis does:
+//   - lazily, when a Get finds an expired entry;
+//   - actively, by a background sweeper that samples entries and purges the
+//     expired ones, so keys that are never read again do not linger.
+type Cache[K comparable, V any] struct {
+	config  CacheConfig[K, V]
+	seed    maphash.Seed
+	shards  []*shard[K, V]
+	flights flightGroup[K, V]
+	persist *persister[K, V] // Nil unless opened with OpenCache
+	stop    chan struct{}
+	closed  sync.Once
+
+	// Load statistics. Hits, misses and evictions are counted per shard.
+	loads, loadErrors     atomic.Uint64
+	loadTime, maxLoadTime atomic.Int64 // Nanoseconds
+}
+
+// shard is one lock-striped partition of the cache.
+type shard[K comparable, V any] struct {
+	// Every Get updates the policy's bookkeeping, so reads need the write lock.
+	mutex      sync.Mutex
+	store      map[K]*entry[V]
+	bytes      int
+	maxEntries int
+	maxBytes   int
+	policy     EvictionPolicy[K]
+
+	hits, misses                uint64
+	evictedSize, evictedExpired uint64
+}
+
+func NewCache[K comparable, V any](config CacheConfig[K, V]) *Cache[K, V] {
+	if config.Shards <= 0 {
+		config.Shards = defaultShards
+	}
+	// Every shard needs room for at least one entry, or a limit would be
+	// split into shares of 0, which means unbounded.
+	for _, limit := range []int{config.MaxEntries, config.MaxBytes} {
+		if limit > 0 && config.Shards > limit {
+			config.Shards = limit
+		}
+	}
+	if config.NewPolicy == nil {
+		config.NewPolicy = func(int) EvictionPolicy[K] { return NewLRUPolicy[K]() }
+	}
+	if config.Sizer == nil {
+		config.Sizer = func(K, V) int { return defaultEntrySize }
+	}
+
+	c := &Cache[K, V]{
+		config: config,
+		seed:   maphash.MakeSeed(),
+		shards: make([]*shard[K, V], config.Shards),
+		stop:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		maxEntries := shardLimit(config.MaxEntries, config.Shards, i)
+		c.shards[i] = &shard[K, V]{
+			store:      make(map[K]*entry[V]),
+			maxEntries: maxEntries,
+			maxBytes:   shardLimit(config.MaxBytes, config.Shards, i),
+			policy:     config.NewPolicy(maxEntries),
+		}
+	}
+	if config.SweepInterval > 0 {
+		go c.sweepLoop()
+	}
+	return c
+}
+
+// Close stops the background sweeper and, for a persistent cache, flushes
+// its files to disk.
+// Calling it again does nothing.
+func (c *Cache[K, V]) Close() error {
+	var err error
+	c.closed.Do(func() {
+		close(c.stop)
+		if c.persist != nil {
+			err = c.persist.close(c)
+		}
+	})
+	return err
+}
+
+func (c *Cache[K, V]) shardFor(key K) *shard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.lookup(key, time.Now())
+	if !ok || e.missing {
+		s.misses++
+		var zero V
+		return zero, false
+	}
+	s.hits++
+	return e.value, true
+}
+
+// Set stores the value with the cache's default TTL.
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.config.DefaultTTL)
+}
+
+// SetWithTTL stores the value for ttl; a ttl of 0 means no expiry.
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	e := c.newEntry(key, value, ttl, time.Now())
+
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(key, e)
+	c.logSet(key, e)
+}
+
+// SetIfAbsent stores the value for ttl only if key is not cached yet, and
+// reports whether it did. A ttl of 0 means no expiry.
+func (c *Cache[K, V]) SetIfAbsent(key K, value V, ttl time.Duration) bool {
+	now := time.Now()
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if e, ok := s.lookup(key, now); ok && !e.missing {
+		return false
+	}
+	e := c.newEntry(key, value, ttl, now)
+	s.set(key, e)
+	c.logSet(key, e)
+	return true
+}
+
+// Update atomically replaces the value of key with the result of fn, which
+// receives the current value and whether there was one. An existing entry
+// keeps its expiry; a new one gets the default TTL. If fn returns an error
+// the cache is left unchanged.
+func (c *Cache[K, V]) Update(key K, fn func(old V, exists bool) (V, error)) (V, error) {
+	now := time.Now()
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e, ok := s.lookup(key, now)
+	exists := ok && !e.missing
+	var old V
+	if exists {
+		old = e.value
+	}
+	value, err := fn(old, exists)
+	if err != nil {
+		return old, err
+	}
+
+	updated := c.newEntry(key, value, c.config.DefaultTTL, now)
+	if exists {
+		updated.expiresAt, updated.refreshAt = e.expiresAt, e.refreshAt
+	}
+	s.set(key, updated)
+	c.logSet(key, updated)
+	return value, nil
+}
+
+// Expire changes the TTL of a cached key, counting from now, and reports
+// whether the key exists. A ttl of 0 removes the expiry.
+func (c *Cache[K, V]) Expire(key K, ttl time.Duration) bool {
+	now := time.Now()
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.lookup(key, now)
+	if !ok || e.missing {
+		return false
+	}
+	c.setExpiry(e, ttl, now)
+	c.logSet(key, e)
+	return true
+}
+
+// TTL returns the time left before key expires, 0 if it never does, and
+// whether the key exists.
+func (c *Cache[K, V]) TTL(key K) (time.Duration, bool) {
+	now := time.Now()
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.store[key]
+	if !ok || e.missing || e.expired(now) {
+		return 0, false
+	}
+	if e.expiresAt.IsZero() {
+		return 0, true
+	}
+	return e.expiresAt.Sub(now), true
+}
+
+// Delete removes key and reports whether it was cached.
+func (c *Cache[K, V]) Delete(key K) bool {
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.store[key]
+	if !ok {
+		return false
+	}
+	s.remove(key)
+	c.logDelete(key)
+	return !e.missing && !e.expired(time.Now())
+}
+
+func (c *Cache[K, V]) newEntry(key K, value V, ttl time.Duration, now time.Time) *entry[V] {
+	e := &entry[V]{value: value, size: c.config.Sizer(key, value)}
+	c.setExpiry(e, ttl, now)
+	return e
+}
+
+// setExpiry sets when e expires and, with refresh-ahead, when it is reloaded.
+func (c *Cache[K, V]) setExpiry(e *entry[V], ttl time.Duration, now time.Time) {
+	e.expiresAt, e.refreshAt = time.Time{}, time.Time{}
+	if ttl <= 0 {
+		return
+	}
+	e.expiresAt = now.Add(ttl)
+	if r := c.config.RefreshAhead; r > 0 && r < 1 {
+		e.refreshAt = now.Add(time.Duration(r * float64(ttl)))
+	}
+}
+
+// GetOrLoad returns the cached value, or calls load on a miss and caches
+// its result with the default TTL.
+//
+// Concurrent misses on the same key are coalesced: one caller runs load
+// and the others wait for its result, so a popular key expiring does not
+// send a stampede to the backing store. The shard is not locked while load
+// runs, so a slow load does not block other keys. ErrNotFound is cached
+// for NegativeTTL; other errors are returned and not cached.
+func (c *Cache[K, V]) GetOrLoad(key K, load func(K) (V, error)) (V, error) {
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	now := time.Now()
+	e, ok := s.lookup(key, now)
+	if !ok {
+		s.misses++
+		s.mutex.Unlock()
+		return c.load(key, load)
+	}
+	s.hits++ // A cached "not found" is a hit too: the store is spared
+	refresh := !e.refreshAt.IsZero() && now.After(e.refreshAt) && !e.refreshing
+	if refresh {
+		e.refreshing = true
+	}
+	s.mutex.Unlock()
+
+	if refresh {
+		go c.refresh(key, e, load)
+	}
+	if e.missing {
+		var zero V
+		return zero, ErrNotFound
+	}
+	return e.value, nil
+}
+
+// load runs load once for all concurrent callers and caches the outcome.
+func (c *Cache[K, V]) load(key K, load func(K) (V, error)) (V, error) {
+	v, err, _ := c.flights.Do(key, func() (V, error) {
+		start := time.Now()
+		v, err := load(key)
+		c.recordLoad(time.Since(start), err)
+		switch {
+		case err == nil:
+			c.Set(key, v)
+		case errors.Is(err, ErrNotFound) && c.config.NegativeTTL > 0:
+			c.setMissing(key)
+		}
+		return v, err
+	})
+	return v, err
+}
+
+// refresh reloads an entry ahead of its expiry. Callers keep getting the
+// old value meanwhile. If the reload fails, the old value stays until it
+// expires and the next GetOrLoad may try again.
+func (c *Cache[K, V]) refresh(key K, old *entry[V], load func(K) (V, error)) {
+	if _, err := c.load(key, load); err != nil {
+		s := c.shardFor(key)
+		s.mutex.Lock()
+		old.refreshing = false
+		s.mutex.Unlock()
+	}
+}
+
+// setMissing records that key does not exist, for NegativeTTL.
+func (c *Cache[K, V]) setMissing(key K) {
+	var zero V
+	e := &entry[V]{
+		missing:   true,
+		expiresAt: time.Now().Add(c.config.NegativeTTL),
+		size:      c.config.Sizer(key, zero),
+	}
+
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(key, e)
+}
+
+// Len returns the number of entries, including expired ones not yet purged.
+func (c *Cache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		n += len(s.store)
+		s.mutex.Unlock()
+	}
+	return n
+}
+
+// lookup returns the live entry for key, purging it if it has expired, and
+// marks it as accessed. Caller holds the mutex.
+func (s *shard[K, V]) lookup(key K, now time.Time) (*entry[V], bool) {
+	e, ok := s.store[key]
+	if !ok {
+		return nil, false
+	}
+	if e.expired(now) {
+		s.remove(key)
+		s.evictedExpired++
+		return nil, false
+	}
+	s.policy.Accessed(key)
+	return e, true
+}
+
+// set inserts or replaces an entry and evicts if needed.
+// Caller holds the mutex.
+func (s *shard[K, V]) set(key K, e *entry[V]) {
+	if old, ok := s.store[key]; ok {
+		s.bytes -= old.size
+		s.policy.Accessed(key)
+	} else {
+		s.policy.Added(key)
+	}
+	s.store[key] = e
+	s.bytes += e.size
+	s.evict()
+}
+
+// evict removes entries until the shard is within its limits.
+// Caller holds the mutex.
+func (s *shard[K, V]) evict() {
+	for s.overLimit() {
+		victim, ok := s.policy.Victim()
+		if !ok {
+			return
+		}
+		s.remove(victim)
+		s.evictedSize++
+	}
+}
+
+func (s *shard[K, V]) overLimit() bool {
+	return (s.maxEntries > 0 && len(s.store) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// remove deletes an entry and tells the policy. Caller holds the mutex.
+func (s *shard[K, V]) remove(key K) {
+	s.bytes -= s.store[key].size
+	delete(s.store, key)
+	s.policy.Removed(key)
+}
+
+// Sampling parameters of the active expiry, borrowed from Redis: look at
+// 20 entries, and go again right away if more than a quarter had expired.
+const (
+	sweepSampleSize   = 20
+	sweepRepeatFactor = 0.25
+)
+
+func (c *Cache[K, V]) sweepLoop() {
+	ticker := time.NewTicker(c.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			for _, s := range c.shards {
+				for s.sweepOnce() > sweepRepeatFactor {
+				}
+			}
+		}
+	}
+}
+
+// sweepOnce purges expired entries among a sample of the shard and returns
+// the fraction of the sample that had expired. Map iteration order is
+// randomised in Go, so ranging over the first N entries is a random sample.
+func (s *shard[K, V]) sweepOnce() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	sampled, expired := 0, 0
+	for key, e := range s.store {
+		if sampled == sweepSampleSize {
+			break
+		}
+		sampled++
+		if e.expired(now) {
+			s.remove(key)
+			s.evictedExpired++
+			expired++
+		}
+	}
+	if sampled == 0 {
+		return 0
+	}
+	return float64(expired) / float64(sampled)
+}
+
+// shardLimit returns shard i's share of a limit, so that the shares add up
+// to exactly n; 0 (unbounded) stays 0.
+func shardLimit(n, shards, i int) int {
+	share := n / shards
+	if i < n%shards {
+		share++
+	}
+	return share
+}
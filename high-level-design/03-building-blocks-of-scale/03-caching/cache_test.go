@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCacheMaxEntriesAcrossShards(t *testing.T) {
+	for _, tc := range []struct{ maxEntries, shards int }{
+		{5, 16},  // Fewer entries than shards
+		{20, 16}, // Not a multiple of the shard count
+		{64, 16},
+	} {
+		cache := NewCache(CacheConfig[string, int]{MaxEntries: tc.maxEntries, Shards: tc.shards})
+		for i := range 1000 {
+			cache.Set(strconv.Itoa(i), i)
+		}
+		if n := cache.Len(); n > tc.maxEntries {
+			t.Errorf("MaxEntries %d with %d shards: cache holds %d entries", tc.maxEntries, tc.shards, n)
+		}
+		cache.Close()
+	}
+}
+
+func TestCacheCloseTwice(t *testing.T) {
+	cache := NewCache(CacheConfig[string, int]{SweepInterval: 1})
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
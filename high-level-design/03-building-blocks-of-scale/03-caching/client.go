@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client is a minimal client for RESPServer (or Redis). It holds a single
+// connection and is safe for concurrent use; calls are serialised.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    respWriter
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: respWriter{bufio.NewWriter(conn)}}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends one command and returns the reply: a string, an int64, nil for
+// a null, or a []any. Error replies are returned as a RESPError.
+func (c *Client) Do(args ...string) (any, error) {
+	replies, err := c.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(RESPError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends all commands in one write, then reads all the replies.
+// Error replies are returned in place, as RESPError values.
+func (c *Client) Pipeline(cmds [][]string) ([]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, args := range cmds {
+		c.w.command(args)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		v, err := readValue(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = v
+	}
+	return replies, nil
+}
+
+// Get returns the value of key and whether it exists.
+func (c *Client) Get(key string) (string, bool, error) {
+	v, err := c.Do("GET", key)
+	if err != nil || v == nil {
+		return "", false, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", false, fmt.Errorf("GET: unexpected reply %v", v)
+	}
+	return s, true, nil
+}
+
+// Set stores value for ttl; a ttl of 0 means no expiry. The server counts
+// in milliseconds, so ttl is rounded up to the next one: PX 0 would be
+// refused.
+func (c *Client) Set(key, value string, ttl time.Duration) error {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		ms := (ttl + time.Millisecond - 1) / time.Millisecond
+		args = append(args, "PX", strconv.FormatInt(int64(ms), 10))
+	}
+	_, err := c.Do(args...)
+	return err
+}
+
+// Incr increments the integer stored at key and returns the new value.
+func (c *Client) Incr(key string) (int64, error) {
+	v, err := c.Do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("INCR: unexpected reply %v", v)
+	}
+	return n, nil
+}
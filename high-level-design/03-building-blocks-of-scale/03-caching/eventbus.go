@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The event bus below is the one from 06-event-driven. In production the
+// instances would share a broker (Redis pub/sub, Kafka, NATS); here they
+// share the bus in-process.
+
+// EventType is a unique name for an event.
+type EventType string
+
+const (
+	CacheInvalidated EventType = "CacheInvalidated"
+)
+
+// Event represents something that happened in the past.
+type Event struct {
+	Type      EventType
+	Data      interface{} // Arbitrary payload
+	Timestamp time.Time
+}
+
+// EventHandler is a function that processes an event.
+type EventHandler func(event Event)
+
+// EventBus coordinates the publishing and subscribing of events.
+type EventBus struct {
+	subscribers map[EventType][]EventHandler
+	mu          sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[EventType][]EventHandler),
+	}
+}
+
+// Subscribe allows a service to listen for a specific event type.
+func (eb *EventBus) Subscribe(eventType EventType, handler EventHandler) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.subscribers[eventType] = append(eb.subscribers[eventType], handler)
+}
+
+// Publish sends an event to all subscribers of that type. Handlers run
+// asynchronously, like messages arriving from a broker.
+func (eb *EventBus) Publish(event Event) {
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+
+	for _, handler := range eb.subscribers[event.Type] {
+		go handler(event)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventBusDeliversToSubscribersOfTheType(t *testing.T) {
+	bus := NewEventBus()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var got []string
+	for _, name := range []string{"first", "second"} {
+		bus.Subscribe(CacheInvalidated, func(event Event) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, name+":"+event.Data.(string))
+		})
+	}
+	bus.Subscribe("Other", func(event Event) {
+		t.Errorf("handler for Other received a %s event", event.Type)
+	})
+
+	wg.Add(2)
+	bus.Publish(Event{Type: CacheInvalidated, Data: "k", Timestamp: time.Now()})
+	wg.Wait()
+	if len(got) != 2 {
+		t.Fatalf("delivered %v, want one event per subscriber", got)
+	}
+
+	// Publishing an event nobody subscribed to is a no-op.
+	bus.Publish(Event{Type: "Unknown"})
+}
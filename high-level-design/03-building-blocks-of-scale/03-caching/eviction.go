@@ -0,0 +1,352 @@
+package main
+
+import (
+	"container/list"
+	"hash/maphash"
+)
+
+// EvictionPolicy decides which entry leaves a full cache.
+//
+// The cache tells the policy about every key that is added, read or
+// removed, and asks it for a Victim whenever it is over its limits.
+// Policies are not safe for concurrent use; the cache serialises calls.
+type EvictionPolicy[K comparable] interface {
+	Added(key K)
+	Accessed(key K)
+	Removed(key K)
+	// Victim returns the key to evict next, without removing it.
+	Victim() (K, bool)
+}
+
+// --- LRU ---
+
+// LRUPolicy evicts the least recently used key. Simple and good for
+// workloads with strong recency, but a single scan over many cold keys
+// flushes the whole cache.
+type LRUPolicy[K comparable] struct {
+	order *list.List // Front is most recently used
+	nodes map[K]*list.Element
+}
+
+func NewLRUPolicy[K comparable]() *LRUPolicy[K] {
+	return &LRUPolicy[K]{order: list.New(), nodes: make(map[K]*list.Element)}
+}
+
+func (p *LRUPolicy[K]) Added(key K) {
+	p.nodes[key] = p.order.PushFront(key)
+}
+
+func (p *LRUPolicy[K]) Accessed(key K) {
+	if e, ok := p.nodes[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *LRUPolicy[K]) Removed(key K) {
+	if e, ok := p.nodes[key]; ok {
+		p.order.Remove(e)
+		delete(p.nodes, key)
+	}
+}
+
+func (p *LRUPolicy[K]) Victim() (K, bool) {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(K), true
+	}
+	var zero K
+	return zero, false
+}
+
+// --- LFU ---
+
+// LFUPolicy evicts the least frequently used key, breaking ties by recency.
+// It resists scans, but keys that were hot long ago stay forever because
+// their counts never decay.
+//
+// All operations are O(1): keys are kept in one list per access count and
+// the policy tracks the smallest count in use.
+type LFUPolicy[K comparable] struct {
+	nodes   map[K]*list.Element // Value is *lfuNode[K]
+	buckets map[int]*list.List  // Access count -> keys, front is most recent
+	minFreq int
+}
+
+type lfuNode[K comparable] struct {
+	key  K
+	freq int
+}
+
+func NewLFUPolicy[K comparable]() *LFUPolicy[K] {
+	return &LFUPolicy[K]{nodes: make(map[K]*list.Element), buckets: make(map[int]*list.List)}
+}
+
+func (p *LFUPolicy[K]) Added(key K) {
+	p.nodes[key] = p.bucket(1).PushFront(&lfuNode[K]{key: key, freq: 1})
+	p.minFreq = 1
+}
+
+func (p *LFUPolicy[K]) Accessed(key K) {
+	e, ok := p.nodes[key]
+	if !ok {
+		return
+	}
+	n := e.Value.(*lfuNode[K])
+	p.unlink(e)
+	n.freq++
+	p.nodes[key] = p.bucket(n.freq).PushFront(n)
+	if _, ok := p.buckets[p.minFreq]; !ok {
+		p.minFreq = n.freq
+	}
+}
+
+func (p *LFUPolicy[K]) Removed(key K) {
+	e, ok := p.nodes[key]
+	if !ok {
+		return
+	}
+	p.unlink(e)
+	delete(p.nodes, key)
+	if _, ok := p.buckets[p.minFreq]; !ok {
+		p.recomputeMin()
+	}
+}
+
+func (p *LFUPolicy[K]) Victim() (K, bool) {
+	l, ok := p.buckets[p.minFreq]
+	if !ok {
+		var zero K
+		return zero, false
+	}
+	return l.Back().Value.(*lfuNode[K]).key, true
+}
+
+func (p *LFUPolicy[K]) bucket(freq int) *list.List {
+	l, ok := p.buckets[freq]
+	if !ok {
+		l = list.New()
+		p.buckets[freq] = l
+	}
+	return l
+}
+
+// unlink removes e from its bucket, dropping the bucket when empty.
+func (p *LFUPolicy[K]) unlink(e *list.Element) {
+	freq := e.Value.(*lfuNode[K]).freq
+	l := p.buckets[freq]
+	l.Remove(e)
+	if l.Len() == 0 {
+		delete(p.buckets, freq)
+	}
+}
+
+// recomputeMin scans the buckets; only needed after an arbitrary removal.
+func (p *LFUPolicy[K]) recomputeMin() {
+	p.minFreq = 0
+	for freq := range p.buckets {
+		if p.minFreq == 0 || freq < p.minFreq {
+			p.minFreq = freq
+		}
+	}
+}
+
+// --- W-TinyLFU ---
+
+// TinyLFUPolicy is W-TinyLFU, the policy behind Caffeine and Ristretto.
+//
+// New keys enter a small LRU "window" (1% of capacity) so bursts of new
+// keys can build up some history. Keys pushed out of the window become
+// candidates for the main area, an SLRU split into "probation" and
+// "protected" (80%). When the cache is full, a candidate only gets in if
+// a frequency sketch says it is used more often than the probation victim
+// it would replace; otherwise the candidate itself is evicted. This keeps
+// both recency and frequency, and one-hit wonders cannot flush hot keys.
+type TinyLFUPolicy[K comparable] struct {
+	sketch *countMinSketch[K]
+
+	window, probation, protected *list.List // Front is most recently used
+	windowCap, protectedCap      int
+	nodes                        map[K]*list.Element // Value is *tinyNode[K]
+
+	// candidate is the last key moved from the window to probation; it is
+	// the one that has to win the admission contest.
+	candidate    K
+	hasCandidate bool
+}
+
+type segment int
+
+const (
+	segWindow segment = iota
+	segProbation
+	segProtected
+)
+
+type tinyNode[K comparable] struct {
+	key K
+	seg segment
+}
+
+// NewTinyLFUPolicy sizes the window, protected area and sketch for a cache
+// holding about capacity entries.
+func NewTinyLFUPolicy[K comparable](capacity int) *TinyLFUPolicy[K] {
+	capacity = max(capacity, 2)
+	windowCap := max(capacity/100, 1)
+	return &TinyLFUPolicy[K]{
+		sketch:       newCountMinSketch[K](capacity),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		windowCap:    windowCap,
+		protectedCap: (capacity - windowCap) * 8 / 10,
+		nodes:        make(map[K]*list.Element),
+	}
+}
+
+func (p *TinyLFUPolicy[K]) Added(key K) {
+	p.sketch.increment(key)
+	p.nodes[key] = p.window.PushFront(&tinyNode[K]{key: key, seg: segWindow})
+
+	// Window overflow: the oldest window key moves to probation and becomes
+	// the candidate that must beat the probation victim to stay.
+	if p.window.Len() > p.windowCap {
+		e := p.window.Back()
+		n := e.Value.(*tinyNode[K])
+		p.window.Remove(e)
+		n.seg = segProbation
+		p.nodes[n.key] = p.probation.PushFront(n)
+		p.candidate, p.hasCandidate = n.key, true
+	}
+}
+
+func (p *TinyLFUPolicy[K]) Accessed(key K) {
+	p.sketch.increment(key)
+	e, ok := p.nodes[key]
+	if !ok {
+		return
+	}
+	n := e.Value.(*tinyNode[K])
+	switch n.seg {
+	case segWindow:
+		p.window.MoveToFront(e)
+	case segProtected:
+		p.protected.MoveToFront(e)
+	case segProbation:
+		// A second hit in probation earns a place in the protected area.
+		p.probation.Remove(e)
+		n.seg = segProtected
+		p.nodes[key] = p.protected.PushFront(n)
+		if p.hasCandidate && p.candidate == key {
+			p.hasCandidate = false
+		}
+		if p.protected.Len() > p.protectedCap {
+			// Demote the oldest protected key back to probation.
+			old := p.protected.Back()
+			on := old.Value.(*tinyNode[K])
+			p.protected.Remove(old)
+			on.seg = segProbation
+			p.nodes[on.key] = p.probation.PushFront(on)
+		}
+	}
+}
+
+func (p *TinyLFUPolicy[K]) Removed(key K) {
+	e, ok := p.nodes[key]
+	if !ok {
+		return
+	}
+	p.listOf(e.Value.(*tinyNode[K]).seg).Remove(e)
+	delete(p.nodes, key)
+	if p.hasCandidate && p.candidate == key {
+		p.hasCandidate = false
+	}
+}
+
+func (p *TinyLFUPolicy[K]) Victim() (K, bool) {
+	victim := p.probation.Back()
+	if victim == nil {
+		// No probation keys: fall back to the oldest key anywhere.
+		for _, l := range []*list.List{p.window, p.protected} {
+			if back := l.Back(); back != nil {
+				return back.Value.(*tinyNode[K]).key, true
+			}
+		}
+		var zero K
+		return zero, false
+	}
+
+	victimKey := victim.Value.(*tinyNode[K]).key
+	if !p.hasCandidate || p.candidate == victimKey {
+		return victimKey, true
+	}
+	// The admission contest: keep whichever is used more often.
+	if p.sketch.estimate(p.candidate) > p.sketch.estimate(victimKey) {
+		return victimKey, true
+	}
+	return p.candidate, true
+}
+
+func (p *TinyLFUPolicy[K]) listOf(s segment) *list.List {
+	switch s {
+	case segWindow:
+		return p.window
+	case segProbation:
+		return p.probation
+	}
+	return p.protected
+}
+
+// countMinSketch estimates how often each key was seen in a few bytes per
+// entry. Each key bumps one counter in each of the rows; its estimate is the
+// smallest of them (collisions can only inflate counters). Counters are
+// halved periodically so the sketch forgets old popularity.
+type countMinSketch[K comparable] struct {
+	rows       [4][]uint8
+	mask       uint64
+	seeds      [4]maphash.Seed
+	additions  int
+	resetAfter int
+}
+
+func newCountMinSketch[K comparable](capacity int) *countMinSketch[K] {
+	width := 1
+	for width < capacity {
+		width <<= 1
+	}
+	s := &countMinSketch[K]{mask: uint64(width - 1), resetAfter: 10 * capacity}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+		s.seeds[i] = maphash.MakeSeed()
+	}
+	return s
+}
+
+func (s *countMinSketch[K]) increment(key K) {
+	for i := range s.rows {
+		c := &s.rows[i][maphash.Comparable(s.seeds[i], key)&s.mask]
+		if *c < 15 { // 4-bit counters, as in the TinyLFU paper
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAfter {
+		s.halve()
+	}
+}
+
+func (s *countMinSketch[K]) estimate(key K) uint8 {
+	est := uint8(255)
+	for i := range s.rows {
+		est = min(est, s.rows[i][maphash.Comparable(s.seeds[i], key)&s.mask])
+	}
+	return est
+}
+
+// halve ages every counter so recent popularity outweighs old popularity.
+func (s *countMinSketch[K]) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
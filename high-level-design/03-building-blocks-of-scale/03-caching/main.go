@@ -1,8 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -13,13 +28,29 @@ type User struct {
 	Email string
 }
 
+// userSize estimates the memory a cached user takes: the strings plus a
+// fixed overhead for the map slot, entry struct and policy bookkeeping.
+func userSize(id string, u User) int {
+	const overhead = 96
+	return overhead + len(id) + len(u.ID) + len(u.Name) + len(u.Email)
+}
+
 // Database simulates a slow persistent storage.
 type Database struct {
-	data map[string]User
+	// ReadLatency and WriteLatency simulate network/disk latency. Set them
+	// before use; tests set them to 0.
+	ReadLatency, WriteLatency time.Duration
+
+	mu      sync.RWMutex
+	data    map[string]User
+	queries atomic.Int64 // Number of GetUser calls, to show the cache's effect
+	writes  atomic.Int64 // Number of PutUsers calls (round trips)
 }
 
 func NewDatabase() *Database {
 	return &Database{
+		ReadLatency:  2 * time.Second,
+		WriteLatency: 200 * time.Millisecond,
 		data: map[string]User{
 			"1": {ID: "1", Name: "Alice", Email: "alice@example.com"},
 			"2": {ID: "2", Name: "Bob", Email: "bob@example.com"},
@@ -29,75 +60,123 @@ func NewDatabase() *Database {
 
 // GetUser simulates a slow database query.
 func (db *Database) GetUser(id string) (User, bool) {
-	time.Sleep(2 * time.Second) // Simulate network/disk latency
-	user, ok := db.data[id]
-	return user, ok
-}
-
-// Cache simulates a fast in-memory store (like Redis).
-type Cache struct {
-	store map[string]User
-	mutex sync.RWMutex
+	db.queries.Add(1)
+	time.Sleep(db.ReadLatency)
+	return db.peek(id)
 }
 
-func NewCache() *Cache {
-	return &Cache{
-		store: make(map[string]User),
+// PutUsers simulates a write transaction. A batch costs a single round
+// trip, which is what makes write-behind batching pay off.
+func (db *Database) PutUsers(users []User) error {
+	db.writes.Add(1)
+	time.Sleep(db.WriteLatency)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, u := range users {
+		db.data[u.ID] = u
 	}
+	return nil
 }
 
-func (c *Cache) Get(id string) (User, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	user, ok := c.store[id]
+// peek reads a row without the simulated latency, to inspect the DB in demos.
+func (db *Database) peek(id string) (User, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user, ok := db.data[id]
 	return user, ok
 }
 
-func (c *Cache) Set(id string, user User) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.store[id] = user
-}
-
 // Application represents our backend service.
 type Application struct {
-	db    *Database
-	cache *Cache
+	db          *Database
+	cache       *Cache[string, User]
+	strategy    WriteStrategy
+	writeBehind *WriteBehindQueue[string, User] // Only with the WriteBehind strategy
 }
 
-// GetProfile implements the Cache-Aside pattern.
-func (app *Application) GetProfile(userID string) User {
-	fmt.Printf("Requesting profile for user %s...\n", userID)
+func NewApplication(db *Database, strategy WriteStrategy) *Application {
+	app := &Application{
+		db: db,
+		// Profiles are cached for a minute at most, and the cache never
+		// holds more than 1000 of them.
+		cache: NewCache(CacheConfig[string, User]{
+			DefaultTTL:    time.Minute,
+			MaxEntries:    1000,
+			MaxBytes:      1 << 20,
+			SweepInterval: time.Second,
+			RefreshAhead:  0.8,
+			NegativeTTL:   10 * time.Second,
+			NewPolicy: func(capacity int) EvictionPolicy[string] {
+				return NewTinyLFUPolicy[string](capacity)
+			},
+			Sizer: userSize,
+		}),
+		strategy: strategy,
+	}
+	if strategy == WriteBehind {
+		app.writeBehind = NewWriteBehindQueue(
+			WriteBehindConfig{BatchSize: 100, FlushInterval: time.Second},
+			func(batch map[string]User) error {
+				users := make([]User, 0, len(batch))
+				for _, u := range batch {
+					users = append(users, u)
+				}
+				return db.PutUsers(users)
+			},
+		)
+	}
+	return app
+}
 
-	// 1. Check Cache
-	user, found := app.cache.Get(userID)
-	if found {
-		fmt.Println(" -> Cache HIT! Returning fast.")
-		return user
+// Close flushes queued writes and stops the cache.
+func (app *Application) Close() error {
+	defer app.cache.Close()
+	if app.writeBehind != nil {
+		return app.writeBehind.Close()
 	}
+	return nil
+}
 
-	fmt.Println(" -> Cache MISS. Fetching from DB (slow)...")
+// GetProfile implements the Cache-Aside pattern. The cache loads missing
+// profiles through loadUser, and makes sure that:
+//   - concurrent misses on the same user share a single DB query;
+//   - hot profiles are reloaded in the background shortly before they expire;
+//   - unknown users are remembered for a while instead of hitting the DB each time.
+func (app *Application) GetProfile(userID string) User {
+	fmt.Printf("Requesting profile for user %s...\n", userID)
 
-	// 2. Fetch from DB
-	user, found = app.db.GetUser(userID)
-	if !found {
-		fmt.Println(" -> User not found in DB.")
+	user, err := app.cache.GetOrLoad(userID, app.loadUser)
+	if errors.Is(err, ErrNotFound) {
+		fmt.Println(" -> User not found.")
 		return User{}
 	}
+	return user
+}
 
-	// 3. Update Cache
+// loadUser is called by the cache on a miss.
+func (app *Application) loadUser(userID string) (User, error) {
+	fmt.Printf(" -> Cache MISS for user %s. Fetching from DB (slow)...\n", userID)
+	user, found := app.db.GetUser(userID)
+	if !found {
+		return User{}, ErrNotFound
+	}
 	fmt.Println(" -> Writing to Cache...")
-	app.cache.Set(userID, user)
-
-	return user
+	return user, nil
 }
 
 func main() {
-	app := &Application{
-		db:    NewDatabase(),
-		cache: NewCache(),
+	serve := flag.String("serve", "", "run only the RESP cache server on this address (e.g. :6380)")
+	dataDir := flag.String("data", "", "with -serve, persist the cache in this directory (AOF + snapshots)")
+	debugAddr := flag.String("debug", "", "with -serve, serve cache stats and keys over HTTP on this address")
+	flag.Parse()
+	if *serve != "" {
+		runServer(*serve, *dataDir, *debugAddr)
+		return
 	}
 
+	app := NewApplication(NewDatabase(), WriteThrough)
+	defer app.Close()
+
 	// First Request: Cache Miss
 	start := time.Now()
 	app.GetProfile("1")
@@ -107,5 +186,501 @@ func main() {
 	start = time.Now()
 	app.GetProfile("1")
 	fmt.Printf("Second call took: %v\n", time.Since(start))
+
+	demoStampede(app)
+	demoNegativeCaching(app)
+	demoStats(app)
+	demoRefreshAhead()
+	demoWriteStrategies()
+	demoRESP()
+	demoPersistence()
+	demoTwoTier()
+	demoTTL()
+	comparePolicies()
+}
+
+// demoStampede sends 100 concurrent requests for an uncached user. Without
+// coalescing each of them would query the database.
+func demoStampede(app *Application) {
+	fmt.Println("\n--- Stampede Protection ---")
+	before := app.db.queries.Load()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.cache.GetOrLoad("2", app.loadUser)
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("100 concurrent misses -> %d DB query\n", app.db.queries.Load()-before)
+}
+
+// demoNegativeCaching looks up an unknown user twice: only the first
+// lookup pays for the DB query.
+func demoNegativeCaching(app *Application) {
+	fmt.Println("\n--- Negative Caching ---")
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		app.GetProfile("42")
+		fmt.Printf("Lookup %d took: %v\n", i+1, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// demoStats prints what the cache has seen so far, through the debug
+// endpoint an operator would use.
+func demoStats(app *Application) {
+	fmt.Println("\n--- Cache Statistics ---")
+	server := httptest.NewServer(http.StripPrefix("/debug/cache", app.cache.DebugHandler()))
+	defer server.Close()
+
+	for _, path := range []string{"/debug/cache/stats", "/debug/cache/keys?limit=5"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("GET %s\n%s", path, body)
+	}
+}
+
+// demoRefreshAhead reads a key continuously across its TTL. The entry is
+// reloaded in the background at 80% of its TTL, so no read ever waits for
+// the loader.
+func demoRefreshAhead() {
+	fmt.Println("\n--- Refresh-Ahead ---")
+	cache := NewCache(CacheConfig[string, User]{DefaultTTL: 500 * time.Millisecond, RefreshAhead: 0.8})
+	defer cache.Close()
+
+	var loads atomic.Int64
+	load := func(id string) (User, error) {
+		time.Sleep(100 * time.Millisecond)
+		version := loads.Add(1)
+		return User{ID: id, Name: fmt.Sprintf("Alice v%d", version)}, nil
+	}
+
+	cache.GetOrLoad("1", load)
+	var slowest time.Duration
+	for i := 0; i < 15; i++ {
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		user, _ := cache.GetOrLoad("1", load)
+		slowest = max(slowest, time.Since(start))
+		if i%5 == 4 {
+			fmt.Printf("t=%dms: %s\n", (i+1)*100, user.Name)
+		}
+	}
+	fmt.Printf("Loads: %d, slowest read: %v\n", loads.Load(), slowest.Round(time.Microsecond))
 }
 
+// demoWriteStrategies renames Alice with each write strategy and shows what
+// a reader would see in the cache and in the database afterwards.
+func demoWriteStrategies() {
+	fmt.Println("\n--- Write Strategies ---")
+	fmt.Printf("%-14s %-12s %-16s %-16s %-16s\n", "strategy", "write took", "cache after", "DB after", "DB after Close")
+
+	for _, strategy := range []WriteStrategy{WriteThrough, WriteAround, WriteBehind} {
+		db := NewDatabase()
+		app := NewApplication(db, strategy)
+		app.cache.Set("1", User{ID: "1", Name: "Alice", Email: "alice@example.com"}) // Warm cache
+
+		start := time.Now()
+		app.UpdateProfile(User{ID: "1", Name: "Alice Smith", Email: "alice@example.com"})
+		took := time.Since(start).Round(time.Millisecond)
+
+		cached := "(miss)"
+		if u, ok := app.cache.Get("1"); ok {
+			cached = u.Name
+		}
+		inDB, _ := db.peek("1")
+		app.Close()
+		afterClose, _ := db.peek("1")
+		fmt.Printf("%-14s %-12v %-16s %-16s %-16s\n", strategy, took, cached, inDB.Name, afterClose.Name)
+	}
+
+	// Write-behind turns many writes into a few round trips.
+	db := NewDatabase()
+	app := NewApplication(db, WriteBehind)
+	start := time.Now()
+	for i := 0; i < 250; i++ {
+		id := strconv.Itoa(i % 50)
+		app.UpdateProfile(User{ID: id, Name: "User " + id + " rev " + strconv.Itoa(i)})
+	}
+	fmt.Printf("\nWrite-behind: 250 writes to 50 users took %v, ", time.Since(start).Round(time.Microsecond))
+	app.Close()
+	fmt.Printf("%d DB round trip(s) after Close\n", db.writes.Load())
+}
+
+// serverCacheConfig configures the store behind the RESP server. Like
+// Redis, keys never expire unless a TTL is set, and memory is bounded in bytes.
+var serverCacheConfig = CacheConfig[string, string]{
+	MaxBytes:      64 << 20,
+	SweepInterval: 100 * time.Millisecond,
+	Sizer:         func(k, v string) int { return 64 + len(k) + len(v) },
+}
+
+// runServer serves the cache until SIGINT or SIGTERM. With a data
+// directory, the cache is reloaded from it on start and flushed on exit.
+// With a debug address, /debug/cache/stats and /debug/cache/keys are
+// served there.
+func runServer(addr, dataDir, debugAddr string) {
+	cache := NewCache(serverCacheConfig)
+	if dataDir != "" {
+		var err error
+		cache, err = OpenCache(serverCacheConfig, PersistenceConfig{
+			Dir:              dataDir,
+			SnapshotInterval: 5 * time.Minute,
+			AppendOnly:       true,
+			Fsync:            FsyncEverySec,
+		})
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		fmt.Printf("Loaded %d keys from %s\n", cache.Len(), dataDir)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		cache.Close()
+		return
+	}
+	if debugAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/cache/", http.StripPrefix("/debug/cache", cache.DebugHandler()))
+		go func() {
+			if err := http.ListenAndServe(debugAddr, mux); err != nil {
+				fmt.Println("Debug server error:", err)
+			}
+		}()
+	}
+
+	server := NewRESPServer(cache)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	fmt.Printf("RESP cache server listening on %s (try: redis-cli -p %s)\n", ln.Addr(), portOf(ln.Addr()))
+	if err := server.Serve(ln); err != nil {
+		fmt.Println("Error:", err)
+	}
+	if err := cache.Close(); err != nil {
+		fmt.Println("Error:", err)
+	}
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+// demoRESP runs the RESP server on a loopback port and talks to it with
+// the Go client, the way a service would talk to Redis.
+func demoRESP() {
+	fmt.Println("\n--- RESP Cache Server ---")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	cache := NewCache(serverCacheConfig)
+	defer cache.Close()
+	server := NewRESPServer(cache)
+	go server.Serve(ln)
+	defer server.Close()
+
+	client, err := Dial(ln.Addr().String())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer client.Close()
+
+	// 1. Plain commands
+	for _, cmd := range [][]string{
+		{"PING"},
+		{"SET", "greeting", "hello", "EX", "10"},
+		{"GET", "greeting"},
+		{"TTL", "greeting"},
+		{"SET", "greeting", "bonjour", "NX"},
+		{"INCR", "visits"},
+		{"INCR", "visits"},
+		{"MGET", "greeting", "visits", "missing"},
+		{"INCR", "greeting"},
+		{"DEL", "greeting", "missing"},
+		{"TTL", "greeting"},
+	} {
+		reply, err := client.Do(cmd...)
+		if err != nil {
+			fmt.Printf("%-40s -> (error) %v\n", strings.Join(cmd, " "), err)
+			continue
+		}
+		fmt.Printf("%-40s -> %v\n", strings.Join(cmd, " "), formatReply(reply))
+	}
+
+	// 2. Pipelining: 1000 commands in one round trip
+	const n = 1000
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		client.Incr("sequential")
+	}
+	sequential := time.Since(start)
+	cmds := make([][]string, n)
+	for i := range cmds {
+		cmds[i] = []string{"INCR", "pipelined"}
+	}
+	start = time.Now()
+	replies, _ := client.Pipeline(cmds)
+	fmt.Printf("%d INCRs: sequential %v, pipelined %v (last reply %v)\n",
+		n, sequential.Round(time.Microsecond), time.Since(start).Round(time.Microsecond), replies[n-1])
+
+	// 3. Many concurrent clients
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Dial(ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			for j := 0; j < 100; j++ {
+				c.Incr("shared")
+			}
+		}()
+	}
+	wg.Wait()
+	total, _, _ := client.Get("shared")
+	fmt.Printf("50 clients x 100 INCRs -> shared = %s\n", total)
+}
+
+// demoPersistence restarts a persistent cache and shows it comes back warm,
+// then compares the cost of the fsync policies.
+func demoPersistence() {
+	fmt.Println("\n--- Persistence ---")
+	dir, err := os.MkdirTemp("", "cache-data")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	config := CacheConfig[string, User]{DefaultTTL: time.Hour, Sizer: userSize}
+	persistence := PersistenceConfig{Dir: dir, AppendOnly: true, Fsync: FsyncAlways}
+
+	// 1. First run: fill the cache, snapshot halfway, then crash (no Close).
+	cache, err := OpenCache(config, persistence)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		id := strconv.Itoa(i)
+		cache.Set(id, User{ID: id, Name: "User " + id})
+	}
+	cache.Snapshot()
+	cache.SetWithTTL("temp", User{ID: "temp"}, 50*time.Millisecond)
+	cache.Set("1", User{ID: "1", Name: "Alice (renamed after the snapshot)"})
+	cache.Delete("2")
+	fmt.Printf("Before crash: %d keys, files: %s\n", cache.Len(), listFiles(dir))
+	cache.persist.close(cache) // Simulated crash: only release the files
+
+	// 2. Second run: the snapshot is loaded and the log replayed over it.
+	time.Sleep(100 * time.Millisecond) // "temp" expires while we are down
+	restarted, err := OpenCache(config, persistence)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	alice, _ := restarted.Get("1")
+	_, hasBob := restarted.Get("2")
+	_, hasTemp := restarted.Get("temp")
+	ttl, _ := restarted.TTL("3")
+	fmt.Printf("After restart: %d keys, user 1 = %q, user 2 present = %v, temp present = %v, user 3 TTL ~%v\n",
+		restarted.Len(), alice.Name, hasBob, hasTemp, ttl.Round(time.Minute))
+	restarted.Close()
+
+	// 3. The price of durability.
+	for _, policy := range []FsyncPolicy{FsyncAlways, FsyncEverySec, FsyncNo} {
+		cache, err := OpenCache(config, PersistenceConfig{Dir: filepath.Join(dir, policy.String()), AppendOnly: true, Fsync: policy})
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		start := time.Now()
+		for i := 0; i < 500; i++ {
+			cache.Set(strconv.Itoa(i), User{ID: strconv.Itoa(i)})
+		}
+		fmt.Printf("fsync %-9s 500 writes took %v\n", policy, time.Since(start).Round(time.Microsecond))
+		cache.Close()
+	}
+}
+
+// demoTwoTier runs four app instances, each with a local L1, sharing the
+// RESP server as L2. Instances A, B and C listen for invalidations; D does
+// not, and keeps serving its stale L1 copy after A updates the user until
+// its short L1 TTL runs out.
+func demoTwoTier() {
+	fmt.Println("\n--- Two-Tier Cache (L1 per instance, shared L2) ---")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	l2 := NewCache(serverCacheConfig)
+	defer l2.Close()
+	server := NewRESPServer(l2)
+	go server.Serve(ln)
+	defer server.Close()
+
+	db := NewDatabase()
+	var dbLoads atomic.Int64
+	load := func(id string) (User, error) {
+		dbLoads.Add(1)
+		if user, ok := db.peek(id); ok {
+			return user, nil
+		}
+		return User{}, ErrNotFound
+	}
+
+	bus := NewEventBus()
+	names := []string{"A", "B", "C", "D"}
+	instances := make(map[string]*TieredCache[string, User])
+	for _, name := range names {
+		client, err := Dial(ln.Addr().String())
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
+		defer client.Close()
+		// A short L1 TTL bounds how long a missed invalidation is felt.
+		l1 := NewCache(CacheConfig[string, User]{DefaultTTL: 500 * time.Millisecond, MaxEntries: 100})
+		defer l1.Close()
+
+		instanceBus := bus
+		if name == "D" {
+			instanceBus = nil
+		}
+		instances[name] = NewTieredCache(name, l1, NewRemoteL2[User](client), 10*time.Minute, instanceBus)
+	}
+
+	read := func(label string) {
+		fmt.Printf("%-22s", label)
+		for _, name := range names {
+			user, _ := instances[name].GetOrLoad("1", load)
+			fmt.Printf(" %s=%-14q", name, user.Name)
+		}
+		fmt.Printf(" (DB loads so far: %d)\n", dbLoads.Load())
+	}
+
+	// 1. Cold start: A loads from the DB, the others find it in L2.
+	read("First reads:")
+
+	// 2. A updates the user: L2 and A's L1 get the new value, and the
+	// others are told to drop their L1 copy.
+	instances["A"].Set("1", User{ID: "1", Name: "Alice Smith", Email: "alice@example.com"})
+	time.Sleep(50 * time.Millisecond) // Let the invalidations arrive
+	read("After A's update:")
+
+	// 3. D never heard about the update, but its L1 copy expires and it
+	// reads the new value from L2.
+	time.Sleep(500 * time.Millisecond)
+	read("After the L1 TTL:")
+}
+
+// listFiles returns the names of the files in dir.
+func listFiles(dir string) string {
+	entries, _ := os.ReadDir(dir)
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatReply renders a reply the way redis-cli does.
+func formatReply(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "(nil)"
+	case int64:
+		return fmt.Sprintf("(integer) %d", v)
+	case string:
+		return strconv.Quote(v)
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = formatReply(item)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+// demoTTL shows an entry disappearing once its TTL has passed.
+func demoTTL() {
+	fmt.Println("\n--- TTL Expiry ---")
+	cache := NewCache(CacheConfig[string, User]{DefaultTTL: 200 * time.Millisecond, SweepInterval: 50 * time.Millisecond})
+	defer cache.Close()
+
+	cache.Set("1", User{ID: "1", Name: "Alice"})
+	cache.SetWithTTL("2", User{ID: "2", Name: "Bob"}, 0) // Never expires
+	_, found := cache.Get("1")
+	fmt.Printf("Right after Set: user 1 cached = %v\n", found)
+
+	time.Sleep(300 * time.Millisecond)
+	// The background sweeper has already purged user 1: Len counts only Bob.
+	_, found = cache.Get("1")
+	fmt.Printf("After 300ms:     user 1 cached = %v, entries left = %d\n", found, cache.Len())
+}
+
+// comparePolicies replays the same skewed workload against each eviction
+// policy and prints the hit ratio. A few keys are very popular (Zipf
+// distribution), and halfway through, a one-off scan touches 2000 keys
+// that are never requested again, the way a batch job or crawler would.
+func comparePolicies() {
+	fmt.Println("\n--- Eviction Policies (capacity 100, 1000 keys, Zipf + scan) ---")
+	policies := []struct {
+		name      string
+		newPolicy func(capacity int) EvictionPolicy[string]
+	}{
+		{"LRU", func(int) EvictionPolicy[string] { return NewLRUPolicy[string]() }},
+		{"LFU", func(int) EvictionPolicy[string] { return NewLFUPolicy[string]() }},
+		{"W-TinyLFU", func(capacity int) EvictionPolicy[string] { return NewTinyLFUPolicy[string](capacity) }},
+	}
+
+	for _, p := range policies {
+		// One shard, so every policy sees the whole key space.
+		cache := NewCache(CacheConfig[string, User]{MaxEntries: 100, Shards: 1, NewPolicy: p.newPolicy})
+		rng := rand.New(rand.NewSource(42))
+		zipf := rand.NewZipf(rng, 1.1, 1, 999)
+
+		hits, requests := 0, 0
+		get := func(id string) {
+			requests++
+			if _, ok := cache.Get(id); ok {
+				hits++
+				return
+			}
+			cache.Set(id, User{ID: id}) // Read-through on a miss
+		}
+
+		for i := 0; i < 50000; i++ {
+			if i == 25000 {
+				for j := 0; j < 2000; j++ {
+					get("scan-" + strconv.Itoa(j))
+				}
+			}
+			get(strconv.FormatUint(zipf.Uint64(), 10))
+		}
+		fmt.Printf("%-10s hit ratio: %.1f%%\n", p.name, 100*float64(hits)/float64(requests))
+	}
+}
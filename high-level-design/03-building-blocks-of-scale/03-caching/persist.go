@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy decides how often the append-only log is forced to disk,
+// trading write latency for how much a power loss can take away.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySec syncs once per second: at most a second of writes is lost.
+	FsyncEverySec FsyncPolicy = iota
+	// FsyncAlways syncs after every write: nothing is lost, writes are slowest.
+	FsyncAlways
+	// FsyncNo leaves syncing to the OS, which usually flushes within 30s.
+	FsyncNo
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncEverySec:
+		return "everysec"
+	case FsyncAlways:
+		return "always"
+	case FsyncNo:
+		return "no"
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+}
+
+// PersistenceConfig controls how a cache survives restarts. It follows
+// Redis, which offers the same two mechanisms:
+//   - snapshots: the whole cache written out at intervals. Compact and fast
+//     to load, but everything since the last snapshot is lost on a crash.
+//   - an append-only log (AOF) of every mutation. Loses at most what the
+//     fsync policy allows, but grows until the next snapshot truncates it.
+//
+// Both can be enabled together: on start the snapshot is loaded and the
+// log written since is replayed over it.
+type PersistenceConfig struct {
+	Dir              string        // Where the snapshot and log files live
+	SnapshotInterval time.Duration // 0 disables periodic snapshots
+	AppendOnly       bool          // Log every mutation
+	Fsync            FsyncPolicy   // How often the log is synced
+}
+
+// record is one line of a snapshot or of the append-only log. Mutations
+// are logged as the state they leave behind, never as operations such as
+// "increment", so replaying a record twice is harmless.
+type record[K comparable, V any] struct {
+	Op        string `json:"op"` // "set" or "del"
+	Key       K      `json:"key"`
+	Value     V      `json:"value,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix milliseconds; 0 means never
+}
+
+const (
+	opSet = "set"
+	opDel = "del"
+
+	snapshotFile = "snapshot.jsonl"
+)
+
+// persister writes a cache's snapshots and log.
+//
+// Each snapshot starts a new log generation (appendonly.<gen>.jsonl), and
+// only deletes older generations once the snapshot is safely on disk. Since
+// records hold resulting states, replaying every remaining generation over
+// the snapshot restores the latest state whether or not a crash interrupted
+// a snapshot.
+type persister[K comparable, V any] struct {
+	config PersistenceConfig
+
+	mu  sync.Mutex // Guards the log; taken while holding a shard lock
+	aof *os.File
+	gen int
+
+	snapshotMu sync.Mutex // Serialises snapshots
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// OpenCache creates a cache that persists to config.Dir and loads whatever
+// a previous run left there, so it starts warm.
+func OpenCache[K comparable, V any](config CacheConfig[K, V], persistence PersistenceConfig) (*Cache[K, V], error) {
+	if err := os.MkdirAll(persistence.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	p := &persister[K, V]{config: persistence, stop: make(chan struct{}), done: make(chan struct{})}
+	c := NewCache(config)
+
+	// 1. Load the last snapshot, then replay the log written since.
+	if err := c.loadFile(filepath.Join(persistence.Dir, snapshotFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.Close()
+		return nil, err
+	}
+	gens, err := p.generations()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, gen := range gens {
+		if err := c.loadFile(p.aofPath(gen)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		p.gen = gen
+	}
+
+	// 2. Append to a fresh generation from now on.
+	if persistence.AppendOnly {
+		if err := p.rotate(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	c.persist = p
+	go p.run(c)
+	return c, nil
+}
+
+// Snapshot writes the whole cache to disk and truncates the log.
+func (c *Cache[K, V]) Snapshot() error {
+	if c.persist == nil {
+		return errors.New("cache is not persistent")
+	}
+	return c.persist.snapshot(c)
+}
+
+// logSet records the state of key. Caller holds the shard mutex, which
+// keeps the log in the same order as the mutations of each key.
+func (c *Cache[K, V]) logSet(key K, e *entry[V]) {
+	if c.persist == nil {
+		return
+	}
+	rec := record[K, V]{Op: opSet, Key: key, Value: e.value}
+	if !e.expiresAt.IsZero() {
+		rec.ExpiresAt = e.expiresAt.UnixMilli()
+	}
+	c.persist.append(rec)
+}
+
+// logDelete records that key was removed. Caller holds the shard mutex.
+func (c *Cache[K, V]) logDelete(key K) {
+	if c.persist == nil {
+		return
+	}
+	c.persist.append(record[K, V]{Op: opDel, Key: key})
+}
+
+// loadFile applies the records of a snapshot or log file. Expired entries
+// are skipped. A damaged last line, left by a crash in the middle of a
+// write, is ignored; damage anywhere else is an error.
+func (c *Cache[K, V]) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var rec record[K, V]
+		if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				fmt.Printf("Persistence: Ignoring truncated record at %s:%d\n", path, lineNo)
+				return nil
+			}
+			return fmt.Errorf("%s:%d: %w", path, lineNo, jsonErr)
+		}
+
+		s := c.shardFor(rec.Key)
+		s.mutex.Lock()
+		switch {
+		case rec.Op == opDel || (rec.ExpiresAt != 0 && now.UnixMilli() >= rec.ExpiresAt):
+			if _, ok := s.store[rec.Key]; ok {
+				s.remove(rec.Key)
+			}
+		case rec.Op == opSet:
+			e := &entry[V]{value: rec.Value, size: c.config.Sizer(rec.Key, rec.Value)}
+			if rec.ExpiresAt != 0 {
+				e.expiresAt = time.UnixMilli(rec.ExpiresAt)
+			}
+			s.set(rec.Key, e)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (p *persister[K, V]) append(rec record[K, V]) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Printf("Persistence: Cannot encode record for %v: %v\n", rec.Key, err)
+		return
+	}
+	line = append(line, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.aof == nil {
+		return
+	}
+	if _, err := p.aof.Write(line); err != nil {
+		fmt.Printf("Persistence: Append failed: %v\n", err)
+		return
+	}
+	if p.config.Fsync == FsyncAlways {
+		p.aof.Sync()
+	}
+}
+
+// rotate starts the next log generation. Records appended from now on go
+// to the new file.
+func (p *persister[K, V]) rotate() error {
+	f, err := os.OpenFile(p.aofPath(p.gen+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	old := p.aof
+	p.aof = f
+	p.gen++
+	p.mu.Unlock()
+
+	if old != nil {
+		old.Sync()
+		old.Close()
+	}
+	return nil
+}
+
+// snapshot writes every live entry to a temporary file and renames it over
+// the previous snapshot, so a crash never leaves a half-written snapshot
+// behind. Log generations older than the snapshot are then deleted.
+func (p *persister[K, V]) snapshot(c *Cache[K, V]) error {
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	// 1. Send new mutations to a new log generation. Everything in older
+	// generations is then also reflected in the shards we are about to read.
+	if p.config.AppendOnly {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	keepFrom := p.gen
+	p.mu.Unlock()
+
+	// 2. Write the snapshot, one shard at a time.
+	path := filepath.Join(p.config.Dir, snapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	now := time.Now()
+	for _, s := range c.shards {
+		var recs []record[K, V]
+		s.mutex.Lock()
+		for key, e := range s.store {
+			if e.missing || e.expired(now) {
+				continue
+			}
+			rec := record[K, V]{Op: opSet, Key: key, Value: e.value}
+			if !e.expiresAt.IsZero() {
+				rec.ExpiresAt = e.expiresAt.UnixMilli()
+			}
+			recs = append(recs, rec)
+		}
+		s.mutex.Unlock()
+
+		for _, rec := range recs {
+			if err := enc.Encode(rec); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// 3. The snapshot covers the older log generations now.
+	gens, err := p.generations()
+	if err != nil {
+		return err
+	}
+	for _, gen := range gens {
+		if gen < keepFrom || !p.config.AppendOnly {
+			os.Remove(p.aofPath(gen))
+		}
+	}
+	return nil
+}
+
+// run syncs the log once per second with FsyncEverySec and takes periodic
+// snapshots.
+func (p *persister[K, V]) run(c *Cache[K, V]) {
+	defer close(p.done)
+
+	var sync, snapshot <-chan time.Time
+	if p.config.AppendOnly && p.config.Fsync == FsyncEverySec {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		sync = t.C
+	}
+	if p.config.SnapshotInterval > 0 {
+		t := time.NewTicker(p.config.SnapshotInterval)
+		defer t.Stop()
+		snapshot = t.C
+	}
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-sync:
+			p.mu.Lock()
+			p.aof.Sync()
+			p.mu.Unlock()
+		case <-snapshot:
+			if err := p.snapshot(c); err != nil {
+				fmt.Printf("Persistence: Snapshot failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// close takes a last snapshot if snapshots are enabled, then syncs and
+// closes the log.
+func (p *persister[K, V]) close(c *Cache[K, V]) error {
+	close(p.stop)
+	<-p.done
+
+	var err error
+	if p.config.SnapshotInterval > 0 {
+		err = p.snapshot(c)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.aof != nil {
+		p.aof.Sync()
+		err = errors.Join(err, p.aof.Close())
+		p.aof = nil
+	}
+	return err
+}
+
+func (p *persister[K, V]) aofPath(gen int) string {
+	return filepath.Join(p.config.Dir, fmt.Sprintf("appendonly.%06d.jsonl", gen))
+}
+
+// generations lists the log generations on disk, oldest first.
+func (p *persister[K, V]) generations() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(p.config.Dir, "appendonly.*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var gens []int
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "appendonly."), ".jsonl")
+		if gen, err := strconv.Atoi(name); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
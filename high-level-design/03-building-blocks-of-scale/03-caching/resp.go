@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP2 is the Redis wire protocol. Every value starts with a type byte
+// and ends with CRLF:
+//
+//	+OK\r\n                       simple string
+//	-ERR message\r\n              error
+//	:42\r\n                       integer
+//	$5\r\nhello\r\n               bulk string ($-1\r\n is null)
+//	*2\r\n$3\r\nGET\r\n$1\r\nk\r\n  array (*-1\r\n is null)
+//
+// Clients send commands as arrays of bulk strings. Tools like telnet may
+// also send "inline" commands: a plain line of space-separated words.
+
+// Limits that keep a malformed or hostile client from making us allocate
+// huge buffers. They match Redis' defaults.
+const (
+	maxBulkLen  = 512 << 20
+	maxArrayLen = 1 << 20
+)
+
+var errProtocol = errors.New("protocol error")
+
+// RESPError is an error reply sent by the server.
+type RESPError string
+
+func (e RESPError) Error() string { return string(e) }
+
+// readCommand reads one command, in array or inline form.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	v, err := readValue(r)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: command must be an array", errProtocol)
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: command arguments must be bulk strings", errProtocol)
+		}
+		args[i] = s
+	}
+	return args, nil
+}
+
+// readValue reads one RESP value. Strings come back as string, integers as
+// int64, nulls as nil, arrays as []any and error replies as RESPError.
+func readValue(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("%w: empty line", errProtocol)
+	}
+
+	switch prefix, rest := line[0], line[1:]; prefix {
+	case '+':
+		return rest, nil
+	case '-':
+		return RESPError(rest), nil
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad integer %q", errProtocol, rest)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 || n > maxBulkLen {
+			return nil, fmt.Errorf("%w: bad bulk length %q", errProtocol, rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 || n > maxArrayLen {
+			return nil, fmt.Errorf("%w: bad array length %q", errProtocol, rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%w: unknown type byte %q", errProtocol, line[0])
+}
+
+// readLine reads a line and strips its CRLF (or bare LF, for telnet users).
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// respWriter encodes replies. Writes are buffered; the caller flushes.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func (w respWriter) err(s string)    { fmt.Fprintf(w, "-%s\r\n", s) }
+func (w respWriter) integer(n int64) { fmt.Fprintf(w, ":%d\r\n", n) }
+func (w respWriter) null()           { w.WriteString("$-1\r\n") }
+func (w respWriter) array(n int)     { fmt.Fprintf(w, "*%d\r\n", n) }
+
+func (w respWriter) bulk(s string) {
+	fmt.Fprintf(w, "$%d\r\n", len(s))
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+// command encodes a command as an array of bulk strings.
+func (w respWriter) command(args []string) {
+	w.array(len(args))
+	for _, a := range args {
+		w.bulk(a)
+	}
+}
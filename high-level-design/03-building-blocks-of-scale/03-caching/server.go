@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RESPServer exposes a Cache over TCP using a subset of the Redis protocol,
+// so redis-cli and Redis client libraries can talk to it:
+//
+//	PING [message]
+//	GET key
+//	SET key value [EX seconds | PX milliseconds] [NX]
+//	DEL key [key ...]
+//	EXPIRE key seconds
+//	TTL key
+//	INCR key
+//	MGET key [key ...]
+//
+// Each connection is served by its own goroutine. Clients may pipeline:
+// replies are buffered and flushed only once no more commands are waiting
+// in the read buffer, so a batch of commands costs one write.
+type RESPServer struct {
+	cache *Cache[string, string]
+
+	mu      sync.Mutex
+	ln      net.Listener
+	conns   map[net.Conn]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func NewRESPServer(cache *Cache[string, string]) *RESPServer {
+	return &RESPServer{cache: cache, conns: make(map[net.Conn]struct{})}
+}
+
+// Serve accepts connections on ln until Close is called.
+func (s *RESPServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their goroutines to finish.
+func (s *RESPServer) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *RESPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				// Like Redis, report the error and hang up: the stream
+				// can no longer be trusted to be in sync.
+				w.err("ERR " + err.Error())
+				w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("RESP: Connection %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			s.execute(w, args)
+		}
+
+		// More pipelined commands already arrived: answer them all in one write.
+		if r.Buffered() > 0 {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Errors of INCR, worded as Redis does.
+var (
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// arity is the number of arguments of each command, including its name.
+// A negative value means "at least that many".
+var arity = map[string]int{
+	"PING": -1, "GET": 2, "SET": -3, "DEL": -2, "EXPIRE": 3, "TTL": 2, "INCR": 2, "MGET": -2,
+}
+
+func (s *RESPServer) execute(w respWriter, args []string) {
+	name := strings.ToUpper(args[0])
+	n, ok := arity[name]
+	if !ok {
+		w.err(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) {
+		w.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			w.bulk(args[1])
+		} else {
+			w.simple("PONG")
+		}
+	case "GET":
+		if v, ok := s.cache.Get(args[1]); ok {
+			w.bulk(v)
+		} else {
+			w.null()
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		var deleted int64
+		for _, key := range args[1:] {
+			if s.cache.Delete(key) {
+				deleted++
+			}
+		}
+		w.integer(deleted)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || seconds > int64(math.MaxInt64/time.Second) {
+			w.err("ERR value is not an integer or out of range")
+			return
+		}
+		var ok bool
+		if seconds <= 0 {
+			// Redis deletes a key whose new TTL is already in the past.
+			ok = s.cache.Delete(args[1])
+		} else {
+			ok = s.cache.Expire(args[1], time.Duration(seconds)*time.Second)
+		}
+		w.integer(boolInt(ok))
+	case "TTL":
+		ttl, ok := s.cache.TTL(args[1])
+		switch {
+		case !ok:
+			w.integer(-2)
+		case ttl == 0:
+			w.integer(-1)
+		default:
+			w.integer(int64((ttl + time.Second/2) / time.Second))
+		}
+	case "INCR":
+		v, err := s.cache.Update(args[1], func(old string, exists bool) (string, error) {
+			n := int64(0)
+			if exists {
+				var err error
+				if n, err = strconv.ParseInt(old, 10, 64); err != nil {
+					return "", errNotInteger
+				}
+			}
+			if n == math.MaxInt64 {
+				return "", errOverflow
+			}
+			return strconv.FormatInt(n+1, 10), nil
+		})
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		n, _ := strconv.ParseInt(v, 10, 64)
+		w.integer(n)
+	case "MGET":
+		w.array(len(args) - 1)
+		for _, key := range args[1:] {
+			if v, ok := s.cache.Get(key); ok {
+				w.bulk(v)
+			} else {
+				w.null()
+			}
+		}
+	}
+}
+
+// set handles SET key value [EX seconds | PX milliseconds] [NX].
+func (s *RESPServer) set(w respWriter, args []string) {
+	key, value := args[1], args[2]
+	var ttl time.Duration
+	nx := false
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "EX", "PX":
+			if ttl != 0 || i+1 == len(args) {
+				w.err("ERR syntax error")
+				return
+			}
+			i++
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 || n > int64(math.MaxInt64/unit) {
+				w.err("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+	}
+
+	if nx {
+		if !s.cache.SetIfAbsent(key, value, ttl) {
+			w.null()
+			return
+		}
+	} else {
+		s.cache.SetWithTTL(key, value, ttl)
+	}
+	w.simple("OK")
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves a fresh cache on a loopback port and returns a
+// client connected to it.
+func startServer(t *testing.T) (*Client, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCache(CacheConfig[string, string]{})
+	srv := NewRESPServer(cache)
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		cache.Close()
+	})
+	return dial(t, ln.Addr().String()), ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Client {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// steps are commands, space-separated, and the replies they should get:
+// a value as returned by Client.Do or a RESPError.
+type steps = []struct {
+	cmd  string
+	want any
+}
+
+// run sends each command and checks its reply.
+func run(t *testing.T, c *Client, steps steps) {
+	t.Helper()
+	for _, step := range steps {
+		got, err := c.Do(strings.Fields(step.cmd)...)
+		if err != nil {
+			got = err
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %#v, want %#v", step.cmd, got, step.want)
+		}
+	}
+}
+
+func TestRESPCommands(t *testing.T) {
+	c, _ := startServer(t)
+	run(t, c, steps{
+		{"PING", "PONG"},
+		{"PING hello", "hello"},
+		{"GET k", nil},
+		{"SET k v", "OK"},
+		{"GET k", "v"},
+		{"SET k v2 NX", nil},
+		{"SET n v NX", "OK"},
+		{"GET k", "v"},
+		{"TTL k", int64(-1)},
+		{"TTL missing", int64(-2)},
+		{"EXPIRE k 100", int64(1)},
+		{"TTL k", int64(100)},
+		{"EXPIRE missing 100", int64(0)},
+		{"SET e v EX 60", "OK"},
+		{"TTL e", int64(60)},
+		{"SET p v PX 30000", "OK"},
+		{"TTL p", int64(30)},
+		{"EXPIRE p 0", int64(1)},
+		{"GET p", nil},
+		{"MGET k missing n", []any{"v", nil, "v"}},
+		{"DEL k n missing", int64(2)},
+		{"GET k", nil},
+		{"set lower case", "OK"},
+		{"get lower", "case"},
+	})
+}
+
+func TestRESPErrors(t *testing.T) {
+	c, _ := startServer(t)
+	run(t, c, steps{
+		{"NOPE", RESPError("ERR unknown command 'NOPE'")},
+		{"GET", RESPError("ERR wrong number of arguments for 'get' command")},
+		{"GET a b", RESPError("ERR wrong number of arguments for 'get' command")},
+		{"SET k v EX", RESPError("ERR syntax error")},
+		{"SET k v EX 10 PX 10", RESPError("ERR syntax error")},
+		{"SET k v XX", RESPError("ERR syntax error")},
+		{"SET k v EX 0", RESPError("ERR invalid expire time in 'set' command")},
+		{"SET k v PX ten", RESPError("ERR invalid expire time in 'set' command")},
+		{"SET k v EX 9223372036854775807", RESPError("ERR invalid expire time in 'set' command")},
+		{"EXPIRE k soon", RESPError("ERR value is not an integer or out of range")},
+		{"GET k", nil}, // No failed SET stored anything
+	})
+}
+
+func TestRESPExpiry(t *testing.T) {
+	c, _ := startServer(t)
+	run(t, c, steps{{"SET k v PX 50", "OK"}, {"GET k", "v"}})
+	time.Sleep(100 * time.Millisecond)
+	run(t, c, steps{{"GET k", nil}, {"TTL k", int64(-2)}})
+}
+
+func TestRESPIncr(t *testing.T) {
+	c, _ := startServer(t)
+	run(t, c, steps{
+		{"INCR n", int64(1)},
+		{"INCR n", int64(2)},
+		{"GET n", "2"},
+		{"SET s abc", "OK"},
+		{"INCR s", RESPError("ERR value is not an integer or out of range")},
+		{"GET s", "abc"},
+		{"SET max 9223372036854775807", "OK"},
+		{"INCR max", RESPError("ERR increment or decrement would overflow")},
+		{"GET max", "9223372036854775807"},
+		{"SET min -9223372036854775808", "OK"},
+		{"INCR min", int64(-9223372036854775807)},
+	})
+}
+
+func TestRESPPipeline(t *testing.T) {
+	c, _ := startServer(t)
+	replies, err := c.Pipeline([][]string{
+		{"SET", "a", "1"},
+		{"INCR", "a"},
+		{"GET", "a"},
+		{"INCR", "a", "extra"},
+		{"MGET", "a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{
+		"OK", int64(2), "2",
+		RESPError("ERR wrong number of arguments for 'incr' command"),
+		[]any{"2", nil},
+	}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("got %#v, want %#v", replies, want)
+	}
+}
+
+func TestRESPConcurrentClients(t *testing.T) {
+	c, addr := startServer(t)
+	const clients, incrs = 8, 100
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		client := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range incrs {
+				if _, err := client.Incr("counter"); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := client.Set("client"+strconv.Itoa(i), "x", 0); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	run(t, c, steps{{"GET counter", strconv.Itoa(clients * incrs)}})
+}
+
+func TestRESPInlineCommands(t *testing.T) {
+	_, addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "SET k v\r\nGET k\n")
+	r := bufio.NewReader(conn)
+	for _, want := range []any{"OK", "v"} {
+		if got, err := readValue(r); err != nil || got != want {
+			t.Errorf("got %#v, %v; want %#v", got, err, want)
+		}
+	}
+}
+
+func TestRESPMalformedInput(t *testing.T) {
+	for _, input := range []string{
+		"*1\r\n:5\r\n",            // Arguments must be bulk strings
+		"*1\r\n$abc\r\n",          // Bad bulk length
+		"*1\r\n$3\r\nGETXX\r\n",   // Bulk string longer than announced
+		"*x\r\n",                  // Bad array length
+		"*99999999999\r\n",        // Array too long
+		"*1\r\n$-2\r\n",           // Negative bulk length
+		"*1\r\n?what\r\n",         // Unknown type byte
+		"*2\r\n$3\r\nGET\r\n\r\n", // Empty line
+	} {
+		_, addr := startServer(t)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, input)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		r := bufio.NewReader(conn)
+		reply, err := readValue(r)
+		if e, ok := reply.(RESPError); err != nil || !ok || !strings.HasPrefix(string(e), "ERR protocol error") {
+			t.Errorf("%q: got %#v, %v; want a protocol error", input, reply, err)
+		}
+		// The server hangs up after a protocol error.
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Errorf("%q: connection still open after a protocol error (%v)", input, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestClientSetRoundsTTLUp(t *testing.T) {
+	c, _ := startServer(t)
+	// 500µs would truncate to PX 0, which the server refuses.
+	if err := c.Set("k", "v", 500*time.Microsecond); err != nil {
+		t.Fatalf("sub-millisecond TTL: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ok, err := c.Get("k"); ok || err != nil {
+		t.Errorf("key still there after its TTL: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls for the same key into one, like
+// golang.org/x/sync/singleflight but typed. The zero value is ready to use.
+type flightGroup[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*flight[V]
+}
+
+// flight is a call in progress or just completed.
+type flight[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+// PanicError is what waiters get when the call they were waiting for
+// panicked. The caller that ran it gets the panic itself.
+type PanicError struct {
+	Value any
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("shared call panicked: %v", e.Value)
+}
+
+// Do runs fn for key unless a call for key is already running, in which
+// case it waits for that call and returns its result. shared reports
+// whether the result came from another caller's call.
+func (g *flightGroup[K, V]) Do(key K, fn func() (V, error)) (v V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*flight[V])
+	}
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.val, f.err, true
+	}
+	f := &flight[V]{}
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	// If fn panics (or calls runtime.Goexit), waiters get an error rather
+	// than a zero value passed off as a success, and are released so they
+	// do not block forever; the panic then carries on up this goroutine.
+	returned := false
+	defer func() {
+		r := recover()
+		if !returned {
+			var zero V
+			f.val, f.err = zero, &PanicError{Value: r}
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		f.wg.Done()
+		if r != nil {
+			panic(r)
+		}
+	}()
+	f.val, f.err = fn()
+	returned = true
+	return f.val, f.err, false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupSharesResult(t *testing.T) {
+	var g flightGroup[string, int]
+	release := make(chan struct{})
+	calls := 0
+
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, _ = g.Do("k", func() (int, error) {
+				calls++
+				<-release
+				return 42, nil
+			})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // Let every caller join the flight
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn ran %d times, want 1", calls)
+	}
+	for _, v := range results {
+		if v != 42 {
+			t.Errorf("got %d, want 42", v)
+		}
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup[string, int]
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		g.Do("k", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err, shared := g.Do("k", func() (int, error) { return 1, nil })
+		if !shared {
+			err = errors.New("waiter ran its own call")
+		}
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the waiter join the flight
+	close(release)
+
+	if r := <-panicked; r != "boom" {
+		t.Errorf("caller recovered %v, want the original panic", r)
+	}
+	var pe *PanicError
+	if err := <-waited; !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Errorf("waiter got %v, want a PanicError", err)
+	}
+
+	// The key is free again.
+	if v, err, _ := g.Do("k", func() (int, error) { return 7, nil }); v != 7 || err != nil {
+		t.Errorf("after the panic: got %d, %v", v, err)
+	}
+}
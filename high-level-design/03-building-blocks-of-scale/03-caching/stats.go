@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Eviction reasons reported by Stats.
+const (
+	EvictedSize    = "size"    // Pushed out by MaxEntries or MaxBytes
+	EvictedExpired = "expired" // TTL passed, found by a read or the sweeper
+)
+
+// Stats is a point-in-time view of a cache's effectiveness.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   map[string]uint64 // By reason: EvictedSize, EvictedExpired
+	Loads       uint64            // Loader calls made by GetOrLoad
+	LoadErrors  uint64            // Including ErrNotFound
+	AvgLoadTime time.Duration
+	MaxLoadTime time.Duration
+	Entries     int
+	Bytes       int // Estimated with the configured Sizer
+}
+
+// HitRatio is the fraction of reads served from the cache.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Stats returns the counters accumulated since the cache was created.
+func (c *Cache[K, V]) Stats() Stats {
+	stats := Stats{
+		Evictions:   map[string]uint64{EvictedSize: 0, EvictedExpired: 0},
+		Loads:       c.loads.Load(),
+		LoadErrors:  c.loadErrors.Load(),
+		MaxLoadTime: time.Duration(c.maxLoadTime.Load()),
+	}
+	if stats.Loads > 0 {
+		stats.AvgLoadTime = time.Duration(c.loadTime.Load() / int64(stats.Loads))
+	}
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		stats.Evictions[EvictedSize] += s.evictedSize
+		stats.Evictions[EvictedExpired] += s.evictedExpired
+		stats.Entries += len(s.store)
+		stats.Bytes += s.bytes
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+func (c *Cache[K, V]) recordLoad(took time.Duration, err error) {
+	c.loads.Add(1)
+	if err != nil {
+		c.loadErrors.Add(1)
+	}
+	c.loadTime.Add(int64(took))
+	for {
+		prev := c.maxLoadTime.Load()
+		if int64(took) <= prev || c.maxLoadTime.CompareAndSwap(prev, int64(took)) {
+			return
+		}
+	}
+}
+
+// KeyInfo describes one cached key, for debugging.
+type KeyInfo[K comparable] struct {
+	Key      K
+	TTL      time.Duration // Time left; 0 means no expiry
+	Size     int
+	Negative bool // A cached "not found"
+}
+
+// Keys lists the live keys with their remaining TTL, in no particular order.
+func (c *Cache[K, V]) Keys() []KeyInfo[K] {
+	now := time.Now()
+	var keys []KeyInfo[K]
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for key, e := range s.store {
+			if e.expired(now) {
+				continue
+			}
+			info := KeyInfo[K]{Key: key, Size: e.size, Negative: e.missing}
+			if !e.expiresAt.IsZero() {
+				info.TTL = e.expiresAt.Sub(now)
+			}
+			keys = append(keys, info)
+		}
+		s.mutex.Unlock()
+	}
+	return keys
+}
+
+// DebugHandler serves the cache's statistics and contents as JSON:
+//
+//	GET /stats                    hits, misses, evictions, load times, size
+//	GET /keys?prefix=user:&limit=100  keys with their remaining TTL, sorted
+//
+// It is meant for an internal debug port; it exposes every key.
+func (c *Cache[K, V]) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := c.Stats()
+		writeJSON(w, map[string]any{
+			"hits":          stats.Hits,
+			"misses":        stats.Misses,
+			"hit_ratio":     stats.HitRatio(),
+			"evictions":     stats.Evictions,
+			"loads":         stats.Loads,
+			"load_errors":   stats.LoadErrors,
+			"avg_load_time": stats.AvgLoadTime.String(),
+			"max_load_time": stats.MaxLoadTime.String(),
+			"entries":       stats.Entries,
+			"bytes":         stats.Bytes,
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		prefix := r.URL.Query().Get("prefix")
+
+		type keyJSON struct {
+			Key      string `json:"key"`
+			TTL      string `json:"ttl"`
+			Size     int    `json:"size"`
+			Negative bool   `json:"negative,omitempty"`
+		}
+		var keys []keyJSON
+		for _, info := range c.Keys() {
+			name := fmt.Sprint(info.Key)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			ttl := "none"
+			if info.TTL > 0 {
+				ttl = info.TTL.Round(time.Millisecond).String()
+			}
+			keys = append(keys, keyJSON{Key: name, TTL: ttl, Size: info.Size, Negative: info.Negative})
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+		total := len(keys)
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+		writeJSON(w, map[string]any{"total": total, "keys": keys})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
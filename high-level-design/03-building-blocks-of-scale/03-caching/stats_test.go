@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStatsFollowCacheOperations(t *testing.T) {
+	cache := NewCache(CacheConfig[string, string]{MaxEntries: 3, Shards: 1, NegativeTTL: time.Minute})
+	defer cache.Close()
+
+	cache.Set("a", "1")
+	cache.Get("a") // hit
+	cache.Get("b") // miss
+
+	// The fourth key pushes the least recently used out of a 3-entry cache.
+	cache.Set("b", "2")
+	cache.Set("c", "3")
+	cache.Set("d", "4") // evicts "a"
+
+	cache.SetWithTTL("e", "5", time.Millisecond) // evicts "b"
+	time.Sleep(5 * time.Millisecond)
+	cache.Get("e") // miss, purges the expired entry and frees a slot
+
+	// GetOrLoad: a load, a failed load, and a cached "not found".
+	cache.GetOrLoad("f", func(string) (string, error) { return "6", nil }) // miss, load
+	cache.GetOrLoad("f", func(string) (string, error) { return "", errors.New("not called") })
+	cache.GetOrLoad("g", func(string) (string, error) { return "", ErrNotFound }) // miss, load error, evicts "c"
+	cache.GetOrLoad("g", func(string) (string, error) { return "", errors.New("not called") })
+
+	stats := cache.Stats()
+	want := Stats{
+		Hits:       3, // a, f, cached not found g
+		Misses:     4, // b, e, f, g
+		Evictions:  map[string]uint64{EvictedSize: 3, EvictedExpired: 1},
+		Loads:      2,
+		LoadErrors: 1,
+		Entries:    3, // d, f and the negative entry for g
+		Bytes:      3 * defaultEntrySize,
+	}
+	if stats.Hits != want.Hits || stats.Misses != want.Misses {
+		t.Errorf("hits/misses = %d/%d, want %d/%d", stats.Hits, stats.Misses, want.Hits, want.Misses)
+	}
+	for reason, n := range want.Evictions {
+		if stats.Evictions[reason] != n {
+			t.Errorf("evictions[%s] = %d, want %d", reason, stats.Evictions[reason], n)
+		}
+	}
+	if stats.Loads != want.Loads || stats.LoadErrors != want.LoadErrors {
+		t.Errorf("loads/errors = %d/%d, want %d/%d", stats.Loads, stats.LoadErrors, want.Loads, want.LoadErrors)
+	}
+	if stats.Entries != want.Entries || stats.Bytes != want.Bytes {
+		t.Errorf("entries/bytes = %d/%d, want %d/%d", stats.Entries, stats.Bytes, want.Entries, want.Bytes)
+	}
+	if got := stats.HitRatio(); got != 3.0/7 {
+		t.Errorf("HitRatio = %v, want 3/7", got)
+	}
+}
+
+func TestStatsSweeperCountsExpiry(t *testing.T) {
+	cache := NewCache(CacheConfig[string, string]{SweepInterval: 5 * time.Millisecond})
+	defer cache.Close()
+	for i := range 10 {
+		cache.SetWithTTL(strconv.Itoa(i), "v", time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Nobody read the keys; the sweeper found them.
+	stats := cache.Stats()
+	if stats.Evictions[EvictedExpired] != 10 || stats.Entries != 0 {
+		t.Errorf("after the sweep: %d expired, %d entries; want 10 and 0", stats.Evictions[EvictedExpired], stats.Entries)
+	}
+	if stats.Hits+stats.Misses != 0 {
+		t.Errorf("the sweeper counted %d reads", stats.Hits+stats.Misses)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	cache := NewCache(CacheConfig[string, string]{NegativeTTL: time.Minute})
+	defer cache.Close()
+	cache.Set("user:1", "alice")
+	cache.SetWithTTL("user:2", "bob", time.Hour)
+	cache.Set("session:1", "x")
+	cache.GetOrLoad("user:3", func(string) (string, error) { return "", ErrNotFound })
+	cache.Get("user:1")
+
+	srv := httptest.NewServer(cache.DebugHandler())
+	defer srv.Close()
+	get := func(path string, v any) int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("GET %s: Content-Type = %q", path, ct)
+			}
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var stats struct {
+		Hits      uint64            `json:"hits"`
+		Misses    uint64            `json:"misses"`
+		HitRatio  float64           `json:"hit_ratio"`
+		Evictions map[string]uint64 `json:"evictions"`
+		Loads     uint64            `json:"loads"`
+		Entries   int               `json:"entries"`
+	}
+	if code := get("/stats", &stats); code != http.StatusOK {
+		t.Fatalf("GET /stats: status %d", code)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.HitRatio != 0.5 || stats.Loads != 1 || stats.Entries != 4 {
+		t.Errorf("GET /stats = %+v", stats)
+	}
+	if _, ok := stats.Evictions[EvictedSize]; !ok {
+		t.Errorf("GET /stats: evictions %v lack the %q reason", stats.Evictions, EvictedSize)
+	}
+
+	type key struct {
+		Key      string `json:"key"`
+		TTL      string `json:"ttl"`
+		Negative bool   `json:"negative"`
+	}
+	var keys struct {
+		Total int   `json:"total"`
+		Keys  []key `json:"keys"`
+	}
+	if code := get("/keys?prefix=user:", &keys); code != http.StatusOK {
+		t.Fatalf("GET /keys: status %d", code)
+	}
+	if keys.Total != 3 || len(keys.Keys) != 3 {
+		t.Fatalf("GET /keys?prefix=user: = %+v, want the 3 user keys", keys)
+	}
+	// Sorted by key, with the TTL and the negative flag.
+	if k := keys.Keys[0]; k.Key != "user:1" || k.TTL != "none" || k.Negative {
+		t.Errorf("keys[0] = %+v", k)
+	}
+	if k := keys.Keys[1]; k.Key != "user:2" || k.TTL == "none" {
+		t.Errorf("keys[1] = %+v, want a TTL", k)
+	}
+	if k := keys.Keys[2]; k.Key != "user:3" || !k.Negative {
+		t.Errorf("keys[2] = %+v, want a negative entry", k)
+	}
+
+	keys.Keys = nil
+	if code := get("/keys?limit=2", &keys); code != http.StatusOK {
+		t.Fatalf("GET /keys?limit=2: status %d", code)
+	}
+	if keys.Total != 4 || len(keys.Keys) != 2 || keys.Keys[0].Key != "session:1" {
+		t.Errorf("GET /keys?limit=2 = %+v, want 2 of 4 keys starting with session:1", keys)
+	}
+	if code := get("/keys?limit=0", nil); code != http.StatusBadRequest {
+		t.Errorf("GET /keys?limit=0: status %d, want 400", code)
+	}
+}
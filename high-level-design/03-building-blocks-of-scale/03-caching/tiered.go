@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// L2 is the shared second tier of a TieredCache, seen by every instance.
+type L2[K comparable, V any] interface {
+	Get(key K) (V, bool, error)
+	Set(key K, value V, ttl time.Duration) error
+	Delete(key K) error
+}
+
+// Invalidation is the payload of a CacheInvalidated event.
+type Invalidation struct {
+	Key    any
+	Origin string // Instance that changed the key
+}
+
+// TieredCache puts a small in-process L1 in front of a shared L2, like an
+// application instance with a local cache in front of Redis:
+//   - reads try L1, then L2, then the loader, filling the tiers on the way back;
+//   - writes go to L2 and the local L1, then an invalidation is published so
+//     every other instance drops its L1 copy.
+//
+// Invalidations are asynchronous, so another instance may serve its old L1
+// copy for a brief moment after a write. Keep the L1 TTL short: it bounds
+// the staleness if an invalidation is ever missed.
+type TieredCache[K comparable, V any] struct {
+	id    string
+	l1    *Cache[K, V]
+	l2    L2[K, V]
+	l2TTL time.Duration
+	bus   *EventBus
+
+	flights flightGroup[K, V]
+
+	// fills holds a generation for every key with an L1 fill in flight.
+	// onInvalidation bumps it, and a fill whose generation moved is not
+	// cached: it may have read L2 before the write it was told about.
+	mu    sync.Mutex
+	fills map[K]uint64
+}
+
+// NewTieredCache creates the tiers of instance id and subscribes it to
+// invalidations on bus. A nil bus disables invalidation.
+func NewTieredCache[K comparable, V any](id string, l1 *Cache[K, V], l2 L2[K, V], l2TTL time.Duration, bus *EventBus) *TieredCache[K, V] {
+	t := &TieredCache[K, V]{id: id, l1: l1, l2: l2, l2TTL: l2TTL, bus: bus, fills: make(map[K]uint64)}
+	if bus != nil {
+		bus.Subscribe(CacheInvalidated, t.onInvalidation)
+	}
+	return t
+}
+
+// GetOrLoad returns the value from L1, L2 or, on a miss in both, load.
+// Concurrent misses on the same key share one lookup, as in Cache.GetOrLoad.
+func (t *TieredCache[K, V]) GetOrLoad(key K, load func(K) (V, error)) (V, error) {
+	if v, ok := t.l1.Get(key); ok {
+		return v, nil
+	}
+	v, err, _ := t.flights.Do(key, func() (V, error) {
+		t.mu.Lock()
+		gen := t.fills[key]
+		t.fills[key] = gen
+		t.mu.Unlock()
+
+		v, err := t.fetch(key, load)
+
+		// 3. Fill L1, unless an invalidation arrived meanwhile. Checking
+		// and filling under mu means an invalidation either sees the new
+		// L1 entry and drops it, or has moved the generation already.
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if err == nil && t.fills[key] == gen {
+			t.l1.Set(key, v)
+		}
+		delete(t.fills, key)
+		return v, err
+	})
+	return v, err
+}
+
+// fetch reads key from L2, or from load on a miss, filling L2.
+func (t *TieredCache[K, V]) fetch(key K, load func(K) (V, error)) (V, error) {
+	// 1. Shared tier
+	if v, ok, err := t.l2.Get(key); err == nil && ok {
+		return v, nil
+	}
+	// 2. Source of truth. An unreachable L2 is not fatal: we fall
+	// through to the loader and only lose the sharing.
+	v, err := load(key)
+	if err != nil {
+		return v, err
+	}
+	t.l2.Set(key, v, t.l2TTL)
+	return v, nil
+}
+
+// Set writes the value to both tiers and invalidates the other instances.
+func (t *TieredCache[K, V]) Set(key K, value V) error {
+	if err := t.l2.Set(key, value, t.l2TTL); err != nil {
+		return err
+	}
+	t.l1.Set(key, value)
+	t.publish(key)
+	return nil
+}
+
+// Delete removes the key from both tiers and invalidates the other instances.
+func (t *TieredCache[K, V]) Delete(key K) error {
+	if err := t.l2.Delete(key); err != nil {
+		return err
+	}
+	t.l1.Delete(key)
+	t.publish(key)
+	return nil
+}
+
+func (t *TieredCache[K, V]) publish(key K) {
+	if t.bus == nil {
+		return
+	}
+	t.bus.Publish(Event{
+		Type:      CacheInvalidated,
+		Data:      Invalidation{Key: key, Origin: t.id},
+		Timestamp: time.Now(),
+	})
+}
+
+// onInvalidation drops the L1 copy of a key changed by another instance.
+// The origin already holds the new value in its L1.
+func (t *TieredCache[K, V]) onInvalidation(event Event) {
+	inv := event.Data.(Invalidation)
+	key, ok := inv.Key.(K)
+	if !ok || inv.Origin == t.id {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen, loading := t.fills[key]; loading {
+		t.fills[key] = gen + 1
+	}
+	t.l1.Delete(key)
+}
+
+// RemoteL2 stores values in a RESP server (or Redis) as JSON.
+type RemoteL2[V any] struct {
+	client *Client
+}
+
+func NewRemoteL2[V any](client *Client) *RemoteL2[V] {
+	return &RemoteL2[V]{client: client}
+}
+
+func (r *RemoteL2[V]) Get(key string) (V, bool, error) {
+	var v V
+	data, ok, err := r.client.Get(key)
+	if err != nil || !ok {
+		return v, false, err
+	}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return v, false, err
+	}
+	return v, true, nil
+}
+
+func (r *RemoteL2[V]) Set(key string, value V, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(key, string(data), ttl)
+}
+
+func (r *RemoteL2[V]) Delete(key string) error {
+	_, err := r.client.Do("DEL", key)
+	return err
+}
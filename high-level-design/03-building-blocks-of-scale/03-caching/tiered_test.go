@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// memL2 is an in-process L2. If gate is set, Get reads the value and then
+// waits for gate before returning it, to hold a load in flight.
+type memL2 struct {
+	mu     sync.Mutex
+	values map[string]string
+	gets   int
+	gate   chan struct{}
+	inGet  chan struct{} // Signalled when a gated Get has read its value
+}
+
+func newMemL2() *memL2 {
+	return &memL2{values: make(map[string]string)}
+}
+
+func (m *memL2) Get(key string) (string, bool, error) {
+	m.mu.Lock()
+	v, ok := m.values[key]
+	m.gets++
+	gate, inGet := m.gate, m.inGet
+	m.mu.Unlock()
+	if gate != nil {
+		inGet <- struct{}{}
+		<-gate
+	}
+	return v, ok, nil
+}
+
+func (m *memL2) Set(key string, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *memL2) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func newTestTier(t *testing.T, id string, l2 L2[string, string], bus *EventBus) *TieredCache[string, string] {
+	t.Helper()
+	l1 := NewCache(CacheConfig[string, string]{DefaultTTL: time.Minute})
+	t.Cleanup(func() { l1.Close() })
+	return NewTieredCache(id, l1, l2, time.Hour, bus)
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTieredCacheInvalidatesOtherInstances(t *testing.T) {
+	l2 := newMemL2()
+	bus := NewEventBus()
+	a := newTestTier(t, "A", l2, bus)
+	b := newTestTier(t, "B", l2, bus)
+	loads := 0
+	load := func(string) (string, error) {
+		loads++
+		return "v1", nil
+	}
+
+	// A loads from the source, B finds the value in L2.
+	for _, tier := range []*TieredCache[string, string]{a, b} {
+		if v, err := tier.GetOrLoad("k", load); err != nil || v != "v1" {
+			t.Fatalf("%s: GetOrLoad = %q, %v", tier.id, v, err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("%d loads, want 1: B should have read L2", loads)
+	}
+
+	// A writes: its own L1 is updated in place, B's copy is dropped.
+	if err := a.Set("k", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "B's L1 copy to be dropped", func() bool {
+		_, ok := b.l1.Get("k")
+		return !ok
+	})
+	if _, ok := a.l1.Get("k"); !ok {
+		t.Fatal("A dropped its own L1 copy on its own invalidation")
+	}
+	if v, _ := b.GetOrLoad("k", load); v != "v2" {
+		t.Fatalf("B read %q after A's write, want v2", v)
+	}
+
+	// A delete is invalidated the same way.
+	if err := a.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "B's L1 copy to be deleted", func() bool {
+		_, ok := b.l1.Get("k")
+		return !ok
+	})
+	if v, _ := b.GetOrLoad("k", load); v != "v1" || loads != 2 {
+		t.Fatalf("B read %q after the delete with %d loads, want a reload of v1", v, loads)
+	}
+}
+
+func TestTieredCacheInvalidationDuringLoad(t *testing.T) {
+	l2 := newMemL2()
+	l2.Set("k", "old", 0)
+	bus := NewEventBus()
+	a := newTestTier(t, "A", newMemL2(), bus) // Only used to publish
+	b := newTestTier(t, "B", l2, bus)
+
+	// B misses L1 and reads "old" from L2, then stalls before filling L1.
+	l2.gate, l2.inGet = make(chan struct{}), make(chan struct{})
+	done := make(chan string)
+	go func() {
+		v, _ := b.GetOrLoad("k", nil)
+		done <- v
+	}()
+	<-l2.inGet
+
+	// Meanwhile another instance writes the key and B hears about it.
+	l2.Set("k", "new", 0)
+	a.publish("k")
+	waitFor(t, "B to receive the invalidation", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.fills["k"] > 0
+	})
+
+	// The stalled load finishes with the value it read before the write.
+	l2.mu.Lock()
+	gate := l2.gate
+	l2.gate = nil
+	l2.mu.Unlock()
+	close(gate)
+	if v := <-done; v != "old" {
+		t.Fatalf("in-flight load returned %q, want the old value it read", v)
+	}
+	if v, ok := b.l1.Get("k"); ok {
+		t.Fatalf("B cached %q in L1 after the invalidation", v)
+	}
+	if v, _ := b.GetOrLoad("k", nil); v != "new" {
+		t.Fatalf("B read %q after the invalidated load, want new", v)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.fills) != 0 {
+		t.Errorf("fills still tracks %d keys after the loads finished", len(b.fills))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WriteStrategy decides how UpdateProfile keeps the cache and the database
+// in step.
+type WriteStrategy int
+
+const (
+	// WriteThrough writes the database, then the cache. Reads right after a
+	// write are fast and fresh, but every write pays the database latency.
+	WriteThrough WriteStrategy = iota
+	// WriteAround writes the database and drops the cached copy. Data that is
+	// written but never read does not pollute the cache, but the first read
+	// after a write is a miss.
+	WriteAround
+	// WriteBehind writes the cache and queues the database write, which is
+	// flushed in batches in the background. Writes are fast, but the database
+	// lags behind and queued writes are lost if the process crashes. If the
+	// entry is evicted before the flush, a read reloads the old DB value.
+	WriteBehind
+)
+
+func (s WriteStrategy) String() string {
+	switch s {
+	case WriteThrough:
+		return "write-through"
+	case WriteAround:
+		return "write-around"
+	case WriteBehind:
+		return "write-behind"
+	}
+	return fmt.Sprintf("WriteStrategy(%d)", int(s))
+}
+
+// UpdateProfile saves a user according to the application's write strategy.
+func (app *Application) UpdateProfile(user User) error {
+	switch app.strategy {
+	case WriteThrough:
+		// 1. Persist first, so the cache never holds data the DB refused.
+		if err := app.db.PutUsers([]User{user}); err != nil {
+			return err
+		}
+		// 2. Refresh the cache.
+		app.cache.Set(user.ID, user)
+	case WriteAround:
+		if err := app.db.PutUsers([]User{user}); err != nil {
+			return err
+		}
+		// The next read reloads the user from the DB.
+		app.cache.Delete(user.ID)
+	case WriteBehind:
+		// Queue first: once the application is closed, nothing is written.
+		if err := app.writeBehind.Enqueue(user.ID, user); err != nil {
+			return err
+		}
+		app.cache.Set(user.ID, user)
+	}
+	return nil
+}
+
+// WriteBehindConfig controls when queued writes are flushed.
+type WriteBehindConfig struct {
+	BatchSize     int           // Flush as soon as this many keys are pending; 0 flushes every write
+	FlushInterval time.Duration // Flush whatever is pending at least this often; defaults to 1s
+}
+
+const defaultFlushInterval = time.Second
+
+// ErrQueueClosed is returned by Enqueue once the queue has been closed.
+var ErrQueueClosed = errors.New("write-behind queue closed")
+
+// WriteBehindQueue buffers writes and hands them to flush in batches, from a
+// background goroutine. Several writes to the same key before a flush are
+// coalesced into one: only the latest value is written.
+type WriteBehindQueue[K comparable, V any] struct {
+	config WriteBehindConfig
+	flush  func(batch map[K]V) error
+
+	mu      sync.Mutex
+	pending map[K]V
+	closed  bool
+
+	kick chan struct{} // Signals that a full batch is waiting
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewWriteBehindQueue[K comparable, V any](config WriteBehindConfig, flush func(batch map[K]V) error) *WriteBehindQueue[K, V] {
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultFlushInterval
+	}
+	w := &WriteBehindQueue[K, V]{
+		config:  config,
+		flush:   flush,
+		pending: make(map[K]V),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Enqueue schedules a write. It never waits for the backing store. After
+// Close, it returns ErrQueueClosed: nothing would flush the write.
+func (w *WriteBehindQueue[K, V]) Enqueue(key K, value V) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrQueueClosed
+	}
+	w.pending[key] = value
+	full := len(w.pending) >= w.config.BatchSize
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default: // A flush is already scheduled
+		}
+	}
+	return nil
+}
+
+// Close stops the background flusher and writes out everything still
+// queued, so a clean shutdown loses no writes. Calling it again does
+// nothing.
+func (w *WriteBehindQueue[K, V]) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	<-w.done
+	return w.flushPending()
+}
+
+func (w *WriteBehindQueue[K, V]) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		}
+		if err := w.flushPending(); err != nil {
+			fmt.Printf("Write-behind: flush failed, will retry: %v\n", err)
+		}
+	}
+}
+
+// flushPending writes the current batch. On failure the batch is put back,
+// except for keys that were written again in the meantime.
+func (w *WriteBehindQueue[K, V]) flushPending() error {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = make(map[K]V)
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	err := w.flush(batch)
+	if err != nil {
+		w.mu.Lock()
+		for k, v := range batch {
+			if _, newer := w.pending[k]; !newer {
+				w.pending[k] = v
+			}
+		}
+		w.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a database without the simulated latency.
+func newTestDatabase() *Database {
+	db := NewDatabase()
+	db.ReadLatency, db.WriteLatency = 0, 0
+	return db
+}
+
+func TestUpdateProfile(t *testing.T) {
+	updated := User{ID: "1", Name: "Alice", Email: "alice@new.example.com"}
+	for _, tc := range []struct {
+		strategy  WriteStrategy
+		cached    bool // Whether the cache holds the new value right after
+		dbUpdated bool // Whether the DB does, before the application is closed
+	}{
+		{WriteThrough, true, true},
+		{WriteAround, false, true},
+		{WriteBehind, true, false},
+	} {
+		t.Run(tc.strategy.String(), func(t *testing.T) {
+			db := newTestDatabase()
+			app := NewApplication(db, tc.strategy)
+			app.GetProfile("1") // Cache the old value
+
+			if err := app.UpdateProfile(updated); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := app.cache.Get("1")
+			if tc.cached && got != updated {
+				t.Errorf("cache holds %+v, want %+v", got, updated)
+			}
+			if !tc.cached && ok {
+				t.Errorf("cache still holds %+v, want it dropped", got)
+			}
+			if got, _ := db.peek("1"); (got == updated) != tc.dbUpdated {
+				t.Errorf("DB holds %+v, updated: want %v", got, tc.dbUpdated)
+			}
+
+			// Whatever the strategy, the DB is up to date once the
+			// application is closed, and reads return the new value.
+			if got := app.GetProfile("1"); got != updated {
+				t.Errorf("GetProfile returned %+v, want %+v", got, updated)
+			}
+			if err := app.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := db.peek("1"); got != updated {
+				t.Errorf("after Close, DB holds %+v, want %+v", got, updated)
+			}
+		})
+	}
+}
+
+func TestUpdateProfileAfterClose(t *testing.T) {
+	app := NewApplication(newTestDatabase(), WriteBehind)
+	app.Close()
+	if err := app.UpdateProfile(User{ID: "3"}); !errors.Is(err, ErrQueueClosed) {
+		t.Fatalf("got %v, want ErrQueueClosed", err)
+	}
+	if _, ok := app.cache.Get("3"); ok {
+		t.Error("a rejected write reached the cache")
+	}
+}
+
+// recordingFlush collects the batches a WriteBehindQueue flushes.
+type recordingFlush struct {
+	mu      sync.Mutex
+	batches []map[string]int
+}
+
+func (r *recordingFlush) flush(batch map[string]int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, batch)
+	return nil
+}
+
+func (r *recordingFlush) written() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make(map[string]int)
+	for _, b := range r.batches {
+		for k, v := range b {
+			all[k] = v
+		}
+	}
+	return all
+}
+
+func TestWriteBehindQueueCloseFlushes(t *testing.T) {
+	var rec recordingFlush
+	q := NewWriteBehindQueue(WriteBehindConfig{BatchSize: 100, FlushInterval: time.Hour}, rec.flush)
+	q.Enqueue("a", 1)
+	q.Enqueue("b", 2)
+	q.Enqueue("a", 3) // Coalesced with the first write
+
+	if len(rec.written()) != 0 {
+		t.Fatal("flushed before the batch was full or the interval passed")
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.written(); len(got) != 2 || got["a"] != 3 || got["b"] != 2 {
+		t.Errorf("Close flushed %v, want map[a:3 b:2]", got)
+	}
+	if err := q.Enqueue("c", 4); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Enqueue after Close: got %v, want ErrQueueClosed", err)
+	}
+	if err := q.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestWriteBehindQueueBatchSize(t *testing.T) {
+	var rec recordingFlush
+	q := NewWriteBehindQueue(WriteBehindConfig{BatchSize: 2, FlushInterval: time.Hour}, rec.flush)
+	defer q.Close()
+	q.Enqueue("a", 1)
+	q.Enqueue("b", 2)
+
+	deadline := time.Now().Add(time.Second)
+	for len(rec.written()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := rec.written(); len(got) != 2 {
+		t.Errorf("a full batch was not flushed: %v", got)
+	}
+}
+
+func TestWriteBehindQueueDefaultInterval(t *testing.T) {
+	// A zero FlushInterval must not make time.NewTicker panic.
+	var rec recordingFlush
+	q := NewWriteBehindQueue(WriteBehindConfig{BatchSize: 10}, rec.flush)
+	q.Enqueue("a", 1)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.written(); got["a"] != 1 {
+		t.Errorf("Close flushed %v", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the parsed directives of a Cache-Control header.
+// Directive names are lower-cased; valueless directives map to "".
+type CacheControl map[string]string
+
+func parseCacheControl(h http.Header) CacheControl {
+	cc := CacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// Seconds returns a directive's value as a duration, if it is a valid
+// number of seconds.
+func (cc CacheControl) Seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime returns how long a response may be served from a
+// shared cache without revalidation (RFC 9111, section 4.2.1):
+// s-maxage, then max-age, then Expires minus Date. no-cache means the
+// response may be stored but must be revalidated before every use.
+func freshnessLifetime(h http.Header, now time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if cc.Has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.Seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.Seconds("max-age"); ok {
+		return d
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0 // An invalid Expires means "already expired"
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if lifetime := expires.Sub(date); lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
+
+// cacheableStatus lists the status codes a cache may store when the
+// response carries explicit freshness or validators.
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusNotFound: true,
+	http.StatusMethodNotAllowed: true, http.StatusGone: true, http.StatusRequestURITooLong: true,
+	http.StatusNotImplemented: true,
+}
+
+// storable reports whether a shared cache may keep the response to req,
+// and why not when it may not.
+func storable(req *http.Request, resp *http.Response) (bool, string) {
+	reqCC, respCC := parseCacheControl(req.Header), parseCacheControl(resp.Header)
+	switch {
+	case req.Method != http.MethodGet:
+		return false, "method " + req.Method
+	case !cacheableStatus[resp.StatusCode]:
+		return false, "status " + strconv.Itoa(resp.StatusCode)
+	case reqCC.Has("no-store") || respCC.Has("no-store"):
+		return false, "no-store"
+	case respCC.Has("private"):
+		return false, "private"
+	case req.Header.Get("Authorization") != "" && !respCC.Has("public") && !respCC.Has("s-maxage"):
+		return false, "authorized request"
+	case strings.TrimSpace(resp.Header.Get("Vary")) == "*":
+		return false, "Vary: *"
+	}
+	hasValidator := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	if freshnessLifetime(resp.Header, time.Now()) == 0 && !hasValidator {
+		return false, "no freshness and no validator"
+	}
+	return true, ""
+}
+
+// collapsible reports whether the origin fetch for r may be shared with
+// other requests for the same object. Requests with credentials may get a
+// response tailored to their user, so they always fetch their own.
+func collapsible(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == ""
+}
+
+// varyHeaders returns the request headers named by a response's Vary.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
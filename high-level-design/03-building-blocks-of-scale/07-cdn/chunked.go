@@ -0,0 +1,613 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/glob"
+)
+
+// defaultChunkSize is used when ChunkedPaths is set without a ChunkSize.
+const defaultChunkSize = 1 << 20
+
+// largeObject is a big file (video, a download) cached as fixed-size
+// chunks. Each chunk is fetched from the origin with a range request the
+// first time a client asks for bytes in it, so a viewer who watches the
+// first minute of a film never pulls the rest of it through the edge.
+// Chunked objects are assumed not to Vary.
+type largeObject struct {
+	size   int64
+	header http.Header // Origin headers, without Content-Range and Content-Length
+
+	mu       sync.Mutex
+	storedAt time.Time
+	lifetime time.Duration
+
+	chunks map[int64]*blob // Guarded by the edge's mu, as storage moves them
+}
+
+func (o *largeObject) fresh(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return now.Sub(o.storedAt) < o.lifetime
+}
+
+func (o *largeObject) age(now time.Time) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return now.Sub(o.storedAt)
+}
+
+// revalidated marks the object fresh again after a 304 from the origin.
+func (o *largeObject) revalidated(notModified *http.Response, now time.Time) {
+	header := o.header.Clone()
+	for name, values := range notModified.Header {
+		header[name] = values
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.storedAt = now
+	o.lifetime = freshnessLifetime(header, now)
+}
+
+// strongValidator returns the strong validator of a response: its ETag
+// unless weak ("W/"), else its Last-Modified date if that is strong, else
+// "". Only a strong validator proves that two ranges come from the same
+// version of a file.
+func strongValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	if _, ok := strongLastModified(h); ok {
+		return h.Get("Last-Modified")
+	}
+	return ""
+}
+
+// strongLastModified returns a response's Last-Modified date if it is a
+// strong validator: at least a second older than the response's Date, so
+// no second change could have happened within it (RFC 9110, 8.8.2.2).
+func strongLastModified(h http.Header) (time.Time, bool) {
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil || date.Sub(modified) < time.Second {
+		return time.Time{}, false
+	}
+	return modified, true
+}
+
+// ifRangeMatches reports whether an If-Range value names the cached
+// version: its strong ETag, or the date of its strong Last-Modified.
+func (o *largeObject) ifRangeMatches(ifRange string) bool {
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == o.header.Get("ETag")
+	}
+	t, err := http.ParseTime(ifRange)
+	modified, ok := strongLastModified(o.header)
+	return err == nil && ok && t.Equal(modified)
+}
+
+// byteRange is an inclusive range of bytes, as written in a Range header.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+var (
+	errMalformedRange     = errors.New("malformed Range header")
+	errUnsatisfiableRange = errors.New("no satisfiable range")
+)
+
+// parseRanges parses a Range header such as "bytes=0-499,1000-" against
+// an object of size bytes. Ranges past the end are dropped or clipped;
+// suffix ranges ("-500") count back from the end.
+func parseRanges(spec string, size int64) ([]byteRange, error) {
+	unit, list, ok := strings.Cut(spec, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, errMalformedRange
+	}
+	var ranges []byteRange
+	for _, part := range strings.Split(list, ",") {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, errMalformedRange
+		}
+		if first == "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errMalformedRange
+			}
+			if n > 0 && size > 0 {
+				ranges = append(ranges, byteRange{max(size-n, 0), size - 1})
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errMalformedRange
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil, errMalformedRange
+			}
+			end = min(end, size-1)
+		}
+		if start < size {
+			ranges = append(ranges, byteRange{start, end})
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// chunkResult is the outcome of one range request to the origin. When the
+// origin did not answer with something cacheable, status, header and body
+// hold its response so it can be passed on to the client.
+type chunkResult struct {
+	obj    *largeObject
+	data   []byte
+	status int
+	header http.Header
+	body   []byte
+	err    error
+
+	// shareable is set when the result may be used by clients other than
+	// the one whose request fetched it, as for fillResult.
+	shareable bool
+}
+
+// isChunked reports whether path is cached in chunks (see ChunkedPaths).
+func (s *EdgeServer) isChunked(path string) bool {
+	for _, pattern := range s.config.ChunkedPaths {
+		if glob.Match(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *EdgeServer) chunkSize() int64 {
+	if s.config.ChunkSize > 0 {
+		return s.config.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// serveChunked answers a request for a large object from its chunks,
+// fetching the missing ones from the origin as it goes. It serves the
+// whole object (200), a single range (206), several ranges (206
+// multipart/byteranges) or 416 when no requested range exists.
+func (s *EdgeServer) serveChunked(w http.ResponseWriter, r *http.Request, key string) {
+	// 1. Find the object, learning its size from the origin if needed
+	obj, probed, res := s.largeObject(r, key)
+	if obj == nil {
+		if res.err != nil {
+			s.log(r, "MISS", "origin error: "+res.err.Error())
+			http.Error(w, "origin unreachable", http.StatusBadGateway)
+			return
+		}
+		for name, values := range res.header {
+			w.Header()[name] = slices.Clone(values) // Shared with collapsed requests
+		}
+		removeHopByHop(w.Header())
+		w.Header().Set("X-Cache", "MISS")
+		s.log(r, "MISS", "status "+strconv.Itoa(res.status))
+		w.WriteHeader(res.status)
+		if r.Method != http.MethodHead {
+			w.Write(res.body)
+		}
+		return
+	}
+
+	h := w.Header()
+	for name, values := range obj.header {
+		h[name] = slices.Clone(values) // Shared with concurrent requests
+	}
+	removeHopByHop(h)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Age", strconv.Itoa(int(obj.age(time.Now())/time.Second)))
+	h.Add("Via", "1.1 "+s.name)
+	etag := obj.header.Get("ETag")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
+		h.Set("X-Cache", "HIT")
+		s.log(r, "HIT", "not modified")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// 2. Work out which bytes the client wants. If-Range asks for the
+	// ranges only if the client's partial copy is still current.
+	spec := r.Header.Get("Range")
+	if ir := r.Header.Get("If-Range"); ir != "" && !obj.ifRangeMatches(ir) {
+		spec = ""
+	}
+	whole := []byteRange{{0, obj.size - 1}}
+	ranges := whole
+	if spec != "" {
+		parsed, err := parseRanges(spec, obj.size)
+		switch {
+		case errors.Is(err, errUnsatisfiableRange):
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", obj.size))
+			h.Set("X-Cache", "HIT")
+			s.log(r, "HIT", "range not satisfiable")
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		case err == nil:
+			ranges = parsed
+		}
+		// Overlapping ranges that add up to more than the object would
+		// amplify a tiny request into a huge response: send it whole.
+		var total int64
+		for _, br := range ranges {
+			total += br.length()
+		}
+		if total > obj.size {
+			ranges = whole
+		}
+	}
+
+	// 3. Label the response by how many of the chunks it needs were cached
+	needed, missing := s.chunkCount(obj, ranges)
+	if probed && ranges[0].start < s.chunkSize() {
+		missing++ // The first chunk was fetched to learn the size
+	}
+	label := "HIT"
+	switch {
+	case missing == needed:
+		label = "MISS"
+	case missing > 0:
+		label = "PARTIAL"
+	}
+	h.Set("X-Cache", label)
+	s.log(r, label, fmt.Sprintf("%d of %d chunks fetched", missing, needed))
+
+	// 4. Stream the bytes, fetching chunks as they are reached
+	h.Del("Content-Length")
+	if len(ranges) > 1 {
+		mw := multipart.NewWriter(w)
+		h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		if r.Method == http.MethodHead {
+			return
+		}
+		for _, br := range ranges {
+			part, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {obj.header.Get("Content-Type")},
+				"Content-Range": {br.contentRange(obj.size)},
+			})
+			s.copyRange(part, r, key, obj, br)
+		}
+		mw.Close()
+		return
+	}
+
+	br := ranges[0]
+	h.Set("Content-Length", strconv.FormatInt(br.length(), 10))
+	if spec != "" && br != whole[0] {
+		h.Set("Content-Range", br.contentRange(obj.size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method != http.MethodHead {
+		s.copyRange(w, r, key, obj, br)
+	}
+}
+
+// chunkCount returns how many chunks the ranges touch and how many of
+// those are not cached yet.
+func (s *EdgeServer) chunkCount(obj *largeObject, ranges []byteRange) (needed, missing int) {
+	seen := make(map[int64]bool)
+	for _, br := range ranges {
+		if br.length() <= 0 {
+			continue // An empty object
+		}
+		for i := br.start / s.chunkSize(); i <= br.end/s.chunkSize(); i++ {
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			needed++
+			s.mu.Lock()
+			_, ok := obj.chunks[i]
+			s.mu.Unlock()
+			if !ok {
+				missing++
+			}
+		}
+	}
+	return needed, missing
+}
+
+// copyRange writes the bytes of br to w chunk by chunk. The status line
+// has already gone out, so if a chunk cannot be fetched the connection is
+// aborted: the client sees a truncated response rather than a wrong one.
+func (s *EdgeServer) copyRange(w io.Writer, r *http.Request, key string, obj *largeObject, br byteRange) {
+	size := s.chunkSize()
+	if br.length() <= 0 {
+		return
+	}
+	for i := br.start / size; i <= br.end/size; i++ {
+		data, err := s.chunk(r, key, obj, i)
+		if err != nil {
+			s.log(r, "ABORTED", err.Error())
+			panic(http.ErrAbortHandler)
+		}
+		from := max(br.start-i*size, 0)
+		to := min(br.end+1-i*size, int64(len(data)))
+		if _, err := w.Write(data[from:to]); err != nil {
+			return // The client went away
+		}
+	}
+}
+
+// largeObject returns the cached object for key, fetching its first chunk
+// from the origin when it is not cached, or revalidating it when stale.
+// probed reports whether the first chunk was fetched for this request.
+// A nil object means the origin's answer was not a usable object.
+func (s *EdgeServer) largeObject(r *http.Request, key string) (obj *largeObject, probed bool, res chunkResult) {
+	s.mu.Lock()
+	obj = s.large[key]
+	s.mu.Unlock()
+	if obj != nil && obj.fresh(time.Now()) {
+		return obj, false, chunkResult{}
+	}
+
+	if collapsible(r) {
+		var shared bool
+		res, shared = s.chunks.Do(key+"#probe", func() chunkResult {
+			return s.probe(r, key, obj)
+		})
+		if shared && !res.shareable {
+			// The probe's response was for its client only: fetch our own.
+			res = s.probe(r, key, obj)
+		}
+	} else {
+		res = s.probe(r, key, obj)
+	}
+	switch {
+	case res.obj != nil:
+		return res.obj, res.obj != obj, res
+	case obj != nil && (res.err != nil || res.status >= 500):
+		// Keep serving what is cached while the origin is in trouble.
+		return obj, false, res
+	}
+	return nil, false, res
+}
+
+// probe fetches the first chunk of key, which tells the edge the object's
+// size and caching policy. A stale object is revalidated with its
+// validator instead, keeping its chunks if the origin answers 304.
+//
+// Objects without a strong validator are fetched whole and not cached:
+// nothing would tell a chunk fetched later from another version's.
+func (s *EdgeServer) probe(r *http.Request, key string, stale *largeObject) chunkResult {
+	s.mu.Lock()
+	gen := s.generation
+	s.mu.Unlock()
+
+	req := s.originRequest(r)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", s.chunkSize()-1))
+	if stale != nil {
+		if etag := stale.header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		} else if lm := stale.header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	time.Sleep(s.config.UpstreamLatency)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return chunkResult{err: err, shareable: true}
+	}
+	defer resp.Body.Close()
+	now := time.Now()
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		stale.revalidated(resp, now)
+		return chunkResult{obj: stale, shareable: true}
+	}
+	validator := strongValidator(resp.Header)
+	if resp.StatusCode == http.StatusPartialContent && validator == "" {
+		// Take the whole file in one response instead of the first chunk.
+		resp.Body.Close()
+		time.Sleep(s.config.UpstreamLatency)
+		resp, err = s.client.Do(s.originRequest(r))
+		if err != nil {
+			return chunkResult{err: err, shareable: true}
+		}
+		defer resp.Body.Close()
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return chunkResult{err: err, shareable: true}
+	}
+
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-1048575/73400320
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		if size, err = strconv.ParseInt(total, 10, 64); err != nil {
+			return chunkResult{err: fmt.Errorf("bad Content-Range %q", resp.Header.Get("Content-Range")), shareable: true}
+		}
+	case http.StatusOK:
+		// The origin ignored the range and sent the whole object.
+		size = int64(len(body))
+	default:
+		ok, _ := storable(req, resp)
+		return chunkResult{status: resp.StatusCode, header: resp.Header, body: body, shareable: ok}
+	}
+
+	obj := &largeObject{
+		size:     size,
+		header:   resp.Header.Clone(),
+		storedAt: now,
+		lifetime: freshnessLifetime(resp.Header, now),
+		chunks:   make(map[int64]*blob),
+	}
+	obj.header.Del("Content-Range")
+	obj.header.Del("Content-Length")
+	for i := int64(0); i*s.chunkSize() < int64(len(body)); i++ {
+		obj.chunks[i] = newBlob(key, body[i*s.chunkSize():min((i+1)*s.chunkSize(), int64(len(body)))])
+	}
+
+	// The cacheability rules are those of the full response.
+	whole := *resp
+	whole.StatusCode = http.StatusOK
+	if ok, why := storable(req, &whole); !ok {
+		s.log(r, "PASS", "not stored: "+why)
+		return chunkResult{obj: obj}
+	}
+	if validator == "" {
+		// Complete, so it can still serve the requests collapsed onto it.
+		s.log(r, "PASS", "not stored: no strong validator")
+		return chunkResult{obj: obj, shareable: true}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.generation {
+		return chunkResult{obj: obj, shareable: true}
+	}
+	if old := s.large[key]; old != nil {
+		s.removeLargeLocked(key, old)
+	}
+	s.large[key] = obj
+	s.reindex(key)
+	for i, b := range obj.chunks {
+		s.storeChunkLocked(key, obj, i, b)
+	}
+	return chunkResult{obj: obj, shareable: true}
+}
+
+// removeLargeLocked drops a large object and its chunks. Caller holds s.mu.
+func (s *EdgeServer) removeLargeLocked(key string, obj *largeObject) {
+	for _, b := range obj.chunks {
+		s.freeLocked(b)
+	}
+	clear(obj.chunks)
+	if s.large[key] == obj {
+		delete(s.large, key)
+		s.reindex(key)
+	}
+}
+
+// storeChunkLocked keeps chunk i of obj. Chunks of objects that are not
+// (or no longer) cached are only held for the request that fetched them.
+// Caller holds s.mu.
+func (s *EdgeServer) storeChunkLocked(key string, obj *largeObject, i int64, b *blob) {
+	if s.large[key] != obj {
+		obj.chunks[i] = b
+		return
+	}
+	if !s.admitLocked(b) {
+		delete(obj.chunks, i)
+		return
+	}
+	b.dropped = func() { delete(obj.chunks, i) }
+	obj.chunks[i] = b
+}
+
+// readChunk returns chunk i of obj if it is cached.
+func (s *EdgeServer) readChunk(obj *largeObject, i int64) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := obj.chunks[i]
+	if !ok {
+		return nil, false
+	}
+	data, _, ok := s.readLocked(b)
+	return data, ok
+}
+
+// chunk returns chunk i of obj, fetching it from the origin if needed.
+// Concurrent requests for the same missing chunk of a cached object share
+// one fetch; chunks of objects that are not cached are this request's own.
+func (s *EdgeServer) chunk(r *http.Request, key string, obj *largeObject, i int64) ([]byte, error) {
+	if data, ok := s.readChunk(obj, i); ok {
+		return data, nil
+	}
+	s.mu.Lock()
+	cached := s.large[key] == obj
+	s.mu.Unlock()
+	if !cached || !collapsible(r) {
+		res := s.fetchChunk(r, key, obj, i)
+		return res.data, res.err
+	}
+	res, _ := s.chunks.Do(key+"#"+strconv.FormatInt(i, 10), func() chunkResult {
+		if data, ok := s.readChunk(obj, i); ok {
+			return chunkResult{data: data} // Fetched while we were checking
+		}
+		return s.fetchChunk(r, key, obj, i)
+	})
+	return res.data, res.err
+}
+
+// fetchChunk fetches chunk i with a range request. If-Range, with the
+// object's strong validator, makes the origin send the whole file instead
+// if it has changed since the first chunk was cached, in which case the
+// chunks cannot be stitched together and the object is dropped.
+func (s *EdgeServer) fetchChunk(r *http.Request, key string, obj *largeObject, i int64) chunkResult {
+	br := byteRange{i * s.chunkSize(), min((i+1)*s.chunkSize(), obj.size) - 1}
+	validator := strongValidator(obj.header)
+	if validator == "" {
+		// probe fetches such objects whole; never stitch without one.
+		return chunkResult{err: fmt.Errorf("chunk %d: object has no strong validator", i)}
+	}
+
+	req := s.originRequest(r)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", br.start, br.end))
+	req.Header.Set("If-Range", validator)
+
+	time.Sleep(s.config.UpstreamLatency)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return chunkResult{err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return chunkResult{err: fmt.Errorf("chunk %d: origin answered %d", i, resp.StatusCode)}
+	}
+	if resp.StatusCode != http.StatusPartialContent || strongValidator(resp.Header) != validator {
+		s.mu.Lock()
+		s.removeLargeLocked(key, obj)
+		s.mu.Unlock()
+		return chunkResult{err: fmt.Errorf("chunk %d: origin answered %d, object changed", i, resp.StatusCode)}
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return chunkResult{err: err}
+	}
+	if int64(len(data)) != br.length() {
+		return chunkResult{err: fmt.Errorf("chunk %d: got %d bytes, want %d", i, len(data), br.length())}
+	}
+	s.mu.Lock()
+	s.storeChunkLocked(key, obj, i, newBlob(key, data))
+	s.mu.Unlock()
+	return chunkResult{data: data}
+}
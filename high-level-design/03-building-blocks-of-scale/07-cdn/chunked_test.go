@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRanges(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		size int64
+		want []byteRange
+		err  error
+	}{
+		{"bytes=0-499", 1000, []byteRange{{0, 499}}, nil},
+		{"bytes=500-", 1000, []byteRange{{500, 999}}, nil},
+		{"bytes=-200", 1000, []byteRange{{800, 999}}, nil},
+		{"bytes=-2000", 1000, []byteRange{{0, 999}}, nil},      // Suffix longer than the object
+		{"bytes=900-1999", 1000, []byteRange{{900, 999}}, nil}, // Clipped at the end
+		{"bytes=0-0,-1", 1000, []byteRange{{0, 0}, {999, 999}}, nil},
+		{"bytes= 0-9 , 20-29", 1000, []byteRange{{0, 9}, {20, 29}}, nil},
+		{"bytes=0-9,2000-2999", 1000, []byteRange{{0, 9}}, nil}, // Unsatisfiable parts dropped
+		{"bytes=1000-", 1000, nil, errUnsatisfiableRange},
+		{"bytes=-0", 1000, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=-5", 0, nil, errUnsatisfiableRange},
+		{"bytes=5-1", 1000, nil, errMalformedRange},
+		{"bytes=a-b", 1000, nil, errMalformedRange},
+		{"bytes=-", 1000, nil, errMalformedRange},
+		{"bytes=10", 1000, nil, errMalformedRange},
+		{"bytes=-1-5", 1000, nil, errMalformedRange},
+		{"items=0-9", 1000, nil, errMalformedRange},
+		{"0-9", 1000, nil, errMalformedRange},
+	} {
+		got, err := parseRanges(tc.spec, tc.size)
+		if !errors.Is(err, tc.err) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseRanges(%q, %d) = %v, %v; want %v, %v", tc.spec, tc.size, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+// versionedFile is an origin serving one large file, whose content and
+// validators the test can change. It records the If-Range of every range
+// request it receives.
+type versionedFile struct {
+	mu       sync.Mutex
+	body     []byte
+	etag     string    // Sent as is; "" sends no ETag
+	modTime  time.Time // Zero sends no Last-Modified
+	ifRanges []string
+}
+
+func (f *versionedFile) set(body []byte, etag string, modTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.body, f.etag, f.modTime = body, etag, modTime
+}
+
+func (f *versionedFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	body, etag, modTime := f.body, f.etag, f.modTime
+	if r.Header.Get("Range") != "" {
+		f.ifRanges = append(f.ifRanges, r.Header.Get("If-Range"))
+	}
+	f.mu.Unlock()
+	w.Header().Set("Cache-Control", "max-age=3600")
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// fileOf returns n bytes where byte i is i % 251, shifted by version so
+// that two versions differ everywhere.
+func fileOf(n int, version byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i%251) + version
+	}
+	return b
+}
+
+// newChunkedCDN caches /big/* in 100-byte chunks.
+func newChunkedCDN(t *testing.T, origin http.Handler) *testCDN {
+	return newTestCDN(t, EdgeConfig{ChunkedPaths: []string{"/big/*"}, ChunkSize: 100}, origin)
+}
+
+func TestChunkedRangesFromPartialObject(t *testing.T) {
+	body := fileOf(1000, 0)
+	modTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	origin := &versionedFile{body: body, etag: `"v1"`, modTime: modTime}
+	cdn := newChunkedCDN(t, origin)
+
+	// Cache the first two chunks only.
+	resp, got := cdn.get(t, "/big/file", "Range: bytes=0-199")
+	if resp.StatusCode != http.StatusPartialContent || got != string(body[:200]) {
+		t.Fatalf("first range: status %d, %d bytes", resp.StatusCode, len(got))
+	}
+
+	// A single range, half cached.
+	resp, got = cdn.get(t, "/big/file", "Range: bytes=150-249")
+	if resp.StatusCode != http.StatusPartialContent || got != string(body[150:250]) {
+		t.Fatalf("single range: status %d, body mismatch", resp.StatusCode)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 150-249/1000" {
+		t.Errorf("Content-Range = %q", cr)
+	}
+	if label := resp.Header.Get("X-Cache"); label != "PARTIAL" {
+		t.Errorf("X-Cache = %q, want PARTIAL", label)
+	}
+
+	// Several ranges: multipart/byteranges, one part per range.
+	resp, got = cdn.get(t, "/big/file", "Range: bytes=0-9,500-509,-5")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("multiple ranges: status %d", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader([]byte(got)), params["boundary"])
+	for _, want := range []struct {
+		contentRange string
+		body         []byte
+	}{
+		{"bytes 0-9/1000", body[0:10]},
+		{"bytes 500-509/1000", body[500:510]},
+		{"bytes 995-999/1000", body[995:]},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %s: %v", want.contentRange, err)
+		}
+		data, _ := io.ReadAll(part)
+		if cr := part.Header.Get("Content-Range"); cr != want.contentRange || !bytes.Equal(data, want.body) {
+			t.Errorf("part Content-Range %q with %d bytes, want %q", cr, len(data), want.contentRange)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("extra part after the last range: %v", err)
+	}
+
+	// Nothing satisfiable.
+	resp, _ = cdn.get(t, "/big/file", "Range: bytes=1000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */1000" {
+		t.Errorf("unsatisfiable range: status %d, Content-Range %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+
+	// If-Range: the range if the client's copy is current, else the whole file.
+	for _, tc := range []struct {
+		ifRange string
+		status  int
+	}{
+		{`"v1"`, http.StatusPartialContent},
+		{modTime.Format(http.TimeFormat), http.StatusPartialContent},
+		{`"v0"`, http.StatusOK},
+		{`W/"v1"`, http.StatusOK}, // Weak validators never match If-Range
+		{modTime.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+	} {
+		resp, got = cdn.get(t, "/big/file", "Range: bytes=0-9", "If-Range: "+tc.ifRange)
+		if resp.StatusCode != tc.status {
+			t.Errorf("If-Range %s: status %d, want %d", tc.ifRange, resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusOK && got != string(body) {
+			t.Errorf("If-Range %s: got %d bytes, want the whole file", tc.ifRange, len(got))
+		}
+	}
+	if hits := cdn.originHits.Load(); hits != 10 {
+		t.Errorf("origin got %d requests, want one per chunk (10)", hits)
+	}
+}
+
+func TestChunkedObjectChangedAtOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		etag    string
+		ifRange string // Expected If-Range on chunk fetches
+	}{
+		{"strong ETag", `"v1"`, `"v1"`},
+		{"strong Last-Modified", "", "Last-Modified"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			modTime := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+			origin := &versionedFile{body: fileOf(1000, 0), etag: tc.etag, modTime: modTime}
+			cdn := newChunkedCDN(t, origin)
+			cdn.get(t, "/big/file", "Range: bytes=0-99")
+			if cdn.edge.Storage().MemoryObjects != 1 {
+				t.Fatal("first chunk was not cached")
+			}
+
+			// A new version replaces the file: chunk 1 must not be stitched
+			// onto chunk 0 of the old one. The edge drops the object and
+			// aborts; if nothing had reached the client yet, Go's transport
+			// retries and gets the new version whole.
+			origin.set(fileOf(1000, 1), `"v2"`, time.Now().Add(-time.Minute).UTC())
+			resp, err := http.Get(cdn.url + "/big/file")
+			var got []byte
+			if err == nil {
+				got, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err == nil && !bytes.Equal(got, fileOf(1000, 1)) {
+				t.Fatal("response completed with a body mixing two versions")
+			}
+
+			want := tc.ifRange
+			if want == "Last-Modified" {
+				want = modTime.Format(http.TimeFormat)
+			}
+			origin.mu.Lock()
+			ifRanges := origin.ifRanges
+			origin.mu.Unlock()
+			if !slices.Contains(ifRanges, want) {
+				t.Errorf("chunks fetched with If-Range %q, want %q", ifRanges, want)
+			}
+
+			// The old object is gone; the next request sees the new version.
+			resp, body := cdn.get(t, "/big/file")
+			if resp.StatusCode != http.StatusOK || body != string(fileOf(1000, 1)) {
+				t.Errorf("after the change: status %d, body is not the new version", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestChunkedObjectWithoutStrongValidator(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		etag    string
+		modTime time.Time
+	}{
+		{"no validator", "", time.Time{}},
+		{"weak ETag", `W/"v1"`, time.Time{}},
+		{"Last-Modified too recent to be strong", "", time.Now().UTC()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := &versionedFile{body: fileOf(1000, 0), etag: tc.etag, modTime: tc.modTime}
+			cdn := newChunkedCDN(t, origin)
+
+			resp, got := cdn.get(t, "/big/file", "Range: bytes=0-99")
+			if resp.StatusCode != http.StatusPartialContent || got != string(fileOf(1000, 0)[:100]) {
+				t.Fatalf("status %d, body mismatch", resp.StatusCode)
+			}
+			if st := cdn.edge.Storage(); st.MemoryObjects != 0 {
+				t.Fatalf("cached %d chunks of an object without a strong validator", st.MemoryObjects)
+			}
+
+			// Every request fetches the file whole, so it never mixes versions.
+			origin.set(fileOf(1000, 1), tc.etag, tc.modTime)
+			resp, got = cdn.get(t, "/big/file")
+			if resp.StatusCode != http.StatusOK || got != string(fileOf(1000, 1)) {
+				t.Errorf("after the change: status %d, body is not the new version", resp.StatusCode)
+			}
+			origin.mu.Lock()
+			defer origin.mu.Unlock()
+			for _, ifRange := range origin.ifRanges {
+				if ifRange != "" {
+					t.Errorf("chunk fetched with If-Range %q and no strong validator", ifRange)
+				}
+			}
+		})
+	}
+}
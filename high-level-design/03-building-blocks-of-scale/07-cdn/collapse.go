@@ -0,0 +1,56 @@
+package main
+
+import "sync"
+
+// flightGroup collapses concurrent fetches of the same object into one, in
+// the manner of golang.org/x/sync/singleflight. The zero value is ready to use.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flight[T]
+}
+
+// flight is a fetch in progress.
+type flight[T any] struct {
+	wg     sync.WaitGroup
+	res    T
+	failed bool // fn panicked: res is not a result
+}
+
+// Do runs fn for key unless a call for key is already running, in which
+// case it waits for that call and returns its result with shared set.
+//
+// If the call panics, its waiters do not get its zero result: the call
+// gives up its claim on key and each waiter tries again, so one of them
+// runs fn in turn.
+func (g *flightGroup[T]) Do(key string, fn func() T) (res T, shared bool) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flight[T])
+		}
+		f, ok := g.calls[key]
+		if !ok {
+			break // Leaves g.mu locked
+		}
+		g.mu.Unlock()
+		f.wg.Wait()
+		if !f.failed {
+			return f.res, true
+		}
+	}
+	f := &flight[T]{failed: true}
+	f.wg.Add(1)
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	// Release waiters even if fn panics, so they do not block forever.
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		f.wg.Done()
+	}()
+	f.res = fn()
+	f.failed = false
+	return f.res, false
+}
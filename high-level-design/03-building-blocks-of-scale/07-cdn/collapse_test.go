@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getConcurrently sends n concurrent requests for path with the given
+// header lines and returns their X-Cache labels.
+func (c *testCDN) getConcurrently(t *testing.T, n int, path string, header ...string) []string {
+	t.Helper()
+	labels := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := c.get(t, path, header...)
+			labels[i] = resp.Header.Get("X-Cache")
+		}()
+	}
+	wg.Wait()
+	return labels
+}
+
+func TestEdgeCollapsesConcurrentMisses(t *testing.T) {
+	cdn := newTestCDN(t, EdgeConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "body")
+	}))
+
+	labels := cdn.getConcurrently(t, 20, "/a")
+	if got := cdn.originHits.Load(); got != 1 {
+		t.Errorf("20 concurrent misses sent %d requests to the origin, want 1", got)
+	}
+	for _, label := range labels {
+		if label != "MISS" && label != "HIT" {
+			t.Errorf("X-Cache = %q, want MISS (collapsed) or HIT", label)
+		}
+	}
+}
+
+// barrier returns an origin handler that holds every request until n have
+// arrived, then answers them with the given header lines. If requests are
+// wrongly collapsed, fewer than n arrive and they are answered after a
+// timeout instead.
+func barrier(n int64, header ...string) http.HandlerFunc {
+	var arrived atomic.Int64
+	all := make(chan struct{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if arrived.Add(1) == n {
+			close(all)
+		}
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+		}
+		respond("body", header...)(w, r)
+	}
+}
+
+func TestEdgeNeverCollapsesRequestsWithCredentials(t *testing.T) {
+	for _, credentials := range []string{"Authorization: Bearer token", "Cookie: session=1"} {
+		t.Run(credentials, func(t *testing.T) {
+			// public makes the response storable even for an authorized
+			// request; the fetches must still not be shared.
+			cdn := newTestCDN(t, EdgeConfig{}, barrier(5, "Cache-Control: public, max-age=60"))
+			cdn.getConcurrently(t, 5, "/a", credentials)
+			if got := cdn.originHits.Load(); got != 5 {
+				t.Errorf("5 concurrent requests with credentials sent %d requests to the origin, want 5", got)
+			}
+		})
+	}
+}
+
+func TestEdgeDoesNotShareUnstorableFills(t *testing.T) {
+	cdn := newTestCDN(t, EdgeConfig{}, barrier(5, "Cache-Control: private, max-age=60"))
+	// The first fill may collapse the others onto it, but its response is
+	// private: each of them must fetch its own.
+	cdn.getConcurrently(t, 5, "/a")
+	if got := cdn.originHits.Load(); got != 5 {
+		t.Errorf("5 concurrent requests for a private response sent %d requests to the origin, want 5", got)
+	}
+}
+
+// staleOrigin serves version 1 of /a as already stale by age seconds (per
+// the Age header), then fails with 503 while failing is set.
+type staleOrigin struct {
+	cacheControl string
+	age          int
+	failing      atomic.Bool
+	version      atomic.Int64
+}
+
+func (o *staleOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.failing.Load() {
+		http.Error(w, "origin unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	v := o.version.Add(1)
+	w.Header().Set("Cache-Control", o.cacheControl)
+	if v == 1 {
+		w.Header().Set("Age", strconv.Itoa(o.age))
+	}
+	io.WriteString(w, "v"+strconv.FormatInt(v, 10))
+}
+
+func TestEdgeStaleIfError(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		cacheControl string
+		age          int
+		down         bool // Origin unreachable rather than answering 503
+		status       int
+		label        string
+	}{
+		{"5xx within the window", "max-age=60", 90, false, http.StatusOK, "STALE-IF-ERROR"},
+		{"down within the window", "max-age=60", 90, true, http.StatusOK, "STALE-IF-ERROR"},
+		{"5xx past the window", "max-age=60", 150, false, http.StatusServiceUnavailable, "EXPIRED"},
+		{"down past the window", "max-age=60", 150, true, http.StatusBadGateway, ""},
+		{"window from the response", "max-age=60, stale-if-error=300", 150, false, http.StatusOK, "STALE-IF-ERROR"},
+		{"must-revalidate", "max-age=60, must-revalidate", 90, false, http.StatusServiceUnavailable, "EXPIRED"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			origin := &staleOrigin{cacheControl: tc.cacheControl, age: tc.age}
+			cdn := newTestCDN(t, EdgeConfig{StaleIfError: time.Minute}, origin)
+			if resp, _ := cdn.get(t, "/a"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("first request: status %d", resp.StatusCode)
+			}
+
+			if tc.down {
+				cdn.origin.Close()
+			} else {
+				origin.failing.Store(true)
+			}
+			resp, body := cdn.get(t, "/a")
+			if resp.StatusCode != tc.status || resp.Header.Get("X-Cache") != tc.label {
+				t.Fatalf("status %d, X-Cache %q; want %d %q", resp.StatusCode, resp.Header.Get("X-Cache"), tc.status, tc.label)
+			}
+			if tc.status == http.StatusOK && body != "v1" {
+				t.Errorf("body %q, want the stale v1", body)
+			}
+		})
+	}
+}
+
+func TestEdgeStaleWhileRevalidate(t *testing.T) {
+	origin := &staleOrigin{cacheControl: "max-age=60, stale-while-revalidate=60", age: 90}
+	cdn := newTestCDN(t, EdgeConfig{}, origin)
+	cdn.get(t, "/a")
+
+	// Stale but within the window: served at once, refreshed behind.
+	resp, body := cdn.get(t, "/a")
+	if got := resp.Header.Get("X-Cache"); got != "STALE" || body != "v1" {
+		t.Fatalf("X-Cache = %q, body %q; want STALE v1", got, body)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, body = cdn.get(t, "/a")
+		if resp.Header.Get("X-Cache") == "HIT" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no HIT after the background refresh, last X-Cache %q", resp.Header.Get("X-Cache"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body != "v2" || cdn.originHits.Load() != 2 {
+		t.Errorf("after the refresh: body %q with %d origin requests, want v2 with 2", body, cdn.originHits.Load())
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedResponse is an origin response stored at the edge.
+type cachedResponse struct {
+	status     int
+	header     http.Header
+	body       *blob
+	vary       map[string]string // Request header values this variant was served for
+	storedAt   time.Time         // When it was received or last revalidated
+	initialAge time.Duration     // Age reported by the origin
+	lifetime   time.Duration     // Freshness lifetime
+	swr, sie   time.Duration     // Stale-while-revalidate and stale-if-error windows
+}
+
+func newCachedResponse(key string, r *http.Request, resp *http.Response, body []byte, now time.Time) *cachedResponse {
+	c := &cachedResponse{
+		status:   resp.StatusCode,
+		header:   resp.Header.Clone(),
+		body:     newBlob(key, body),
+		vary:     make(map[string]string),
+		storedAt: now,
+		lifetime: freshnessLifetime(resp.Header, now),
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		c.vary[name] = r.Header.Get(name)
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		c.initialAge = time.Duration(age) * time.Second
+	}
+	return c
+}
+
+// age is how old the response is, counting the time it spent upstream.
+func (c *cachedResponse) age(now time.Time) time.Duration {
+	return c.initialAge + now.Sub(c.storedAt)
+}
+
+func (c *cachedResponse) fresh(now time.Time) bool {
+	return c.age(now) < c.lifetime
+}
+
+// staleWhileRevalidate reports whether a stale response may still be
+// served while it is refreshed in the background.
+func (c *cachedResponse) staleWhileRevalidate(now time.Time) bool {
+	return c.age(now) < c.lifetime+c.swr
+}
+
+// staleIfError reports whether a stale response may be served in place of
+// an origin error.
+func (c *cachedResponse) staleIfError(now time.Time) bool {
+	return c.age(now) < c.lifetime+c.sie
+}
+
+// matches reports whether this variant can answer r, per Vary.
+func (c *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range c.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidated returns a copy refreshed by a 304 Not Modified: the body is
+// still good, and the 304's headers replace the stored ones.
+func (c *cachedResponse) revalidated(notModified *http.Response, now time.Time) *cachedResponse {
+	fresh := *c
+	fresh.header = c.header.Clone()
+	for name, values := range notModified.Header {
+		switch name {
+		case "Content-Length", "Content-Type", "Content-Encoding":
+			continue
+		}
+		fresh.header[name] = values
+	}
+	fresh.storedAt = now
+	fresh.initialAge = 0
+	if age, err := strconv.Atoi(notModified.Header.Get("Age")); err == nil && age > 0 {
+		fresh.initialAge = time.Duration(age) * time.Second
+	}
+	fresh.lifetime = freshnessLifetime(fresh.header, now)
+	return &fresh
+}
+
+// EdgeConfig holds the edge's defaults for serving stale content. Origins
+// can override them per response with the stale-while-revalidate and
+// stale-if-error Cache-Control extensions (RFC 5861).
+type EdgeConfig struct {
+	// StaleWhileRevalidate is how long past its freshness a response may
+	// be served as is while it is revalidated in the background.
+	StaleWhileRevalidate time.Duration
+	// StaleIfError is how long past its freshness a response may be served
+	// when the origin is unreachable or answers with a 5xx.
+	StaleIfError time.Duration
+	// UpstreamLatency simulates the network round trip to the upstream
+	// (the origin, or a shield), added to every fetch.
+	UpstreamLatency time.Duration
+
+	// ChunkedPaths are patterns (see Ban) of large objects, such as video,
+	// that are cached in chunks of ChunkSize bytes fetched on demand with
+	// range requests, instead of as whole files.
+	ChunkedPaths []string
+	ChunkSize    int64
+
+	// MemoryBytes and DiskBytes bound the bodies kept in memory and, if
+	// DiskDir is set, on disk (0 means unlimited). Admission keeps bodies
+	// of rarely requested URLs from pushing out popular ones.
+	MemoryBytes int64
+	DiskDir     string
+	DiskBytes   int64
+	Admission   bool
+
+	// IgnoredParams are patterns (see Ban) of query parameters that do
+	// not change the response, such as "utm_*", left out of cache keys.
+	IgnoredParams []string
+}
+
+// EdgeServer simulates a CDN node in Sydney: a caching reverse proxy in
+// front of the origin. It is "close" to the user but starts empty.
+//
+// It follows the HTTP caching rules (RFC 9111) for a shared cache:
+//   - responses are stored according to Cache-Control (s-maxage, max-age,
+//     no-store, private, no-cache) and Expires;
+//   - Vary keeps one variant per value of the listed request headers;
+//   - stale responses are revalidated with If-None-Match/If-Modified-Since,
+//     and a 304 from the origin refreshes them without a new download;
+//   - clients' own conditional requests are answered with 304 from the cache.
+//
+// It also shields the origin from slowness and failure:
+//   - within the stale-while-revalidate window, a stale response is served
+//     at once and refreshed in the background;
+//   - within the stale-if-error window, a stale response is served when the
+//     origin fails;
+//   - concurrent misses for the same object are collapsed into one fetch.
+//
+// Every response carries X-Cache (HIT, MISS, EXPIRED, REVALIDATED, STALE,
+// STALE-IF-ERROR, PASS) and Age headers so the behaviour can be observed
+// with curl or a browser. Responses from the cache also say which storage
+// tier (memory or disk) held them in X-Cache-Tier.
+type EdgeServer struct {
+	name   string
+	origin *url.URL
+	config EdgeConfig
+	client *http.Client
+	proxy  *httputil.ReverseProxy // For requests that bypass the cache
+	fills  flightGroup[fillResult]
+	chunks flightGroup[chunkResult]
+
+	mu        sync.Mutex
+	cache     map[string][]*cachedResponse // Variants per URL
+	varyNames map[string][]string          // Last known Vary of each URL
+	large     map[string]*largeObject      // Chunked objects per URL
+	tags      map[string]map[string]bool   // Surrogate key -> URLs tagged with it
+	keyTags   map[string][]string          // URL -> its surrogate keys
+
+	memory, disk *tier // Where the bodies are (see storage.go)
+	sketch       *frequencySketch
+	storage      StorageStats
+	blobs        uint64 // Files written to the disk tier
+
+	// generation is bumped by every invalidation. Fills that started
+	// before it do not store their response: it may predate the purge.
+	generation uint64
+}
+
+func NewEdgeServer(name string, origin *url.URL, config EdgeConfig) *EdgeServer {
+	return &EdgeServer{
+		name:      name,
+		origin:    origin,
+		config:    config,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		proxy:     httputil.NewSingleHostReverseProxy(origin),
+		cache:     make(map[string][]*cachedResponse),
+		varyNames: make(map[string][]string),
+		large:     make(map[string]*largeObject),
+		tags:      make(map[string]map[string]bool),
+		keyTags:   make(map[string][]string),
+		memory:    newTier("memory", config.MemoryBytes),
+		disk:      newTier("disk", config.DiskBytes),
+		sketch:    newFrequencySketch(4096),
+	}
+}
+
+func (s *EdgeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		s.log(r, "PASS", "")
+		w.Header().Set("X-Cache", "PASS")
+		s.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	key := s.cacheKey(r)
+	s.mu.Lock()
+	s.sketch.increment(key)
+	s.mu.Unlock()
+	if s.isChunked(r.URL.Path) {
+		s.serveChunked(w, r, key)
+		return
+	}
+
+	// 1. Check local cache
+	cached, body, tier := s.lookup(key, r)
+	reqCC := parseCacheControl(r.Header)
+	forceRevalidate := reqCC.Has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+	now := time.Now()
+
+	switch {
+	case cached == nil:
+		s.serveFill(w, r, key, nil, nil)
+	case forceRevalidate:
+		s.serveFill(w, r, key, cached, body)
+	case cached.fresh(now):
+		w.Header().Set("X-Cache-Tier", tier)
+		s.serveCached(w, r, cached, body, "HIT", "from "+tier)
+	case cached.staleWhileRevalidate(now):
+		// 2. Slightly stale: answer now, refresh for the next client.
+		w.Header().Set("X-Cache-Tier", tier)
+		s.serveCached(w, r, cached, body, "STALE", "revalidating in background")
+		go s.revalidate(r.Clone(context.WithoutCancel(r.Context())), key)
+	default:
+		// 3. Too stale: revalidate before answering.
+		s.serveFill(w, r, key, cached, body)
+	}
+}
+
+// revalidate refreshes a stale entry in the background, unless another
+// request already did.
+func (s *EdgeServer) revalidate(r *http.Request, key string) {
+	cached, body, _ := s.lookup(key, r)
+	if cached == nil || cached.fresh(time.Now()) {
+		return
+	}
+	s.collapsedFill(r, key, cached, body)
+}
+
+// fillResult is the outcome of a trip to the origin.
+type fillResult struct {
+	entry  *cachedResponse // What to serve; nil if the origin was unreachable
+	body   []byte
+	label  string // MISS, EXPIRED or REVALIDATED
+	note   string
+	failed bool  // The origin was unreachable or answered with a 5xx
+	err    error // Set when the origin was unreachable
+	shared bool  // The fill was started by another request
+
+	// shareable is set when the result may be served to clients other than
+	// the one whose request fetched it: the response is one a shared cache
+	// may store, or there was no response at all.
+	shareable bool
+}
+
+// serveFill fetches from the origin and serves the result, falling back to
+// the stale copy if the origin fails within the stale-if-error window.
+func (s *EdgeServer) serveFill(w http.ResponseWriter, r *http.Request, key string, stale *cachedResponse, staleBody []byte) {
+	res := s.collapsedFill(r, key, stale, staleBody)
+	switch {
+	case res.shared && !res.shareable:
+		// Collapsed onto a fill whose response was meant for its client
+		// only (private, no-store...): fetch our own.
+		res = s.fill(r, key, stale, staleBody)
+	case res.entry != nil && !res.entry.matches(r):
+		// Collapsed onto a fill for another variant (Vary): fetch our own.
+		res = s.fill(r, key, stale, staleBody)
+	}
+
+	if res.failed && stale != nil && stale.staleIfError(time.Now()) {
+		s.serveCached(w, r, stale, staleBody, "STALE-IF-ERROR", "origin failed")
+		return
+	}
+	if res.err != nil {
+		s.log(r, "ERROR", res.err.Error())
+		http.Error(w, "origin unreachable", http.StatusBadGateway)
+		return
+	}
+	note := res.note
+	if res.shared {
+		note = strings.TrimPrefix(note+", collapsed", ", ")
+	}
+	s.serveCached(w, r, res.entry, res.body, res.label, note)
+}
+
+// collapsedFill runs fill once for all concurrent requests for the same
+// object, so a burst of misses costs the origin a single request. Requests
+// with credentials are never collapsed.
+func (s *EdgeServer) collapsedFill(r *http.Request, key string, stale *cachedResponse, staleBody []byte) fillResult {
+	if !collapsible(r) {
+		return s.fill(r, key, stale, staleBody)
+	}
+	res, shared := s.fills.Do(s.fillKey(key, r), func() fillResult {
+		return s.fill(r, key, stale, staleBody)
+	})
+	res.shared = shared
+	return res
+}
+
+// fillKey identifies an object being fetched: its URL plus the request
+// headers its last known response varied on.
+func (s *EdgeServer) fillKey(key string, r *http.Request) string {
+	s.mu.Lock()
+	names := s.varyNames[key]
+	s.mu.Unlock()
+	parts := []string{key}
+	for _, name := range names {
+		parts = append(parts, name+"="+r.Header.Get(name))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// fill gets the resource from the origin, conditionally if a stale copy is
+// at hand, and stores it when allowed.
+func (s *EdgeServer) fill(r *http.Request, key string, stale *cachedResponse, staleBody []byte) fillResult {
+	s.mu.Lock()
+	gen := s.generation
+	s.mu.Unlock()
+
+	req := s.originRequest(r)
+	if stale != nil {
+		if etag := stale.header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lm := stale.header.Get("Last-Modified"); lm != "" {
+			req.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	time.Sleep(s.config.UpstreamLatency)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fillResult{failed: true, err: err, shareable: true}
+	}
+	defer resp.Body.Close()
+	now := time.Now()
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		// The stale copy came from the cache, so it was shareable already.
+		fresh := stale.revalidated(resp, now)
+		fresh.body = newBlob(key, staleBody)
+		s.setStaleWindows(fresh)
+		res := fillResult{entry: fresh, body: staleBody, label: "REVALIDATED", shareable: true}
+		if why := s.store(key, fresh, gen); why != "" {
+			res.note = "not stored: " + why
+		}
+		return res
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fillResult{failed: true, err: err, shareable: true}
+	}
+	entry := newCachedResponse(key, req, resp, body, now)
+	s.setStaleWindows(entry)
+
+	ok, why := storable(req, resp)
+	res := fillResult{entry: entry, body: body, label: "MISS", failed: resp.StatusCode >= 500, shareable: ok}
+	if stale != nil {
+		res.label = "EXPIRED"
+	}
+	if res.failed {
+		// Keep the stale copy: it may still be served if the origin errors.
+		res.note = "origin error"
+		return res
+	}
+	if ok {
+		if why := s.store(key, entry, gen); why != "" {
+			res.note = "not stored: " + why
+		}
+	} else {
+		if stale != nil {
+			s.remove(key, stale)
+		}
+		res.note = "not stored: " + why
+	}
+	return res
+}
+
+// setStaleWindows applies the response's stale-while-revalidate and
+// stale-if-error directives, or the edge's defaults. must-revalidate,
+// proxy-revalidate and no-cache forbid serving the response stale at all.
+func (s *EdgeServer) setStaleWindows(c *cachedResponse) {
+	cc := parseCacheControl(c.header)
+	if cc.Has("must-revalidate") || cc.Has("proxy-revalidate") || cc.Has("no-cache") {
+		c.swr, c.sie = 0, 0
+		return
+	}
+	c.swr, c.sie = s.config.StaleWhileRevalidate, s.config.StaleIfError
+	if d, ok := cc.Seconds("stale-while-revalidate"); ok {
+		c.swr = d
+	}
+	if d, ok := cc.Seconds("stale-if-error"); ok {
+		c.sie = d
+	}
+}
+
+// originRequest builds the request the edge sends to fill its cache. It is
+// always a full GET: the edge answers the client's conditional and range
+// headers itself, from the complete response.
+func (s *EdgeServer) originRequest(r *http.Request) *http.Request {
+	target := *s.origin
+	target.Path = r.URL.Path
+	target.RawQuery = s.normalizeQuery(r.URL)
+	// The fill may be shared with other clients or finish in the
+	// background, so it must not be cancelled when this client goes away.
+	req, _ := http.NewRequestWithContext(context.WithoutCancel(r.Context()), http.MethodGet, target.String(), nil)
+
+	req.Header = r.Header.Clone()
+	removeHopByHop(req.Header)
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		req.Header.Del(h)
+	}
+	req.Header.Add("Via", "1.1 "+s.name)
+	return req
+}
+
+// serveCached writes a stored (or just fetched) response. 200 responses go
+// through http.ServeContent, which answers the client's conditional and
+// range requests from the cached body.
+func (s *EdgeServer) serveCached(w http.ResponseWriter, r *http.Request, c *cachedResponse, body []byte, label, note string) {
+	now := time.Now()
+	// Copy the values too: c is shared with concurrent requests, and the
+	// Add below would otherwise append to its slices.
+	h := w.Header()
+	for name, values := range c.header {
+		h[name] = slices.Clone(values)
+	}
+	removeHopByHop(h)
+	h.Del("Content-Length")
+	h.Set("Age", strconv.Itoa(int(c.age(now)/time.Second)))
+	h.Set("X-Cache", label)
+	h.Add("Via", "1.1 "+s.name)
+	s.log(r, label, note)
+
+	if c.status == http.StatusOK {
+		modTime, _ := http.ParseTime(c.header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+		return
+	}
+	w.WriteHeader(c.status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func (s *EdgeServer) log(r *http.Request, label, note string) {
+	if !logRequests.Load() {
+		return
+	}
+	if note != "" {
+		note = " (" + note + ")"
+	}
+	fmt.Printf("[Edge %s] %s %s -> %s%s\n", s.name, r.Method, r.URL.RequestURI(), label, note)
+}
+
+// lookup returns the variant of key that matches r with its body, and the
+// tier the body was found in.
+func (s *EdgeServer) lookup(key string, r *http.Request) (*cachedResponse, []byte, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.cache[key] {
+		if c.matches(r) {
+			body, tier, ok := s.readLocked(c.body)
+			if !ok {
+				return nil, nil, ""
+			}
+			return c, body, tier
+		}
+	}
+	return nil, nil, ""
+}
+
+// store adds a variant, replacing the one for the same Vary values. It
+// returns why nothing was stored: the cache was invalidated since
+// generation gen, or the body was not admitted to memory.
+func (s *EdgeServer) store(key string, c *cachedResponse, gen uint64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.generation {
+		return "invalidated during fetch"
+	}
+	if c.body.tier == nil && !s.admitLocked(c.body) {
+		return "not admitted"
+	}
+	c.body.dropped = func() { s.removeLocked(key, c) }
+
+	s.varyNames[key] = varyHeaders(c.header)
+	defer s.reindex(key)
+	variants := s.cache[key]
+	for i, old := range variants {
+		if sameVary(old.vary, c.vary) {
+			if old.body != c.body {
+				s.freeLocked(old.body)
+			}
+			variants[i] = c
+			return ""
+		}
+	}
+	s.cache[key] = append(variants, c)
+	return ""
+}
+
+func (s *EdgeServer) remove(key string, c *cachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, old := range s.cache[key] {
+		if old == c || sameVary(old.vary, c.vary) {
+			s.freeLocked(old.body)
+			s.removeLocked(key, old)
+			break
+		}
+	}
+}
+
+// removeLocked drops a variant from the index. Caller holds s.mu.
+func (s *EdgeServer) removeLocked(key string, c *cachedResponse) {
+	variants := s.cache[key]
+	for i, old := range variants {
+		if old == c {
+			s.cache[key] = append(variants[:i:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(s.cache[key]) == 0 {
+		delete(s.cache, key)
+	}
+	s.reindex(key)
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// hopByHop headers describe a single connection and must not be forwarded.
+var hopByHop = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func removeHopByHop(h http.Header) {
+	for _, line := range h.Values("Connection") {
+		for _, name := range strings.Split(line, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
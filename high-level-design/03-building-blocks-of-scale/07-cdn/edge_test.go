@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCDN is an edge in front of an origin handler, both on httptest
+// servers, counting the requests that reach the origin.
+type testCDN struct {
+	edge       *EdgeServer
+	url        string // Edge base URL
+	origin     *httptest.Server
+	originHits atomic.Int64
+}
+
+func newTestCDN(t *testing.T, config EdgeConfig, origin http.Handler) *testCDN {
+	t.Helper()
+	c := &testCDN{}
+	c.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.originHits.Add(1)
+		origin.ServeHTTP(w, r)
+	}))
+	t.Cleanup(c.origin.Close)
+	originURL, err := url.Parse(c.origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.edge = NewEdgeServer("test", originURL, config)
+	srv := httptest.NewServer(c.edge)
+	t.Cleanup(srv.Close)
+	c.url = srv.URL
+	return c
+}
+
+// get requests path from the edge with the given header lines
+// ("Name: value", where "Host: ..." sets the request's host) and returns
+// the response with its body read.
+func (c *testCDN) get(t *testing.T, path string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range header {
+		name, value, _ := strings.Cut(line, ":")
+		if name == "Host" {
+			req.Host = strings.TrimSpace(value)
+			continue
+		}
+		req.Header.Add(name, strings.TrimSpace(value))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// respond returns an origin handler that answers with body and the given
+// header lines, without validators unless the lines include them.
+func respond(body string, header ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, line := range header {
+			name, value, _ := strings.Cut(line, ":")
+			w.Header().Add(name, strings.TrimSpace(value))
+		}
+		io.WriteString(w, body)
+	}
+}
+
+func TestEdgeFreshness(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		header []string
+		second string // X-Cache of the second request
+		hits   int64  // Origin requests after two requests
+	}{
+		{"max-age", []string{"Cache-Control: max-age=60"}, "HIT", 1},
+		{"s-maxage overrides max-age", []string{"Cache-Control: max-age=0, s-maxage=60"}, "HIT", 1},
+		{"private", []string{"Cache-Control: private, max-age=60"}, "MISS", 2},
+		{"private beats s-maxage", []string{"Cache-Control: private, s-maxage=60"}, "MISS", 2},
+		{"no-store", []string{"Cache-Control: no-store, max-age=60"}, "MISS", 2},
+		{"no-store beats s-maxage", []string{"Cache-Control: s-maxage=60, no-store"}, "MISS", 2},
+		{"no freshness, no validator", nil, "MISS", 2},
+		{"expired max-age", []string{"Cache-Control: max-age=0"}, "MISS", 2},
+		{"Expires in the future", []string{
+			"Date: " + now.UTC().Format(http.TimeFormat),
+			"Expires: " + now.Add(time.Hour).UTC().Format(http.TimeFormat),
+		}, "HIT", 1},
+		{"Expires without Date", []string{"Expires: " + now.Add(time.Hour).UTC().Format(http.TimeFormat)}, "HIT", 1},
+		{"Expires in the past", []string{
+			"Date: " + now.UTC().Format(http.TimeFormat),
+			"Expires: " + now.Add(-time.Hour).UTC().Format(http.TimeFormat),
+		}, "MISS", 2},
+		{"invalid Expires", []string{"Expires: 0"}, "MISS", 2},
+		{"max-age beats Expires", []string{
+			"Cache-Control: max-age=60",
+			"Expires: " + now.Add(-time.Hour).UTC().Format(http.TimeFormat),
+		}, "HIT", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cdn := newTestCDN(t, EdgeConfig{}, respond("body", tc.header...))
+			if resp, _ := cdn.get(t, "/a"); resp.Header.Get("X-Cache") != "MISS" {
+				t.Fatalf("first request: X-Cache = %q, want MISS", resp.Header.Get("X-Cache"))
+			}
+			resp, body := cdn.get(t, "/a")
+			if got := resp.Header.Get("X-Cache"); got != tc.second || body != "body" {
+				t.Errorf("second request: X-Cache = %q, body %q; want %q", got, body, tc.second)
+			}
+			if got := cdn.originHits.Load(); got != tc.hits {
+				t.Errorf("origin got %d requests, want %d", got, tc.hits)
+			}
+		})
+	}
+}
+
+func TestEdgeRevalidatesStaleResponse(t *testing.T) {
+	origin := NewOriginServer(0)
+	origin.Put("/a", Asset{Body: []byte("v1"), CacheControl: "max-age=0"})
+	cdn := newTestCDN(t, EdgeConfig{}, origin)
+
+	cdn.get(t, "/a")
+	// Stale at once, but the ETag lets the edge revalidate it: the
+	// origin answers 304 and the body is not downloaded again.
+	resp, body := cdn.get(t, "/a")
+	if got := resp.Header.Get("X-Cache"); got != "REVALIDATED" || body != "v1" {
+		t.Fatalf("X-Cache = %q, body %q; want REVALIDATED v1", got, body)
+	}
+
+	origin.Put("/a", Asset{Body: []byte("v2"), CacheControl: "max-age=0"})
+	resp, body = cdn.get(t, "/a")
+	if got := resp.Header.Get("X-Cache"); got != "EXPIRED" || body != "v2" {
+		t.Fatalf("after a change: X-Cache = %q, body %q; want EXPIRED v2", got, body)
+	}
+}
+
+func TestEdgeVary(t *testing.T) {
+	origin := NewOriginServer(0)
+	origin.Put("/greeting", Asset{
+		Body:         []byte("Hello"),
+		CacheControl: "max-age=60",
+		Vary:         "Accept-Language",
+		Variants:     map[string][]byte{"fr": []byte("Bonjour"), "de": []byte("Hallo")},
+	})
+	cdn := newTestCDN(t, EdgeConfig{}, origin)
+
+	for _, tc := range []struct {
+		lang, cache, body string
+	}{
+		{"fr", "MISS", "Bonjour"},
+		{"de", "MISS", "Hallo"},
+		{"fr", "HIT", "Bonjour"},
+		{"de", "HIT", "Hallo"},
+		{"", "MISS", "Hello"},
+		{"", "HIT", "Hello"},
+		{"es", "MISS", "Hello"}, // Same body as no header, but its own variant
+	} {
+		resp, body := cdn.get(t, "/greeting", "Accept-Language: "+tc.lang)
+		if got := resp.Header.Get("X-Cache"); got != tc.cache || body != tc.body {
+			t.Errorf("Accept-Language %q: X-Cache = %q, body %q; want %s %q", tc.lang, got, body, tc.cache, tc.body)
+		}
+	}
+	if got := cdn.originHits.Load(); got != 4 {
+		t.Errorf("origin got %d requests, want one per variant (4)", got)
+	}
+}
+
+func TestEdgeAnswersConditionalRequests(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	origin := NewOriginServer(0)
+	origin.Put("/a", Asset{Body: []byte("body"), CacheControl: "max-age=60", ModTime: modTime})
+	cdn := newTestCDN(t, EdgeConfig{}, origin)
+
+	resp, _ := cdn.get(t, "/a")
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("origin response has no ETag")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"matching If-None-Match", "If-None-Match: " + etag, http.StatusNotModified},
+		{"If-None-Match among others", `If-None-Match: "other", ` + etag, http.StatusNotModified},
+		{"other If-None-Match", `If-None-Match: "other"`, http.StatusOK},
+		{"If-Modified-Since at Last-Modified", "If-Modified-Since: " + modTime.Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since later", "If-Modified-Since: " + modTime.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified},
+		{"If-Modified-Since earlier", "If-Modified-Since: " + modTime.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	} {
+		resp, body := cdn.get(t, "/a", tc.header)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+		if tc.status == http.StatusNotModified && body != "" {
+			t.Errorf("%s: 304 with body %q", tc.name, body)
+		}
+		if got := resp.Header.Get("X-Cache"); got != "HIT" {
+			t.Errorf("%s: X-Cache = %q, want HIT: the edge should answer on its own", tc.name, got)
+		}
+	}
+	if got := cdn.originHits.Load(); got != 1 {
+		t.Errorf("origin got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/glob"
+)
+
+// Objects can be removed from an edge in three ways:
+//   - purge: one URL, with all its Vary variants;
+//   - ban: every URL matching a pattern, where * matches any run of
+//     characters, e.g. "/assets/*" or "/*.css";
+//   - surrogate key: every object the origin tagged with a key in its
+//     Surrogate-Key header (space-separated, as Fastly does), e.g. all pages
+//     showing product 42 after its price changes.
+
+// surrogateKeys returns the tags an origin response carries.
+func surrogateKeys(h http.Header) []string {
+	return strings.Fields(strings.Join(h.Values("Surrogate-Key"), " "))
+}
+
+// reindex records the surrogate keys of url's variants. Caller holds s.mu.
+func (s *EdgeServer) reindex(key string) {
+	for _, tag := range s.keyTags[key] {
+		delete(s.tags[tag], key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+	delete(s.keyTags, key)
+
+	headers := make([]http.Header, 0, len(s.cache[key])+1)
+	for _, c := range s.cache[key] {
+		headers = append(headers, c.header)
+	}
+	if obj, ok := s.large[key]; ok {
+		headers = append(headers, obj.header)
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		for _, tag := range surrogateKeys(h) {
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			if s.tags[tag] == nil {
+				s.tags[tag] = make(map[string]bool)
+			}
+			s.tags[tag][key] = true
+			s.keyTags[key] = append(s.keyTags[key], tag)
+		}
+	}
+}
+
+// Purge removes one URL and returns how many objects (variants) it held.
+// A URL without a host ("/deals?page=2") is purged for every host. It is
+// normalized the way cache keys are.
+func (s *EdgeServer) Purge(rawURL string) int {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0
+	}
+	if u.Host == "" {
+		path := s.normalizePath(u)
+		return s.invalidate(func(key string) bool { return keyPath(key) == path })
+	}
+	want := normalizeHost(u.Host) + s.normalizePath(u)
+	return s.invalidate(func(key string) bool { return key == want })
+}
+
+// Ban removes every URL matching pattern and returns how many objects went.
+// Patterns starting with "/" match the path and query on every host;
+// others match the whole key, host included ("shop.example.com/*").
+func (s *EdgeServer) Ban(pattern string) int {
+	if strings.HasPrefix(pattern, "/") {
+		return s.invalidate(func(key string) bool { return glob.Match(pattern, keyPath(key)) })
+	}
+	return s.invalidate(func(key string) bool { return glob.Match(pattern, key) })
+}
+
+// PurgeTag removes every object tagged with the surrogate key.
+func (s *EdgeServer) PurgeTag(tag string) int {
+	s.mu.Lock()
+	tagged := s.tags[tag]
+	s.mu.Unlock()
+	return s.invalidate(func(key string) bool { return tagged[key] })
+}
+
+// invalidate removes the URLs match selects and bumps the generation, so
+// fills already in flight do not store what may be pre-purge content.
+func (s *EdgeServer) invalidate(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	removed := 0
+	for key, variants := range s.cache {
+		if match(key) {
+			removed += len(variants)
+			for _, c := range variants {
+				s.freeLocked(c.body)
+			}
+			delete(s.cache, key)
+			s.reindex(key)
+		}
+	}
+	for key, obj := range s.large {
+		if match(key) {
+			removed++
+			s.removeLargeLocked(key, obj)
+		}
+	}
+	return removed
+}
+
+// InvalidationResult is an edge's confirmation of an invalidation.
+type InvalidationResult struct {
+	Edge    string `json:"edge"`
+	Removed int    `json:"removed"`
+}
+
+// AdminHandler serves the edge's invalidation API:
+//
+//	POST /purge?url=/logo.png
+//	POST /ban?pattern=/assets/*
+//	POST /purge-tag?tag=product-42
+//
+// Each answers with an InvalidationResult. It belongs on a private
+// network, never on the public listener.
+func (s *EdgeServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path, param string, invalidate func(string) int) {
+		mux.HandleFunc("POST "+path, func(w http.ResponseWriter, r *http.Request) {
+			arg := r.URL.Query().Get(param)
+			if arg == "" {
+				http.Error(w, param+" is required", http.StatusBadRequest)
+				return
+			}
+			removed := invalidate(arg)
+			if logRequests.Load() {
+				fmt.Printf("[Edge %s] %s %s=%s -> removed %d\n", s.name, strings.TrimPrefix(path, "/"), param, arg, removed)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(InvalidationResult{Edge: s.name, Removed: removed})
+		})
+	}
+	handle("/purge", "url", s.Purge)
+	handle("/ban", "pattern", s.Ban)
+	handle("/purge-tag", "tag", s.PurgeTag)
+	return mux
+}
+
+// Purger is the CDN's control plane for invalidations: it sends each one to
+// every edge's admin API and waits for all of them to confirm.
+//
+// Tiers are invalidated in order, each fully before the next: shields
+// first, then edges. The other way round, an edge could refill from a
+// shield that still holds the old object.
+type Purger struct {
+	tiers   [][]string // Admin base URLs, per tier
+	client  *http.Client
+	retries int
+}
+
+func NewPurger(tiers ...[]string) *Purger {
+	return &Purger{tiers: tiers, client: &http.Client{Timeout: 2 * time.Second}, retries: 3}
+}
+
+func (p *Purger) Purge(ctx context.Context, rawURL string) ([]InvalidationResult, error) {
+	return p.fanOut(ctx, "/purge", url.Values{"url": {rawURL}})
+}
+
+func (p *Purger) Ban(ctx context.Context, pattern string) ([]InvalidationResult, error) {
+	return p.fanOut(ctx, "/ban", url.Values{"pattern": {pattern}})
+}
+
+func (p *Purger) PurgeTag(ctx context.Context, tag string) ([]InvalidationResult, error) {
+	return p.fanOut(ctx, "/purge-tag", url.Values{"tag": {tag}})
+}
+
+// fanOut sends the invalidation to every node of a tier concurrently,
+// retrying failures, before moving on to the next tier. It returns the
+// confirmations received and an error naming the nodes that never confirmed.
+func (p *Purger) fanOut(ctx context.Context, path string, params url.Values) ([]InvalidationResult, error) {
+	var results []InvalidationResult
+	for _, tier := range p.tiers {
+		var (
+			mu   sync.Mutex
+			wg   sync.WaitGroup
+			errs []error
+		)
+		for _, base := range tier {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := p.send(ctx, base+path+"?"+params.Encode())
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", base, err))
+					return
+				}
+				results = append(results, res)
+			}()
+		}
+		wg.Wait()
+		if len(errs) > 0 {
+			return results, errors.Join(errs...)
+		}
+	}
+	return results, nil
+}
+
+// send posts one invalidation, retrying with backoff until it is confirmed.
+func (p *Purger) send(ctx context.Context, target string) (InvalidationResult, error) {
+	var lastErr error
+	for attempt := 0; attempt < p.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return InvalidationResult{}, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+		if err != nil {
+			return InvalidationResult{}, err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var res InvalidationResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("status %d", resp.StatusCode)
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return res, nil
+	}
+	return InvalidationResult{}, lastErr
+}
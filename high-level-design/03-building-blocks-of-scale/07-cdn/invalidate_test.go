@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestPurgeNormalizesLikeCacheKeys(t *testing.T) {
+	cdn := newTestCDN(t, EdgeConfig{IgnoredParams: []string{"utm_*"}}, pages)
+	for _, tc := range []struct {
+		name, url string
+		removed   int
+	}{
+		{"same URL", "http://example.com/p?a=1&b=2", 1},
+		{"host case and default port", "http://EXAMPLE.com:80/p?a=1&b=2", 1},
+		{"parameter order and ignored parameters", "http://example.com/p?b=2&utm_source=x&a=1", 1},
+		{"no host purges every host", "/p?b=2&a=1", 1},
+		{"other port", "http://example.com:8080/p?a=1&b=2", 0},
+		{"other query", "http://example.com/p?a=1", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cdn.get(t, "/p?a=1&b=2", "Host: Example.com")
+			if removed := cdn.edge.Purge(tc.url); removed != tc.removed {
+				t.Fatalf("Purge(%s) removed %d, want %d", tc.url, removed, tc.removed)
+			}
+			want := "HIT"
+			if tc.removed > 0 {
+				want = "MISS"
+			}
+			resp, _ := cdn.get(t, "/p?a=1&b=2", "Host: example.com")
+			if got := resp.Header.Get("X-Cache"); got != want {
+				t.Errorf("after the purge: X-Cache = %q, want %q", got, want)
+			}
+			cdn.edge.Ban("/*")
+		})
+	}
+}
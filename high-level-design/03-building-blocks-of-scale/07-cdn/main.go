@@ -1,76 +1,598 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// OriginServer simulates our main server in New York.
-// It has all the data but is "far away" (slow to access).
-type OriginServer struct {
-	content map[string]string
+// logRequests prints a line per request at the origin and the edges. main
+// turns it on; the topology simulation turns it off while it runs, as it
+// sends far too many requests. Handlers read it concurrently.
+var logRequests atomic.Bool
+
+// edgeConfig lets every cached response be served stale for a minute if
+// the origin goes down, and caches downloads in 512 KiB chunks.
+var edgeConfig = EdgeConfig{
+	StaleIfError: time.Minute,
+	ChunkedPaths: []string{"/downloads/*"},
+	ChunkSize:    512 << 10,
+}
+
+// movie is a large file whose bytes are easy to check: byte i is i % 251.
+var movie = func() []byte {
+	b := make([]byte, 3<<20)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}()
+
+// newOrigin publishes a few assets, each with a different caching policy.
+func newOrigin() *OriginServer {
+	origin := NewOriginServer(500 * time.Millisecond)
+	// Static assets: cache for an hour everywhere.
+	origin.Put("/logo.png", Asset{Body: []byte("BINARY_IMAGE_DATA"), ContentType: "image/png", CacheControl: "public, max-age=3600"})
+	// HTML changes often: cache briefly, then revalidate with the ETag.
+	origin.Put("/index.html", Asset{Body: []byte("<html>...</html>"), ContentType: "text/html", CacheControl: "max-age=1"})
+	// News: browsers must revalidate every time, the CDN may keep it a minute.
+	origin.Put("/news", Asset{Body: []byte("Headlines"), ContentType: "text/plain", CacheControl: "max-age=0, s-maxage=60"})
+	// Dynamic and personal data: never in a shared cache.
+	origin.Put("/api/time", Asset{Body: []byte("12:00:00"), ContentType: "text/plain", CacheControl: "no-store"})
+	origin.Put("/account", Asset{Body: []byte("Alice's account"), ContentType: "text/plain", CacheControl: "private, max-age=600"})
+	// Weather: fresh for a second, then served stale for up to 30s while
+	// the edge refreshes it in the background.
+	origin.Put("/weather", Asset{Body: []byte("Sunny"), ContentType: "text/plain", CacheControl: "max-age=1, stale-while-revalidate=30"})
+	origin.Put("/video.mp4", Asset{Body: []byte("VIDEO_DATA"), ContentType: "video/mp4", CacheControl: "max-age=3600"})
+	// A 3 MiB download, cached at the edge chunk by chunk.
+	origin.Put("/downloads/movie.mp4", Asset{Body: movie, ContentType: "video/mp4", CacheControl: "public, max-age=86400"})
+	// One variant per language.
+	origin.Put("/greeting", Asset{
+		Body:         []byte("Hello"),
+		ContentType:  "text/plain",
+		CacheControl: "max-age=3600",
+		Vary:         "Accept-Language",
+		Variants:     map[string][]byte{"fr": []byte("Bonjour"), "de": []byte("Hallo")},
+	})
+	return origin
 }
 
-func (s *OriginServer) Fetch(filename string) (string, bool) {
-	fmt.Printf("   [Origin Server] Fetching '%s' from disk...\n", filename)
-	// Simulate the latency of traveling across the world (e.g., NYC to Sydney)
-	time.Sleep(500 * time.Millisecond)
-	
-	data, ok := s.content[filename]
-	return data, ok
+func main() {
+	serve := flag.Bool("serve", false, "run the origin and the edge as real servers until interrupted")
+	originAddr := flag.String("origin-addr", ":8090", "origin address with -serve")
+	edgeAddr := flag.String("edge-addr", ":8080", "edge address with -serve")
+	flag.Parse()
+	logRequests.Store(true)
+
+	if *serve {
+		runServers(*originAddr, *edgeAddr)
+		return
+	}
+
+	// Setup the world: both servers listen on loopback ports.
+	origin := newOrigin()
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+	originURL, _ := url.Parse(originServer.URL)
+	edgeServer := httptest.NewServer(NewEdgeServer("sydney", originURL, edgeConfig))
+	defer edgeServer.Close()
+
+	// The "browser" in Sydney: a plain client without a cache of its own.
+	get := func(path string, headers ...string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, edgeServer.URL+path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("   <- %d %q X-Cache=%s Age=%s Cache-Control=%q (%v)\n",
+			resp.StatusCode, body, resp.Header.Get("X-Cache"), resp.Header.Get("Age"),
+			resp.Header.Get("Cache-Control"), time.Since(start).Round(time.Millisecond))
+		return resp
+	}
+
+	fmt.Println("--- Request 1 (First visit) ---")
+	first := get("/logo.png")
+
+	fmt.Println("\n--- Request 2 (Refresh page) ---")
+	get("/logo.png")
+
+	fmt.Println("\n--- Browser revalidates its own copy: 304 straight from the edge ---")
+	get("/logo.png", "If-None-Match", first.Header.Get("ETag"))
+
+	fmt.Println("\n--- Short max-age: once stale, the edge revalidates with the origin ---")
+	get("/index.html")
+	time.Sleep(1100 * time.Millisecond)
+	get("/index.html")
+
+	fmt.Println("\n--- s-maxage: the edge caches what browsers may not ---")
+	get("/news")
+	get("/news")
+
+	fmt.Println("\n--- no-store and private: never kept at the edge ---")
+	get("/api/time")
+	get("/api/time")
+	get("/account")
+
+	fmt.Println("\n--- Vary: Accept-Language keeps one copy per language ---")
+	get("/greeting", "Accept-Language", "en")
+	get("/greeting", "Accept-Language", "fr")
+	get("/greeting", "Accept-Language", "en")
+
+	fmt.Println("\n--- Unknown files: the 404 is cached too ---")
+	get("/missing.css")
+	get("/missing.css")
+
+	fmt.Println("\n--- stale-while-revalidate: no client waits for the refresh ---")
+	get("/weather")
+	time.Sleep(1100 * time.Millisecond)
+	origin.Put("/weather", Asset{Body: []byte("Rainy"), ContentType: "text/plain", CacheControl: "max-age=1, stale-while-revalidate=30"})
+	get("/weather")
+	time.Sleep(600 * time.Millisecond) // The background refresh completes
+	get("/weather")
+
+	fmt.Println("\n--- Request collapsing: 20 concurrent misses, one origin fetch ---")
+	before := origin.Requests()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(edgeServer.URL + "/video.mp4")
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Printf("   20 clients -> %d origin request(s)\n", origin.Requests()-before)
+
+	fmt.Println("\n--- stale-if-error: the origin is down ---")
+	origin.SetFailing(true)
+	time.Sleep(1100 * time.Millisecond) // Let /index.html go stale
+	get("/index.html")                  // Stale copy instead of the 503
+	get("/never-cached.html")           // Nothing to fall back on
+	origin.SetFailing(false)
+
+	demoRanges(origin, edgeServer.URL)
+
+	fmt.Printf("\nOrigin handled %d requests\n", origin.Requests())
+
+	demoStorage()
+	demoTopology()
 }
 
-// EdgeServer simulates a CDN node in Sydney.
-// It is "close" to the user but starts empty.
-type EdgeServer struct {
-	origin *OriginServer
-	cache  map[string]string
+// demoRanges plays a video the way a player does: a range at a time,
+// seeking around, with the edge fetching only the chunks it needs.
+func demoRanges(origin *OriginServer, edgeURL string) {
+	fetch := func(path, rng string) []byte {
+		req, _ := http.NewRequest(http.MethodGet, edgeURL+path, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		before := origin.Requests()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Printf("   <- %d %d bytes X-Cache=%s Content-Range=%q Content-Type=%q, %d origin request(s)\n",
+			resp.StatusCode, len(body), resp.Header.Get("X-Cache"), resp.Header.Get("Content-Range"),
+			strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0], origin.Requests()-before)
+		return body
+	}
+
+	fmt.Println("\n--- Range requests: a 3 MiB video cached in 512 KiB chunks ---")
+	fmt.Println("Player starts at the beginning:")
+	start := fetch("/downloads/movie.mp4", "bytes=0-99999")
+	fmt.Println("Viewer seeks to the middle:")
+	middle := fetch("/downloads/movie.mp4", "bytes=1600000-1699999")
+	fmt.Println("Both places again, as one multipart request:")
+	fetch("/downloads/movie.mp4", "bytes=0-99,1600000-1600099")
+	fmt.Println("Someone downloads the whole file:")
+	whole := fetch("/downloads/movie.mp4", "")
+	fmt.Println("Last kilobyte, then a range past the end:")
+	fetch("/downloads/movie.mp4", "bytes=-1024")
+	fetch("/downloads/movie.mp4", "bytes=5000000-")
+	fmt.Printf("   Bytes match the origin: %v\n",
+		bytes.Equal(start, movie[:100000]) && bytes.Equal(middle, movie[1600000:1700000]) && bytes.Equal(whole, movie))
+
+	fmt.Println("Small files are cached whole; ranges are cut from the cached copy:")
+	fetch("/logo.png", "bytes=0-5")
 }
 
-func (s *EdgeServer) GetFile(filename string) string {
-	fmt.Printf("[Edge Server] Request for '%s'...\n", filename)
+// demoStorage shows cache keys being normalized, then runs a crawler past
+// an edge with 64 KiB of memory and a disk tier, with and without
+// admission control.
+func demoStorage() {
+	origin := NewOriginServer(50 * time.Millisecond)
+	page := bytes.Repeat([]byte("<p>article</p>"), 8<<10/14) // About 8 KiB
+	for i := range 22 {
+		origin.Put(fmt.Sprintf("/articles/%d", i), Asset{Body: page, ContentType: "text/html", CacheControl: "max-age=3600"})
+	}
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+	originURL, _ := url.Parse(originServer.URL)
 
-	// 1. Check local cache
-	if data, ok := s.cache[filename]; ok {
-		fmt.Println("   -> HIT! Serving from Edge cache (Fast).")
-		return data
+	newEdge := func(admission bool) (*EdgeServer, *httptest.Server) {
+		config := EdgeConfig{
+			MemoryBytes:   64 << 10,
+			DiskDir:       must(os.MkdirTemp("", "cdn-disk-")),
+			DiskBytes:     128 << 10,
+			Admission:     admission,
+			IgnoredParams: []string{"utm_*", "fbclid"},
+		}
+		edge := NewEdgeServer("sydney", originURL, config)
+		return edge, httptest.NewServer(edge)
+	}
+	get := func(server *httptest.Server, host, path string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
 	}
 
-	// 2. If missing, fetch from Origin
-	fmt.Println("   -> MISS. Fetching from Origin (Slow)...")
-	data, found := s.origin.Fetch(filename)
-	if !found {
-		return "404 Not Found"
+	fmt.Println("\n--- Cache keys: host case, parameter order and tracking tags are ignored ---")
+	edge, server := newEdge(true)
+	for _, u := range []struct{ host, path string }{
+		{"news.example.com", "/articles/1?page=2&lang=en"},
+		{"NEWS.example.com", "/articles/1?lang=en&page=2"},
+		{"news.example.com", "/articles/1?page=2&utm_source=newsletter&lang=en&fbclid=abc"},
+		{"news.example.com", "/articles/1?page=3&lang=en"},
+	} {
+		resp := get(server, u.host, u.path)
+		fmt.Printf("   %-62s -> %s\n", u.host+u.path, resp.Header.Get("X-Cache"))
 	}
+	server.Close()
+	os.RemoveAll(edge.config.DiskDir)
+
+	logRequests.Store(false)
+	defer logRequests.Store(true)
+	for _, admission := range []bool{false, true} {
+		fmt.Printf("\n--- 64 KiB memory, 128 KiB disk, admission control %v ---\n", admission)
+		edge, server := newEdge(admission)
 
-	// 3. Store in local cache for next time
-	s.cache[filename] = data
-	return data
+		// Six popular articles, read over and over: they fill most of memory.
+		for range 3 {
+			for i := range 6 {
+				get(server, "", fmt.Sprintf("/articles/%d", i))
+			}
+		}
+		// A crawler reads sixteen more articles once each.
+		for i := 6; i < 22; i++ {
+			get(server, "", fmt.Sprintf("/articles/%d", i))
+		}
+		tiers := make(map[string]int)
+		for i := range 6 {
+			resp := get(server, "", fmt.Sprintf("/articles/%d", i))
+			tiers[resp.Header.Get("X-Cache")+" "+resp.Header.Get("X-Cache-Tier")]++
+		}
+		st := edge.Storage()
+		fmt.Printf("   Popular articles after the crawl: %v\n", tiers)
+		fmt.Printf("   Memory %d KiB in %d objects, disk %d KiB in %d objects\n",
+			st.MemoryBytes>>10, st.MemoryObjects, st.DiskBytes>>10, st.DiskObjects)
+		fmt.Printf("   Demoted %d, promoted %d, evicted %d, rejected %d\n", st.Demoted, st.Promoted, st.Evicted, st.Rejected)
+
+		server.Close()
+		os.RemoveAll(edge.config.DiskDir)
+	}
 }
 
-func main() {
-	// Setup the world
-	origin := &OriginServer{
-		content: map[string]string{
-			"index.html": "<html>...</html>",
-			"logo.png":   "BINARY_IMAGE_DATA",
-		},
+// must returns v, exiting if err is set.
+func must[T any](v T, err error) T {
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
+	return v
+}
 
-	edge := &EdgeServer{
-		origin: origin,
-		cache:  make(map[string]string),
+var (
+	originLocation = Location{"New York (origin)", 40.71, -74.01}
+	shieldLocation = Location{"Ashburn (shield)", 39.04, -77.49}
+	edgeLocations  = []Location{
+		{"Sydney", -33.87, 151.21},
+		{"Tokyo", 35.68, 139.69},
+		{"London", 51.51, -0.13},
+		{"Sao Paulo", -23.55, -46.63},
+		{"Dallas", 32.78, -96.80},
+	}
+	clientLocations = []Location{
+		{"Melbourne", -37.81, 144.96},
+		{"Osaka", 34.69, 135.50},
+		{"Paris", 48.86, 2.35},
+		{"Buenos Aires", -34.60, -58.38},
+		{"Chicago", 41.88, -87.63},
 	}
+)
 
-	// --- User in Sydney requests a file ---
-	
-	fmt.Println("--- Request 1 (First visit) ---")
-	start := time.Now()
-	edge.GetFile("logo.png")
-	fmt.Printf("Total time: %v\n\n", time.Since(start))
-
-	fmt.Println("--- Request 2 (Refresh page) ---")
-	start = time.Now()
-	edge.GetFile("logo.png")
-	fmt.Printf("Total time: %v\n", time.Since(start))
+// topology is a running CDN: an origin, an optional shield, and edges
+// behind a geo router.
+type topology struct {
+	origin  *OriginServer
+	router  *GeoRouter
+	purger  *Purger
+	servers map[string]*httptest.Server // By location name
+	shields []string                    // Admin API base URLs
+	edges   []string
+}
+
+// productPages are the URLs that show product 1.
+var productPages = []string{"/products/1", "/search?q=shoes", "/deals"}
+
+// putProducts publishes the pages that show product 1's price. Each is
+// tagged with the surrogate key "product-1" so one purge can refresh them all.
+func putProducts(origin *OriginServer, price string) {
+	for _, page := range productPages {
+		path, _, _ := strings.Cut(page, "?")
+		origin.Put(path, Asset{
+			Body:         []byte("Running shoes: " + price),
+			ContentType:  "text/html",
+			CacheControl: "public, max-age=86400",
+			SurrogateKey: "product-1 html",
+		})
+	}
+}
+
+// newTopology starts every server on a loopback port. Each edge fetches
+// from the shield if there is one, else straight from the origin, with the
+// round trip its distance implies.
+func newTopology(withShield bool) *topology {
+	t := &topology{origin: NewOriginServer(20 * time.Millisecond), servers: make(map[string]*httptest.Server)}
+	for i := 0; i < 200; i++ {
+		t.origin.Put(fmt.Sprintf("/assets/%d.js", i), Asset{
+			Body:         []byte(fmt.Sprintf("console.log(%d)", i)),
+			ContentType:  "text/javascript",
+			CacheControl: "public, max-age=3600",
+		})
+	}
+	putProducts(t.origin, "$10")
+	t.servers[originLocation.Name] = httptest.NewServer(t.origin)
+
+	upstream, upstreamLocation := t.servers[originLocation.Name].URL, originLocation
+	if withShield {
+		originURL, _ := url.Parse(upstream)
+		shield := NewEdgeServer("shield", originURL, EdgeConfig{UpstreamLatency: rtt(shieldLocation, originLocation)})
+		t.servers[shieldLocation.Name] = httptest.NewServer(edgeHandler(shield))
+		t.shields = append(t.shields, t.servers[shieldLocation.Name].URL+"/__admin")
+		upstream, upstreamLocation = t.servers[shieldLocation.Name].URL, shieldLocation
+	}
+
+	upstreamURL, _ := url.Parse(upstream)
+	var nodes []*EdgeNode
+	for _, loc := range edgeLocations {
+		edge := NewEdgeServer(loc.Name, upstreamURL, EdgeConfig{UpstreamLatency: rtt(loc, upstreamLocation)})
+		srv := httptest.NewServer(edgeHandler(edge))
+		t.servers[loc.Name] = srv
+		t.edges = append(t.edges, srv.URL+"/__admin")
+		nodes = append(nodes, NewEdgeNode(loc.Name, loc, srv.URL))
+	}
+	t.router = NewGeoRouter(nodes...)
+	t.purger = NewPurger(t.shields, t.edges)
+	return t
+}
+
+func (t *topology) Close() {
+	for _, srv := range t.servers {
+		srv.Close()
+	}
+}
+
+// simulate sends requests from every client location, each to the edge the
+// router picks, and prints latency percentiles per client region and how
+// much of the traffic never reached the origin.
+func (t *topology) simulate(requestsPerClient int) {
+	type sample struct {
+		client, edge string
+		took         time.Duration
+	}
+	var (
+		mu      sync.Mutex
+		samples []sample
+		wg      sync.WaitGroup
+	)
+	for i, client := range clientLocations {
+		// Popularity follows a Zipf distribution: a few assets get most hits.
+		zipf := rand.NewZipf(rand.New(rand.NewSource(int64(i))), 1.2, 1, 199)
+		paths := make(chan string, requestsPerClient)
+		for j := 0; j < requestsPerClient; j++ {
+			paths <- fmt.Sprintf("/assets/%d.js", zipf.Uint64())
+		}
+		close(paths)
+
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for path := range paths {
+					edge, err := t.router.Route(client)
+					if err != nil {
+						continue
+					}
+					start := time.Now()
+					time.Sleep(rtt(client, edge.Location)) // The client's own round trip
+					resp, err := http.Get(edge.URL + path)
+					if err != nil {
+						continue
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+
+					mu.Lock()
+					samples = append(samples, sample{client.Name, edge.Name, time.Since(start)})
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	fmt.Printf("   %-13s %-10s %5s %8s %8s %8s\n", "client", "edge", "reqs", "p50", "p95", "p99")
+	for _, client := range clientLocations {
+		var took []time.Duration
+		edge := ""
+		for _, s := range samples {
+			if s.client == client.Name {
+				took = append(took, s.took)
+				edge = s.edge
+			}
+		}
+		st := latencyStats(took)
+		fmt.Printf("   %-13s %-10s %5d %8v %8v %8v\n", client.Name, edge, st.Count,
+			st.P50.Round(time.Millisecond), st.P95.Round(time.Millisecond), st.P99.Round(time.Millisecond))
+	}
+	offload := 1 - float64(t.origin.Requests())/float64(len(samples))
+	fmt.Printf("   Origin requests: %d of %d, offload ratio %.1f%%\n", t.origin.Requests(), len(samples), 100*offload)
+}
+
+// demoTopology compares a CDN with and without an origin shield, then
+// takes an edge down to show the router failing over.
+func demoTopology() {
+	logRequests.Store(false)
+	defer logRequests.Store(true)
+
+	fmt.Println("\n--- Multi-region CDN, edges straight to the origin ---")
+	direct := newTopology(false)
+	direct.simulate(100)
+	direct.Close()
+
+	fmt.Println("\n--- Multi-region CDN with an origin shield ---")
+	shielded := newTopology(true)
+	defer shielded.Close()
+	shielded.simulate(100)
+
+	fmt.Println("\n--- Failover: the Tokyo edge goes down ---")
+	osaka := clientLocations[1]
+	before, _ := shielded.router.Route(osaka)
+	shielded.servers["Tokyo"].Close()
+	shielded.router.CheckHealth()
+	after, _ := shielded.router.Route(osaka)
+	fmt.Printf("   Osaka was routed to %s, now to %s\n", before.Name, after.Name)
+
+	demoInvalidation()
+}
+
+// demoInvalidation changes a product's price at the origin and pushes the
+// change out to every edge with a surrogate-key purge, then shows a purge
+// by URL and a ban.
+func demoInvalidation() {
+	fmt.Println("\n--- Invalidation: surrogate keys, purge and ban across every edge ---")
+	t := newTopology(true)
+	defer t.Close()
+	ctx := context.Background()
+
+	// fetchAll warms (or checks) every edge with the product pages.
+	fetchAll := func() {
+		for _, loc := range edgeLocations {
+			var got []string
+			for _, path := range productPages {
+				resp, err := http.Get(t.servers[loc.Name].URL + path)
+				if err != nil {
+					fmt.Println("Error:", err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				got = append(got, fmt.Sprintf("%s=%s(%s)", path, strings.TrimPrefix(string(body), "Running shoes: "), resp.Header.Get("X-Cache")))
+			}
+			fmt.Printf("   %-10s %s\n", loc.Name, strings.Join(got, " "))
+		}
+	}
+	report := func(what string, results []InvalidationResult, err error) {
+		removed := 0
+		for _, r := range results {
+			removed += r.Removed
+		}
+		fmt.Printf("   %s: %d nodes confirmed, %d objects removed, err=%v\n", what, len(results), removed, err)
+	}
+
+	fetchAll()
+	putProducts(t.origin, "$8") // The price drops
+	results, err := t.purger.PurgeTag(ctx, "product-1")
+	report("Purge tag product-1", results, err)
+	fetchAll()
+
+	results, err = t.purger.Purge(ctx, "/deals")
+	report("Purge /deals", results, err)
+	results, err = t.purger.Ban(ctx, "/search*")
+	report("Ban /search*", results, err)
+
+	// An edge that is down cannot confirm: the purge reports it.
+	t.servers["London"].Close()
+	_, err = t.purger.PurgeTag(ctx, "html")
+	fmt.Printf("   Purge tag html with London down: %v\n", err)
+}
+
+// runServers serves the demo origin and an edge in front of it, so browser
+// cache semantics can be tested by hand:
+//
+//	curl -i localhost:8080/index.html
+//	curl -i -H 'If-None-Match: "<etag>"' localhost:8080/logo.png
+func runServers(originAddr, edgeAddr string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	originURL, err := url.Parse("http://" + localAddr(originAddr))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	servers := []*http.Server{
+		{Addr: originAddr, Handler: newOrigin()},
+		{Addr: edgeAddr, Handler: NewEdgeServer("local", originURL, edgeConfig)},
+	}
+	for _, srv := range servers {
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Println("Error:", err)
+				stop()
+			}
+		}()
+	}
+	fmt.Printf("Origin on %s, edge on %s (try: curl -i http://%s/index.html)\n", originAddr, edgeAddr, localAddr(edgeAddr))
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(shutdownCtx)
+	}
+}
+
+// localAddr turns ":8080" into "localhost:8080".
+func localAddr(addr string) string {
+	if len(addr) > 0 && addr[0] == ':' {
+		return "localhost" + addr
+	}
+	return addr
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Asset is a file the origin serves, with the caching policy it advertises
+// to the edges and browsers in front of it.
+type Asset struct {
+	Body         []byte
+	ContentType  string
+	CacheControl string // Sent as is; empty sends no Cache-Control header
+	SurrogateKey string // Space-separated tags the CDN can purge by
+	ModTime      time.Time
+
+	// Vary names a request header that selects between Variants, keyed by
+	// that header's value. Requests without a matching variant get Body.
+	Vary     string
+	Variants map[string][]byte
+}
+
+// OriginServer simulates our main server in New York.
+// It has all the data but is "far away" (slow to access).
+type OriginServer struct {
+	latency  time.Duration
+	mu       sync.RWMutex
+	assets   map[string]*Asset
+	requests atomic.Int64
+	failing  atomic.Bool
+}
+
+func NewOriginServer(latency time.Duration) *OriginServer {
+	return &OriginServer{latency: latency, assets: make(map[string]*Asset)}
+}
+
+// Put publishes or replaces the asset at path.
+func (s *OriginServer) Put(path string, a Asset) {
+	if a.ModTime.IsZero() {
+		a.ModTime = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assets[path] = &a
+}
+
+// SetFailing makes the origin answer every request with 503, as during an
+// outage or a bad deploy.
+func (s *OriginServer) SetFailing(failing bool) {
+	s.failing.Store(failing)
+}
+
+// Requests returns how many requests reached the origin.
+func (s *OriginServer) Requests() int64 {
+	return s.requests.Load()
+}
+
+// ServeHTTP serves an asset with its ETag and Last-Modified validators.
+// http.ServeContent answers conditional requests (If-None-Match,
+// If-Modified-Since) with 304 Not Modified and handles Range requests.
+func (s *OriginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	if logRequests.Load() {
+		if rng := r.Header.Get("Range"); rng != "" {
+			fmt.Printf("   [Origin Server] %s %s (%s)\n", r.Method, r.URL.Path, rng)
+		} else {
+			fmt.Printf("   [Origin Server] %s %s\n", r.Method, r.URL.Path)
+		}
+	}
+	// Simulate the latency of traveling across the world (e.g., NYC to Sydney)
+	time.Sleep(s.latency)
+
+	if s.failing.Load() {
+		http.Error(w, "origin unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	s.mu.RLock()
+	a, ok := s.assets[r.URL.Path]
+	s.mu.RUnlock()
+	if !ok {
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.NotFound(w, r)
+		return
+	}
+
+	body := a.Body
+	if a.Vary != "" {
+		w.Header().Set("Vary", a.Vary)
+		if v, ok := a.Variants[r.Header.Get(a.Vary)]; ok {
+			body = v
+		}
+	}
+	if a.CacheControl != "" {
+		w.Header().Set("Cache-Control", a.CacheControl)
+	}
+	if a.ContentType != "" {
+		w.Header().Set("Content-Type", a.ContentType)
+	}
+	if a.SurrogateKey != "" {
+		w.Header().Set("Surrogate-Key", a.SurrogateKey)
+	}
+	w.Header().Set("ETag", etagOf(body))
+	http.ServeContent(w, r, r.URL.Path, a.ModTime, bytes.NewReader(body))
+}
+
+// etagOf returns a strong validator derived from the content.
+func etagOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
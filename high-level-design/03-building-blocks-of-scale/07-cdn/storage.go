@@ -0,0 +1,299 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/maphash"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/glob"
+)
+
+// The edge keeps its index (URLs, headers, freshness) in memory and the
+// bodies in two tiers, as Varnish and Traffic Server do:
+//   - memory: up to MemoryBytes of the most recently used bodies;
+//   - disk: up to DiskBytes of bodies pushed out of memory, read back (and
+//     promoted to memory) when they are requested again.
+//
+// A body that leaves both tiers takes its index entry with it. Whole
+// responses and the chunks of large objects are stored alike.
+//
+// With Admission on, a new body may only push others out of memory if its
+// URL has been requested more often than theirs, as in TinyLFU: a crawler
+// walking through the long tail then cannot flush the popular pages.
+
+// tier is one level of storage with a byte budget.
+type tier struct {
+	name  string
+	limit int64      // Bytes; 0 means unlimited
+	used  int64      // Bytes
+	lru   *list.List // Of *blob; front is most recently used
+}
+
+func newTier(name string, limit int64) *tier {
+	return &tier{name: name, limit: limit, lru: list.New()}
+}
+
+func (t *tier) push(b *blob) {
+	b.tier = t
+	b.elem = t.lru.PushFront(b)
+	t.used += b.size
+}
+
+func (t *tier) remove(b *blob) {
+	t.lru.Remove(b.elem)
+	t.used -= b.size
+	b.tier, b.elem = nil, nil
+}
+
+// blob is a stored body: a whole response or a chunk of a large object.
+type blob struct {
+	data    []byte // nil while on disk
+	size    int64
+	key     string // URL it belongs to, whose popularity decides admission
+	path    string // File on disk, while in the disk tier
+	tier    *tier  // nil until stored, and for bodies that were not admitted
+	elem    *list.Element
+	dropped func() // Removes the index entry; called when both tiers let go
+}
+
+func newBlob(key string, data []byte) *blob {
+	return &blob{data: data, size: int64(len(data)), key: key}
+}
+
+// StorageStats describes the edge's cache tiers.
+type StorageStats struct {
+	MemoryBytes, MemoryObjects int64
+	DiskBytes, DiskObjects     int64
+	Demoted, Promoted          int64 // Bodies moved to disk and back
+	Evicted                    int64 // Bodies that left both tiers
+	Rejected                   int64 // Bodies refused by admission control
+}
+
+// Storage returns the current state of the cache tiers.
+func (s *EdgeServer) Storage() StorageStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.storage
+	st.MemoryBytes, st.MemoryObjects = s.memory.used, int64(s.memory.lru.Len())
+	st.DiskBytes, st.DiskObjects = s.disk.used, int64(s.disk.lru.Len())
+	return st
+}
+
+// admitLocked stores a new body in memory, moving the least recently used
+// bodies to disk to make room. It reports false if the body is too big for
+// the tier or loses the admission contest. Caller holds s.mu.
+func (s *EdgeServer) admitLocked(b *blob) bool {
+	mem := s.memory
+	if mem.limit > 0 && b.size > mem.limit {
+		s.storage.Rejected++
+		return false
+	}
+	// Find who would have to go, and let the newcomer in only if it is
+	// more popular than each of them.
+	var victims []*blob
+	free := mem.limit - mem.used
+	for e := mem.lru.Back(); mem.limit > 0 && free < b.size && e != nil; e = e.Prev() {
+		victim := e.Value.(*blob)
+		if s.config.Admission && victim.key != b.key && s.sketch.estimate(b.key) <= s.sketch.estimate(victim.key) {
+			s.storage.Rejected++
+			return false
+		}
+		victims = append(victims, victim)
+		free += victim.size
+	}
+	for _, victim := range victims {
+		s.demoteLocked(victim)
+	}
+	mem.push(b)
+	return true
+}
+
+// demoteLocked moves a body from memory to disk, or drops it if there is
+// no disk tier or it cannot be written. Caller holds s.mu.
+func (s *EdgeServer) demoteLocked(b *blob) {
+	s.memory.remove(b)
+	disk := s.disk
+	if s.config.DiskDir == "" || (disk.limit > 0 && b.size > disk.limit) {
+		s.dropLocked(b)
+		return
+	}
+	for disk.limit > 0 && disk.used+b.size > disk.limit {
+		oldest := disk.lru.Back().Value.(*blob)
+		disk.remove(oldest)
+		s.dropLocked(oldest)
+	}
+	if b.path == "" {
+		b.path = s.blobPath()
+		if err := os.WriteFile(b.path, b.data, 0o644); err != nil {
+			s.dropLocked(b)
+			return
+		}
+	}
+	b.data = nil
+	disk.push(b)
+	s.storage.Demoted++
+}
+
+// dropLocked discards a body that no tier holds any more, along with the
+// index entry that points at it. Caller holds s.mu.
+func (s *EdgeServer) dropLocked(b *blob) {
+	s.storage.Evicted++
+	s.freeLocked(b)
+	if b.dropped != nil {
+		b.dropped()
+	}
+}
+
+// freeLocked takes a body out of storage, when its index entry is removed
+// or replaced. Caller holds s.mu.
+func (s *EdgeServer) freeLocked(b *blob) {
+	if b.tier != nil {
+		b.tier.remove(b)
+	}
+	if b.path != "" {
+		os.Remove(b.path)
+		b.path = ""
+	}
+}
+
+// readLocked returns a stored body and the tier it was found in, promoting
+// bodies read from disk back to memory if admission allows. It reports
+// false if the body is gone. Caller holds s.mu.
+func (s *EdgeServer) readLocked(b *blob) ([]byte, string, bool) {
+	switch b.tier {
+	case nil:
+		return b.data, "", b.data != nil
+	case s.memory:
+		s.memory.lru.MoveToFront(b.elem)
+		return b.data, s.memory.name, true
+	}
+
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		s.disk.remove(b)
+		s.dropLocked(b)
+		return nil, "", false
+	}
+	s.disk.remove(b)
+	b.data = data
+	if s.admitLocked(b) {
+		// The disk tier no longer counts the body, so its file goes too:
+		// DiskBytes bounds what is actually on disk.
+		os.Remove(b.path)
+		b.path = ""
+		s.storage.Promoted++
+	} else {
+		b.data = nil
+		s.disk.push(b)
+	}
+	return data, s.disk.name, true
+}
+
+// blobPath names a new file in the disk tier.
+func (s *EdgeServer) blobPath() string {
+	s.blobs++
+	sum := sha256.Sum256([]byte(s.name + "/" + strconv.FormatUint(s.blobs, 10)))
+	return filepath.Join(s.config.DiskDir, hex.EncodeToString(sum[:8]))
+}
+
+// cacheKey normalizes the request URL into the key its object is cached
+// under, so that URLs differing only in ways the origin ignores share one
+// copy: the host is lowercased and loses its default port, query
+// parameters are sorted, and IgnoredParams (tracking tags and the like)
+// are dropped. Variants selected by Vary share a key.
+func (s *EdgeServer) cacheKey(r *http.Request) string {
+	return normalizeHost(r.Host) + s.normalizePath(r.URL)
+}
+
+// normalizeHost lowercases host and drops the default port, the host part
+// of a cache key.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ":80")
+}
+
+// normalizePath returns the path and normalized query of u, which is the
+// part of a cache key that purges and bans starting with "/" match.
+func (s *EdgeServer) normalizePath(u *url.URL) string {
+	query := s.normalizeQuery(u)
+	if query == "" {
+		return u.EscapedPath()
+	}
+	return u.EscapedPath() + "?" + query
+}
+
+// normalizeQuery drops IgnoredParams and sorts the rest by name.
+func (s *EdgeServer) normalizeQuery(u *url.URL) string {
+	q := u.Query()
+	for name := range q {
+		for _, pattern := range s.config.IgnoredParams {
+			if glob.Match(pattern, name) {
+				q.Del(name)
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// keyPath strips the host from a cache key.
+func keyPath(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[i:]
+	}
+	return key
+}
+
+// frequencySketch estimates how often each URL was requested in a few
+// bytes per URL: a count-min sketch of 4-bit counters, halved every so
+// often so that old popularity fades.
+type frequencySketch struct {
+	rows       [4][]uint8
+	seeds      [4]maphash.Seed
+	mask       uint64
+	additions  int
+	resetAfter int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+	f := &frequencySketch{mask: uint64(size - 1), resetAfter: 10 * size}
+	for i := range f.rows {
+		f.rows[i] = make([]uint8, size)
+		f.seeds[i] = maphash.MakeSeed()
+	}
+	return f
+}
+
+func (f *frequencySketch) increment(key string) {
+	for i := range f.rows {
+		if c := &f.rows[i][maphash.String(f.seeds[i], key)&f.mask]; *c < 15 {
+			*c++
+		}
+	}
+	f.additions++
+	if f.additions >= f.resetAfter {
+		f.additions = 0
+		for i := range f.rows {
+			for j := range f.rows[i] {
+				f.rows[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (f *frequencySketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i := range f.rows {
+		est = min(est, f.rows[i][maphash.String(f.seeds[i], key)&f.mask])
+	}
+	return est
+}
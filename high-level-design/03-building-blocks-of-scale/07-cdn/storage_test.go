@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pages is an origin serving a 100-byte page for every path.
+var pages = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Write([]byte(strings.Repeat(r.URL.Path[1:2], 100)))
+})
+
+// expectCache requests path and checks the X-Cache and X-Cache-Tier labels.
+func (c *testCDN) expectCache(t *testing.T, path, label, tier string) {
+	t.Helper()
+	resp, body := c.get(t, path)
+	if got := resp.Header.Get("X-Cache"); got != label {
+		t.Errorf("GET %s: X-Cache = %q, want %q", path, got, label)
+	}
+	if got := resp.Header.Get("X-Cache-Tier"); got != tier {
+		t.Errorf("GET %s: X-Cache-Tier = %q, want %q", path, got, tier)
+	}
+	if len(body) != 100 {
+		t.Errorf("GET %s: %d bytes, want 100", path, len(body))
+	}
+}
+
+// diskFiles counts the files in the disk tier's directory.
+func diskFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestStorageDemotesToDiskAndPromotesBack(t *testing.T) {
+	dir := t.TempDir()
+	cdn := newTestCDN(t, EdgeConfig{MemoryBytes: 250, DiskDir: dir, DiskBytes: 1000}, pages)
+
+	// Memory holds two pages: the third pushes the oldest to disk.
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cdn.expectCache(t, path, "MISS", "")
+	}
+	st := cdn.edge.Storage()
+	if st.MemoryObjects != 2 || st.DiskObjects != 1 || st.Demoted != 1 {
+		t.Fatalf("after 3 pages: %+v, want 2 in memory and 1 demoted to disk", st)
+	}
+	if n := diskFiles(t, dir); n != 1 {
+		t.Fatalf("%d files on disk, want 1", n)
+	}
+
+	// Reading /a from disk promotes it, and demotes /b, now the oldest.
+	cdn.expectCache(t, "/a", "HIT", "disk")
+	cdn.expectCache(t, "/a", "HIT", "memory")
+	cdn.expectCache(t, "/b", "HIT", "disk")
+	st = cdn.edge.Storage()
+	if st.Promoted != 2 || st.Demoted != 3 || st.MemoryObjects != 2 || st.DiskObjects != 1 {
+		t.Errorf("after reading back: %+v, want 2 promoted, 3 demoted", st)
+	}
+	// A promoted body's file is deleted: the disk holds what it counts.
+	if n := diskFiles(t, dir); int64(n) != st.DiskObjects {
+		t.Errorf("%d files on disk for %d objects in the disk tier", n, st.DiskObjects)
+	}
+	if hits := cdn.originHits.Load(); hits != 3 {
+		t.Errorf("origin got %d requests, want 3", hits)
+	}
+}
+
+func TestStorageEvictsFromBothTiers(t *testing.T) {
+	dir := t.TempDir()
+	cdn := newTestCDN(t, EdgeConfig{MemoryBytes: 100, DiskDir: dir, DiskBytes: 100}, pages)
+
+	// /a goes to disk, then out of the disk for /b.
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cdn.expectCache(t, path, "MISS", "")
+	}
+	st := cdn.edge.Storage()
+	if st.Evicted != 1 || st.MemoryObjects != 1 || st.DiskObjects != 1 {
+		t.Fatalf("after 3 pages: %+v, want 1 evicted", st)
+	}
+	if n := diskFiles(t, dir); n != 1 {
+		t.Errorf("%d files on disk, want 1", n)
+	}
+	// The evicted page took its index entry with it.
+	cdn.expectCache(t, "/a", "MISS", "")
+}
+
+func TestStorageAdmissionRejectsOneHitWonders(t *testing.T) {
+	cdn := newTestCDN(t, EdgeConfig{MemoryBytes: 200, Admission: true}, pages)
+
+	// Two popular pages fill memory.
+	for range 3 {
+		cdn.get(t, "/a")
+		cdn.get(t, "/b")
+	}
+	// A page requested once may not push either of them out.
+	cdn.expectCache(t, "/c", "MISS", "")
+	st := cdn.edge.Storage()
+	if st.Rejected != 1 || st.MemoryObjects != 2 {
+		t.Fatalf("after a one-hit wonder: %+v, want it rejected", st)
+	}
+	cdn.expectCache(t, "/a", "HIT", "memory")
+	cdn.expectCache(t, "/b", "HIT", "memory")
+
+	// Once it is requested more often than the least recently used page,
+	// it gets in.
+	for range 4 {
+		cdn.get(t, "/c")
+	}
+	cdn.expectCache(t, "/c", "HIT", "memory")
+
+	// Without admission, the first request is enough.
+	plain := newTestCDN(t, EdgeConfig{MemoryBytes: 200}, pages)
+	for range 3 {
+		plain.get(t, "/a")
+		plain.get(t, "/b")
+	}
+	plain.get(t, "/c")
+	plain.expectCache(t, "/c", "HIT", "memory")
+}
+
+func TestCacheKeyNormalization(t *testing.T) {
+	edge := NewEdgeServer("test", nil, EdgeConfig{IgnoredParams: []string{"utm_*", "fbclid"}})
+	for _, tc := range []struct {
+		host, target, want string
+	}{
+		{"example.com", "/p", "example.com/p"},
+		{"EXAMPLE.com", "/p", "example.com/p"},
+		{"example.com:80", "/p", "example.com/p"},
+		{"example.com:8080", "/p", "example.com:8080/p"},
+		{"example.com", "/p?b=2&a=1", "example.com/p?a=1&b=2"},
+		{"example.com", "/p?a=1&utm_source=x&b=2&fbclid=y", "example.com/p?a=1&b=2"},
+		{"example.com", "/p?utm_source=x", "example.com/p"},
+		{"example.com", "/P", "example.com/P"}, // Paths are case-sensitive
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		r.Host = tc.host
+		if got := edge.cacheKey(r); got != tc.want {
+			t.Errorf("cacheKey(%s%s) = %q, want %q", tc.host, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestEquivalentURLsShareACachedCopy(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	cdn := newTestCDN(t, EdgeConfig{IgnoredParams: []string{"utm_*"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		pages(w, r)
+	}))
+
+	cdn.expectCache(t, "/p?b=2&a=1&utm_source=mail", "MISS", "")
+	cdn.get(t, "/p?a=1&b=2", "Host: EXAMPLE.com")
+	cdn.expectCache(t, "/p?a=1&utm_campaign=x&b=2", "HIT", "memory")
+	mu.Lock()
+	if !slices.Equal(queries, []string{"a=1&b=2", "a=1&b=2"}) {
+		t.Errorf("origin saw queries %q, want the normalized one for each host", queries)
+	}
+	mu.Unlock()
+
+	// The host is part of the key, case and default port aside.
+	resp, _ := cdn.get(t, "/p?b=2&a=1", "Host: example.com:80")
+	if got := resp.Header.Get("X-Cache"); got != "HIT" {
+		t.Errorf("example.com:80 after EXAMPLE.com: X-Cache = %q, want HIT", got)
+	}
+}
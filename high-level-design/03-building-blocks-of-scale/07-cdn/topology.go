@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Location is a point on the globe, for clients and data centres alike.
+type Location struct {
+	Name     string
+	Lat, Lon float64 // Degrees
+}
+
+// distanceKm is the great-circle distance between two locations.
+func distanceKm(a, b Location) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat, dLon := (b.Lat-a.Lat)*rad, (b.Lon-a.Lon)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// rtt estimates the network round trip between two locations. Light covers
+// about 200 km per millisecond in fibre, and routes are never straight, so
+// a round trip costs roughly 1 ms per 100 km, plus a little switching time.
+func rtt(a, b Location) time.Duration {
+	return 2*time.Millisecond + time.Duration(distanceKm(a, b)/100*float64(time.Millisecond))
+}
+
+// EdgeNode is an edge as the request router sees it: where it is, how to
+// reach it, and whether it answered its last health check.
+type EdgeNode struct {
+	Name     string
+	Location Location
+	URL      string
+	healthy  atomic.Bool
+}
+
+func NewEdgeNode(name string, loc Location, url string) *EdgeNode {
+	n := &EdgeNode{Name: name, Location: loc, URL: url}
+	n.healthy.Store(true)
+	return n
+}
+
+func (n *EdgeNode) Healthy() bool {
+	return n.healthy.Load()
+}
+
+// GeoRouter plays the part of a CDN's DNS: it answers each client with the
+// nearest edge that passed its last health check, the way GeoDNS or
+// latency-based routing would resolve cdn.example.com.
+type GeoRouter struct {
+	nodes  []*EdgeNode
+	client *http.Client
+}
+
+func NewGeoRouter(nodes ...*EdgeNode) *GeoRouter {
+	return &GeoRouter{nodes: nodes, client: &http.Client{Timeout: time.Second}}
+}
+
+var errNoHealthyEdge = errors.New("no healthy edge")
+
+// Route returns the nearest healthy edge to the client.
+func (g *GeoRouter) Route(client Location) (*EdgeNode, error) {
+	var best *EdgeNode
+	for _, n := range g.nodes {
+		if !n.Healthy() {
+			continue
+		}
+		if best == nil || distanceKm(client, n.Location) < distanceKm(client, best.Location) {
+			best = n
+		}
+	}
+	if best == nil {
+		return nil, errNoHealthyEdge
+	}
+	return best, nil
+}
+
+// CheckHealth probes every edge's /healthz concurrently.
+func (g *GeoRouter) CheckHealth() {
+	var wg sync.WaitGroup
+	for _, n := range g.nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := g.client.Get(n.URL + "/healthz")
+			healthy := err == nil && resp.StatusCode == http.StatusOK
+			if err == nil {
+				resp.Body.Close()
+			}
+			if n.healthy.Swap(healthy) != healthy {
+				fmt.Printf("[Router] Edge %s is now %s\n", n.Name, map[bool]string{true: "healthy", false: "down"}[healthy])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Run checks the edges' health at every interval until ctx is cancelled.
+func (g *GeoRouter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.CheckHealth()
+		}
+	}
+}
+
+// edgeHandler puts the router's health checks and the invalidation API in
+// front of an edge. A real CDN serves the admin API on a private network;
+// sharing the listener keeps the simulation small.
+func edgeHandler(edge *EdgeServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/__admin/", http.StripPrefix("/__admin", edge.AdminHandler()))
+	mux.Handle("/", edge)
+	return mux
+}
+
+// LatencyStats summarises a set of request latencies.
+type LatencyStats struct {
+	Count         int
+	P50, P95, P99 time.Duration
+}
+
+func latencyStats(samples []time.Duration) LatencyStats {
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return LatencyStats{Count: len(sorted), P50: at(0.50), P95: at(0.95), P99: at(0.99)}
+}
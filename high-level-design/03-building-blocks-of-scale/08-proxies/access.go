@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"krandheer.github.com/high-level-design/03-building-blocks-of-scale/internal/glob"
+)
+
+// Credentials are the users allowed to use the proxy, loaded from a file
+// with one "user:sha256-of-password-in-hex" line per user:
+//
+//	# Proxy users
+//	alice:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//
+// Unsalted SHA-256 keeps the demo free of dependencies; a real deployment
+// would store bcrypt or argon2 hashes.
+type Credentials struct {
+	hashes map[string][]byte // User -> SHA-256 of the password
+}
+
+// LoadCredentials reads a credentials file.
+func LoadCredentials(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Credentials{hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		sum, err := hex.DecodeString(hash)
+		if !ok || user == "" || err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: want user:sha256-hex", path, line)
+		}
+		c.hashes[user] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hashPassword returns the form of password stored in a credentials file.
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check reports whether password is user's, in constant time.
+func (c *Credentials) Check(user, password string) bool {
+	want, ok := c.hashes[user]
+	if !ok {
+		// Hash anyway so unknown users take as long as wrong passwords.
+		want = make([]byte, sha256.Size)
+	}
+	got := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(got[:], want) == 1 && ok
+}
+
+// authenticate checks the Proxy-Authorization header of r and returns the
+// user. The header uses the Basic scheme, as in Authorization.
+func (c *Credentials) authenticate(r *http.Request) (string, bool) {
+	// http.Request.BasicAuth only reads Authorization: borrow it.
+	probe := http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	user, password, ok := probe.BasicAuth()
+	if !ok || !c.Check(user, password) {
+		return user, false
+	}
+	return user, true
+}
+
+// AccessPolicy decides where clients may go through the proxy. For each
+// of hosts, CIDRs and ports, a match in the deny list refuses the request,
+// and a non-empty allow list refuses anything it does not match.
+//
+// Whatever the lists say, destinations in internal ranges (loopback,
+// private, link-local such as the cloud metadata service at
+// 169.254.169.254) are refused unless listed in AllowInternal, so the
+// proxy cannot be used to reach the network it runs in (SSRF).
+type AccessPolicy struct {
+	AllowHosts, DenyHosts []string // Patterns such as "*.example.com"
+	AllowCIDRs, DenyCIDRs []netip.Prefix
+	AllowPorts, DenyPorts []int
+	AllowInternal         []netip.Prefix
+}
+
+// internalRanges are the destinations refused by default.
+var internalRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("10.0.0.0/8"),     // Private
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),    // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"), // Link-local, cloud metadata
+	netip.MustParsePrefix("172.16.0.0/12"),  // Private
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("192.168.0.0/16"), // Private
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),    // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved, and broadcast
+	netip.MustParsePrefix("::/96"),          // Unspecified, loopback, IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use IPv4/IPv6 translation
+	netip.MustParsePrefix("fc00::/7"),       // Unique local
+	netip.MustParsePrefix("fe80::/10"),      // Link-local
+	netip.MustParsePrefix("ff00::/8"),       // Multicast
+}
+
+// embeddedIPv4 returns the IPv4 address inside an IPv6 address that
+// carries one to an IPv4 host: NAT64 (64:ff9b::a9fe:a9fe is
+// 169.254.169.254), 6to4 (2002:a9fe:a9fe::) or IPv4-mapped
+// (::ffff:169.254.169.254). Those are checked as the IPv4 address.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case addr.Is4In6():
+		return addr.Unmap(), true
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+// checkTarget applies the host and port rules to the requested host:port,
+// before anything is resolved or dialled. It returns why the target is
+// refused, or "".
+func (p AccessPolicy) checkTarget(host string, port int) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	matches := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool { return glob.Match(strings.ToLower(pattern), host) })
+	}
+	switch {
+	case slices.Contains(p.DenyPorts, port):
+		return "port " + strconv.Itoa(port) + " denied"
+	case len(p.AllowPorts) > 0 && !slices.Contains(p.AllowPorts, port):
+		return "port " + strconv.Itoa(port) + " not allowed"
+	case matches(p.DenyHosts):
+		return "host " + host + " denied"
+	case len(p.AllowHosts) > 0 && !matches(p.AllowHosts):
+		return "host " + host + " not allowed"
+	}
+	return ""
+}
+
+// checkAddr applies the CIDR rules and SSRF protection to the address
+// actually being connected to. It returns why it is refused, or "". An
+// IPv6 address that embeds an IPv4 one must pass the rules as both.
+func (p AccessPolicy) checkAddr(addr netip.Addr) string {
+	if v4, ok := embeddedIPv4(addr); ok {
+		if why := p.checkAddr(v4); why != "" || addr.Is4In6() {
+			return why
+		}
+	}
+	contains := func(prefixes []netip.Prefix) bool {
+		return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+	}
+	switch {
+	case contains(p.DenyCIDRs):
+		return "address " + addr.String() + " denied"
+	case len(p.AllowCIDRs) > 0 && !contains(p.AllowCIDRs):
+		return "address " + addr.String() + " not allowed"
+	case contains(internalRanges) && !contains(p.AllowInternal):
+		return "address " + addr.String() + " is internal"
+	}
+	return ""
+}
+
+// BlockedError is returned when the proxy refuses a destination.
+type BlockedError struct {
+	Reason string
+}
+
+func (e *BlockedError) Error() string {
+	return "destination blocked: " + e.Reason
+}
+
+// control is the dialer's Control hook. It runs after DNS resolution, on
+// the IP about to be connected to, so a hostname that resolves to an
+// internal address (or is re-pointed at one after a check, as in DNS
+// rebinding) is still refused.
+func (p AccessPolicy) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &BlockedError{Reason: "unparsable address " + address}
+	}
+	if why := p.checkAddr(ap.Addr()); why != "" {
+		return &BlockedError{Reason: why}
+	}
+	return nil
+}
+
+// splitTarget returns the host and port a request is for.
+func splitTarget(r *http.Request) (string, int, error) {
+	hostport := r.Host
+	if r.Method != http.MethodConnect {
+		hostport = r.URL.Host
+		if r.URL.Port() == "" {
+			port := "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+			hostport = net.JoinHostPort(r.URL.Hostname(), port)
+		}
+	}
+	host, portText, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("bad port %q", portText)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckTarget(t *testing.T) {
+	policy := AccessPolicy{
+		AllowHosts: []string{"*.example.com", "example.com"},
+		DenyHosts:  []string{"admin.example.com"},
+		DenyPorts:  []int{22},
+	}
+	for _, tc := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 80, ""},
+		{"www.example.com", 443, ""},
+		{"WWW.Example.COM.", 443, ""}, // Case and the trailing dot do not matter
+		{"admin.example.com", 443, "host admin.example.com denied"},
+		{"ADMIN.example.com", 443, "host admin.example.com denied"},
+		{"example.org", 80, "host example.org not allowed"},
+		{"www.example.com", 22, "port 22 denied"},
+	} {
+		if got := policy.checkTarget(tc.host, tc.port); got != tc.want {
+			t.Errorf("checkTarget(%q, %d) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+
+	ports := AccessPolicy{AllowPorts: []int{80, 443}}
+	if got := ports.checkTarget("example.com", 8080); got != "port 8080 not allowed" {
+		t.Errorf("port outside AllowPorts: got %q", got)
+	}
+	if got := (AccessPolicy{}).checkTarget("anything.test", 8080); got != "" {
+		t.Errorf("empty policy: got %q", got)
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	var open AccessPolicy
+	for _, tc := range []struct {
+		addr     string
+		internal bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"192.0.0.170", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::", true},
+		{"::1", true},
+		{"::a9fe:a9fe", true}, // IPv4-compatible
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"64:ff9b::a9fe:a9fe", true},  // NAT64 of 169.254.169.254
+		{"64:ff9b::7f00:1", true},     // NAT64 of 127.0.0.1
+		{"64:ff9b::5db8:d822", false}, // NAT64 of 93.184.216.34
+		{"64:ff9b:1::1", true},
+		{"2002:a9fe:a9fe::1", true}, // 6to4 of 169.254.169.254
+		{"2002:0a00:0001::1", true}, // 6to4 of 10.0.0.1
+		{"2002:5db8:d822::1", false},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+	} {
+		got := open.checkAddr(netip.MustParseAddr(tc.addr))
+		if (got != "") != tc.internal {
+			t.Errorf("checkAddr(%s) = %q, internal: want %v", tc.addr, got, tc.internal)
+		}
+	}
+}
+
+func TestCheckAddrLists(t *testing.T) {
+	policy := AccessPolicy{
+		AllowCIDRs:    []netip.Prefix{netip.MustParsePrefix("93.184.0.0/16"), netip.MustParsePrefix("127.0.0.0/8")},
+		DenyCIDRs:     []netip.Prefix{netip.MustParsePrefix("93.184.216.0/24")},
+		AllowInternal: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	}
+	for addr, want := range map[string]string{
+		"93.184.1.1":       "",
+		"93.184.216.34":    "address 93.184.216.34 denied",
+		"8.8.8.8":          "address 8.8.8.8 not allowed",
+		"127.0.0.1":        "", // Internal, but explicitly allowed
+		"::ffff:127.0.0.1": "",
+		"127.0.0.2":        "address 127.0.0.2 is internal",
+	} {
+		if got := policy.checkAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("checkAddr(%s) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestControlRefusesResolvedInternalAddress(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the target was reached")
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(target.URL, "http://"))
+
+	// "localhost" passes the host rules; it is refused once resolved.
+	p := NewForwardProxy("test-proxy", ProxyConfig{})
+	_, err := p.dialer.Dial("tcp", net.JoinHostPort("localhost", port))
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) {
+		t.Fatalf("dialling localhost: got %v, want a BlockedError", err)
+	}
+
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(must(url.Parse(proxy.URL)))}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://localhost:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET through the proxy: got %d, want 403", resp.StatusCode)
+	}
+
+	// CONNECT is checked the same way.
+	req, _ := http.NewRequest(http.MethodConnect, proxy.URL, nil)
+	req.Host = "localhost:" + port
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("CONNECT through the proxy: got %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Proxy-Authorization"); v != "" {
+			t.Errorf("target got Proxy-Authorization %q", v)
+		}
+	})
+	path := filepath.Join(t.TempDir(), "credentials")
+	os.WriteFile(path, []byte("# users\nalice:"+hashPassword("wonderland")+"\n"), 0o600)
+	creds, err := LoadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, _ := newTestProxy(t, ProxyConfig{Credentials: creds})
+
+	for _, tc := range []struct {
+		name string
+		user *url.Userinfo
+		want int
+	}{
+		{"no credentials", nil, http.StatusProxyAuthRequired},
+		{"wrong password", url.UserPassword("alice", "guess"), http.StatusProxyAuthRequired},
+		{"unknown user", url.UserPassword("bob", "wonderland"), http.StatusProxyAuthRequired},
+		{"valid", url.UserPassword("alice", "wonderland"), http.StatusOK},
+	} {
+		proxyURL := must(url.Parse(proxy.URL))
+		proxyURL.User = tc.user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+		if tc.want == http.StatusProxyAuthRequired && !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), "Basic ") {
+			t.Errorf("%s: Proxy-Authenticate %q, want a Basic challenge", tc.name, resp.Header.Get("Proxy-Authenticate"))
+		}
+	}
+}
+
+func TestLoadCredentialsRejectsBadLines(t *testing.T) {
+	for _, content := range []string{
+		"alice\n",
+		"alice:nothex\n",
+		"alice:abcd\n", // Too short for SHA-256
+		":" + hashPassword("x") + "\n",
+	} {
+		path := filepath.Join(t.TempDir(), "credentials")
+		os.WriteFile(path, []byte(content), 0o600)
+		if _, err := LoadCredentials(path); err == nil {
+			t.Errorf("%q: loaded without error", content)
+		}
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr          string
+		authenticated bool
+		ok            bool
+	}{
+		{"127.0.0.1:8080", false, true},
+		{"[::1]:8080", false, true},
+		{"localhost:8080", false, true},
+		{":8080", false, false},
+		{"0.0.0.0:8080", false, false},
+		{"192.168.1.10:8080", false, false},
+		{":8080", true, true},
+	} {
+		err := checkListenAddr(tc.addr, tc.authenticated)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkListenAddr(%q, %v) = %v, want ok %v", tc.addr, tc.authenticated, err, tc.ok)
+		}
+	}
+}
+
+func TestPolicyFlags(t *testing.T) {
+	policy, err := policyFlags{
+		allowHosts: "*.example.com, example.com",
+		denyCIDRs:  "10.0.0.0/8",
+		denyPorts:  "22,25",
+	}.policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(policy.AllowHosts, policy.DenyCIDRs, policy.DenyPorts)
+	if want := "[*.example.com example.com] [10.0.0.0/8] [22 25]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for _, bad := range []policyFlags{{allowPorts: "http"}, {denyPorts: "70000"}, {allowCIDRs: "10.0.0.0"}} {
+		if _, err := bad.policy(); err == nil {
+			t.Errorf("%+v: parsed without error", bad)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyConfig controls who may use the proxy and where they may go.
+type ProxyConfig struct {
+	// Credentials, when set, make clients authenticate with
+	// Proxy-Authorization: Basic.
+	Credentials *Credentials
+	Policy      AccessPolicy
+	// AuditLog receives one JSON line per request; nil discards them.
+	AuditLog io.Writer
+}
+
+// ForwardProxy is an HTTP forward proxy (RFC 9110), usable by any client
+// configured with HTTP_PROXY/HTTPS_PROXY:
+//   - plain HTTP requests arrive in absolute form ("GET http://host/path")
+//     and are re-sent to the target, with hop-by-hop headers removed in
+//     both directions and bodies streamed rather than buffered;
+//   - HTTPS goes through a CONNECT tunnel: the proxy opens a TCP
+//     connection to host:port and splices bytes both ways, never seeing
+//     what is inside the TLS session.
+//
+// Every request is authenticated, checked against the AccessPolicy, and
+// recorded in the audit log, whether it was allowed or not.
+type ForwardProxy struct {
+	name        string
+	config      ProxyConfig
+	transport   *http.Transport
+	dialer      *net.Dialer
+	audit       *slog.Logger
+	idleTimeout time.Duration // For CONNECT tunnels
+}
+
+func NewForwardProxy(name string, config ProxyConfig) *ForwardProxy {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   config.Policy.control,
+	}
+	auditLog := config.AuditLog
+	if auditLog == nil {
+		auditLog = io.Discard
+	}
+	return &ForwardProxy{
+		name:   name,
+		config: config,
+		dialer: dialer,
+		transport: &http.Transport{
+			// Never chain through the proxy this process may itself be
+			// configured with in HTTP_PROXY.
+			Proxy:       nil,
+			DialContext: dialer.DialContext,
+			// Pass Accept-Encoding and compressed bodies through untouched.
+			DisableCompression:    true,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		audit:       slog.New(slog.NewJSONHandler(auditLog, nil)),
+		idleTimeout: 5 * time.Minute,
+	}
+}
+
+// requestLog is what the audit log records about one request.
+type requestLog struct {
+	user      string
+	status    int
+	denied    string       // Why the proxy refused the request
+	err       error        // What went wrong upstream
+	bytesUp   atomic.Int64 // Client to target, counted as the body is sent
+	bytesDown int64        // Target to client
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &requestLog{}
+	defer func() { p.logRequest(r, rec, time.Since(start)) }()
+
+	// 1. Who is asking?
+	if creds := p.config.Credentials; creds != nil {
+		user, ok := creds.authenticate(r)
+		rec.user = user
+		if !ok {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="`+p.name+`"`)
+			p.deny(w, rec, http.StatusProxyAuthRequired, "authentication required")
+			return
+		}
+	}
+
+	// 2. Is this a proxy request at all?
+	isAbs := r.URL.IsAbs() && (r.URL.Scheme == "http" || r.URL.Scheme == "https")
+	if r.Method != http.MethodConnect && !isAbs {
+		// An origin-form request ("GET /path"): the client talked to us as
+		// if we were the server.
+		p.deny(w, rec, http.StatusBadRequest, "this is a forward proxy: send absolute-form requests or CONNECT")
+		return
+	}
+
+	// 3. May it go there? Addresses are checked again at dial time.
+	host, port, err := splitTarget(r)
+	if err != nil {
+		p.deny(w, rec, http.StatusBadRequest, err.Error())
+		return
+	}
+	if why := p.config.Policy.checkTarget(host, port); why != "" {
+		p.deny(w, rec, http.StatusForbidden, why)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, rec)
+	} else {
+		p.forward(w, r, rec)
+	}
+}
+
+// deny refuses a request.
+func (p *ForwardProxy) deny(w http.ResponseWriter, rec *requestLog, status int, reason string) {
+	rec.status, rec.denied = status, reason
+	http.Error(w, reason, status)
+}
+
+// upstreamFailed answers a request whose target could not be reached:
+// 403 if the dialer refused the address, 504 on a timeout, else 502.
+func (p *ForwardProxy) upstreamFailed(w http.ResponseWriter, rec *requestLog, err error) {
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		p.deny(w, rec, http.StatusForbidden, blocked.Reason)
+		return
+	}
+	rec.status, rec.err = http.StatusBadGateway, err
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		rec.status = http.StatusGatewayTimeout
+	}
+	http.Error(w, err.Error(), rec.status)
+}
+
+// logRequest writes the audit record of a request.
+func (p *ForwardProxy) logRequest(r *http.Request, rec *requestLog, elapsed time.Duration) {
+	target := r.Host // CONNECT host:port
+	switch {
+	case r.Method == http.MethodConnect:
+	case r.URL.IsAbs():
+		target = r.URL.Redacted()
+	default:
+		target = r.Host + r.URL.RequestURI()
+	}
+	level, decision := slog.LevelInfo, "allow"
+	attrs := []slog.Attr{
+		slog.String("client", r.RemoteAddr),
+		slog.String("user", rec.user),
+		slog.String("method", r.Method),
+		slog.String("target", target),
+	}
+	if rec.denied != "" {
+		level, decision = slog.LevelWarn, "deny"
+		attrs = append(attrs, slog.String("reason", rec.denied))
+	}
+	if rec.err != nil {
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", rec.err.Error()))
+	}
+	attrs = append(attrs,
+		slog.String("decision", decision),
+		slog.Int("status", rec.status),
+		slog.Int64("bytes_up", rec.bytesUp.Load()),
+		slog.Int64("bytes_down", rec.bytesDown),
+		slog.Int64("duration_ms", elapsed.Milliseconds()),
+	)
+	p.audit.LogAttrs(context.Background(), level, "proxy request", attrs...)
+}
+
+// forward relays a plain HTTP request to its target and streams the
+// response back.
+func (p *ForwardProxy) forward(w http.ResponseWriter, r *http.Request, rec *requestLog) {
+	// 1. Build the outgoing request: same method, URL and body, minus the
+	// headers that only concerned the client's connection to us.
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	if r.ContentLength == 0 {
+		out.Body = nil
+	} else {
+		out.Body = countingReader{r.Body, &rec.bytesUp}
+	}
+	removeHopByHop(out.Header)
+	out.Header.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, p.name))
+
+	// 2. Send it. RoundTrip rather than a Client: redirects are the
+	// client's business, not ours.
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.upstreamFailed(w, rec, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// 3. Relay the response, flushing as bytes arrive so that slow and
+	// endless responses (downloads, server-sent events) reach the client
+	// as the target produces them.
+	removeHopByHop(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, p.name))
+	w.WriteHeader(resp.StatusCode)
+	rec.status = resp.StatusCode
+	rec.bytesDown, rec.err = copyFlushing(w, resp.Body)
+	if rec.err != nil {
+		// The status is sent: abort the connection, so that the client
+		// sees a truncated body rather than the end of a complete one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// countingReader adds the bytes read through it to n. The transport may
+// still be sending the body after the response is back, hence the atomic.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// copyFlushing copies src to w, flushing after every read.
+func copyFlushing(w http.ResponseWriter, src io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			rc.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// tunnel handles CONNECT host:port: it dials the target, tells the client
+// the tunnel is up, and splices the two connections until both sides are
+// done.
+func (p *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request, rec *requestLog) {
+	// 1. Reach the target before answering, so a failure is a clean error
+	dest, err := p.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.upstreamFailed(w, rec, err)
+		return
+	}
+
+	// 2. Take over the client connection from net/http
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		dest.Close()
+		p.deny(w, rec, http.StatusInternalServerError, "tunnelling not supported")
+		return
+	}
+	rec.status = http.StatusOK
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		dest.Close()
+		rec.err = err
+		return
+	}
+
+	// 3. Splice. The client may have sent the start of its TLS handshake
+	// right behind the CONNECT, so read through net/http's buffer.
+	up, down := p.splice(client, buffered.Reader, dest)
+	rec.bytesUp.Store(up)
+	rec.bytesDown = down
+}
+
+// splice copies between the client and the target in both directions and
+// returns the byte counts. A side that finishes sending has its half of
+// the other connection closed, so the peer sees EOF but can still answer.
+func (p *ForwardProxy) splice(client net.Conn, fromClient *bufio.Reader, dest net.Conn) (up, down int64) {
+	defer client.Close()
+	defer dest.Close()
+
+	// The tunnel is idle when neither side has sent anything for
+	// idleTimeout: every read pushes both deadlines back.
+	conns := []net.Conn{client, dest}
+	extend := func() {
+		for _, c := range conns {
+			c.SetReadDeadline(time.Now().Add(p.idleTimeout))
+		}
+	}
+	extend()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		up = pipe(dest, activityReader{fromClient, extend})
+	}()
+	go func() {
+		defer wg.Done()
+		down = pipe(client, activityReader{dest, extend})
+	}()
+	wg.Wait()
+	return up, down
+}
+
+func pipe(dst net.Conn, src io.Reader) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		// A reset or an idle timeout ends the whole tunnel.
+		dst.Close()
+		return n
+	}
+	if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// activityReader calls active every time bytes are read.
+type activityReader struct {
+	r      io.Reader
+	active func()
+}
+
+func (a activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.active()
+	}
+	return n, err
+}
+
+// hopByHop headers describe a single connection and must not be forwarded.
+// Proxy-Connection is not standard but old clients still send it.
+var hopByHop = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func removeHopByHop(h http.Header) {
+	for _, line := range h.Values("Connection") {
+		for _, name := range strings.Split(line, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHop {
+		h.Del(name)
+	}
+}
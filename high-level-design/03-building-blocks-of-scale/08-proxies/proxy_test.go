@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts a proxy that may reach loopback targets, and returns
+// its server and a client configured to use it.
+func newTestProxy(t *testing.T, config ProxyConfig) (*httptest.Server, *http.Client) {
+	t.Helper()
+	config.Policy.AllowInternal = append(config.Policy.AllowInternal, netip.MustParsePrefix("127.0.0.0/8"))
+	proxy := httptest.NewServer(NewForwardProxy("test-proxy", config))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	t.Cleanup(client.CloseIdleConnections)
+	return proxy, client
+}
+
+// newTarget starts a target server running handler.
+func newTarget(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	target := httptest.NewServer(handler)
+	t.Cleanup(target.Close)
+	return target
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	var via, path string
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		via, path = r.Header.Get("Via"), r.URL.RequestURI()
+		fmt.Fprint(w, "hello")
+	})
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	resp, err := client.Get(target.URL + "/a/b?c=d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("got %d %q, want 200 hello", resp.StatusCode, body)
+	}
+	if path != "/a/b?c=d" {
+		t.Errorf("target got %q, want /a/b?c=d", path)
+	}
+	if via != "1.1 test-proxy" {
+		t.Errorf("target got Via %q, want 1.1 test-proxy", via)
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 test-proxy" {
+		t.Errorf("client got Via %q, want 1.1 test-proxy", got)
+	}
+}
+
+func TestForwardStripsHopByHopHeaders(t *testing.T) {
+	var got http.Header
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Connection", "X-Hop-Response")
+		w.Header().Set("X-Hop-Response", "for the proxy")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-End-To-End", "kept")
+	})
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+	req.Header.Set("Connection", "X-Hop-Request, X-Other")
+	req.Header.Set("X-Hop-Request", "for the proxy")
+	req.Header.Set("X-Other", "for the proxy")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-End-To-End", "kept")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Hop-Request", "X-Other", "Proxy-Connection", "Te", "Upgrade"} {
+		if v := got.Get(name); v != "" {
+			t.Errorf("target got %s: %q", name, v)
+		}
+	}
+	if got.Get("X-End-To-End") != "kept" {
+		t.Error("target did not get X-End-To-End")
+	}
+	for _, name := range []string{"X-Hop-Response", "Keep-Alive"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("client got %s: %q", name, v)
+		}
+	}
+	if resp.Header.Get("X-End-To-End") != "kept" {
+		t.Error("client did not get X-End-To-End")
+	}
+}
+
+func TestForwardStreamsResponse(t *testing.T) {
+	release := make(chan struct{})
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, " second")
+	})
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		close(release)
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The target is still blocked: the first bytes can only arrive if the
+	// proxy relays them as they come.
+	first := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(resp.Body, buf)
+		first <- string(buf[:n])
+	}()
+	select {
+	case got := <-first:
+		if got != "first" {
+			t.Errorf("got %q, want first", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the first bytes did not arrive before the body was complete")
+	}
+	close(release)
+	rest, _ := io.ReadAll(resp.Body)
+	if string(rest) != " second" {
+		t.Errorf("got %q, want \" second\"", rest)
+	}
+}
+
+func TestForwardAbortsTruncatedResponse(t *testing.T) {
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "partial")
+		w.(http.Flusher).Flush()
+		// Drop the connection before the final chunk.
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	})
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	resp, err := client.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if string(body) != "partial" {
+		t.Errorf("got %q, want partial", body)
+	}
+	if err == nil {
+		t.Error("the truncated body ended cleanly, want an error")
+	}
+}
+
+func TestForwardStreamsRequestBody(t *testing.T) {
+	started := make(chan struct{})
+	received := make(chan int64, 1)
+	target := newTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r.Body, buf); err == nil {
+			close(started)
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		received <- n + 1
+	})
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	// The client only sends the rest of the body once the target has seen
+	// its start, which a proxy that buffers whole bodies never allows.
+	const size = 8 << 20
+	body, bodyWriter := io.Pipe()
+	go func() {
+		chunk := make([]byte, 64<<10)
+		bodyWriter.Write(chunk)
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			bodyWriter.CloseWithError(fmt.Errorf("the target got nothing before the body was complete"))
+			return
+		}
+		for sent := len(chunk); sent < size; sent += len(chunk) {
+			bodyWriter.Write(chunk)
+		}
+		bodyWriter.Close()
+	}()
+	resp, err := client.Post(target.URL, "application/octet-stream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := <-received; n != size {
+		t.Errorf("target received %d bytes, want %d", n, size)
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The proxy cannot see inside the tunnel, so it adds no Via.
+		fmt.Fprintf(w, "secure hello, Via %q", r.Header.Get("Via"))
+	}))
+	defer target.Close()
+	proxy, _ := newTestProxy(t, ProxyConfig{})
+
+	client := target.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(must(url.Parse(proxy.URL)))
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(target.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `secure hello, Via ""` {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestConnectRaw(t *testing.T) {
+	// An echo server stands in for any TCP service behind the tunnel.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	proxy, _ := newTestProxy(t, ProxyConfig{})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\nping", ln.Addr())
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	// "ping" was sent right behind the CONNECT, before the tunnel was up.
+	conn.(*net.TCPConn).CloseWrite()
+	echoed, _ := io.ReadAll(r)
+	if string(echoed) != "ping" {
+		t.Errorf("echoed %q, want ping", echoed)
+	}
+}
+
+func TestOriginFormRejected(t *testing.T) {
+	proxy, _ := newTestProxy(t, ProxyConfig{})
+	resp, err := http.Get(proxy.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestUnreachableUpstream(t *testing.T) {
+	// A port that was just free is most likely still closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, client := newTestProxy(t, ProxyConfig{})
+
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,31 @@
+// Package glob matches strings against simple wildcard patterns, as used
+// for host names, URL paths and query parameter names in the demos:
+//
+//	glob.Match("*.example.com", "cdn.example.com") // true
+//	glob.Match("/downloads/*", "/downloads/a/b")    // true
+//
+// The only wildcard is *, which matches any run of characters, including
+// "." and "/". Matching is case-sensitive.
+package glob
+
+import "strings"
+
+// Match reports whether s matches pattern.
+func Match(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
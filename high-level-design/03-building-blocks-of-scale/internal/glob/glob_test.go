@@ -0,0 +1,32 @@
+package glob
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"a", "a", true},
+		{"a", "b", false},
+		{"*", "", true},
+		{"*", "anything/at/all", true},
+		{"*.example.com", "cdn.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", true},
+		{"/downloads/*", "/downloads/big.iso", true},
+		{"/downloads/*", "/download", false},
+		{"utm_*", "utm_source", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		{"a*a", "a", false}, // The prefix and suffix may not overlap
+		{"ab*ba", "aba", false},
+		{"*a*a", "aa", true},
+	} {
+		if got := Match(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
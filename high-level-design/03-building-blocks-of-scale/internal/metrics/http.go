@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPMetrics records the standard request metrics for http.Handlers:
+// a request counter by handler and status code, a latency histogram and
+// an in-flight gauge.
+type HTTPMetrics struct {
+	requests *Counter
+	duration *Histogram
+	inFlight *Gauge
+}
+
+// NewHTTPMetrics registers "<prefix>_requests_total",
+// "<prefix>_request_duration_seconds" and "<prefix>_in_flight_requests".
+func NewHTTPMetrics(r *Registry, prefix string) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounter(prefix+"_requests_total", "Requests served, by handler and status code.", "handler", "code"),
+		duration: r.NewHistogram(prefix+"_request_duration_seconds", "Request latency in seconds, by handler.", DefaultBuckets, "handler"),
+		inFlight: r.NewGauge(prefix+"_in_flight_requests", "Requests currently being served, by handler.", "handler"),
+	}
+}
+
+// Wrap instruments h under the given handler name.
+func (m *HTTPMetrics) Wrap(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight := m.inFlight.With(name)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := NewStatusRecorder(w)
+		h.ServeHTTP(rec, r)
+
+		code := rec.Status()
+		if code == 0 {
+			code = http.StatusOK // Nothing written: net/http sends an empty 200
+		}
+		m.duration.With(name).Observe(time.Since(start).Seconds())
+		m.requests.With(name, strconv.Itoa(code)).Inc()
+	})
+}
+
+// StatusRecorder remembers the status code written through it.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+func (s *StatusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *StatusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Status returns the status code sent, or 0 if nothing was written yet.
+func (s *StatusRecorder) Status() int {
+	return s.status
+}
+
+// Unwrap lets http.ResponseController reach Flush and friends on the
+// underlying writer (the reverse proxy relies on it for streaming).
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,335 @@
+// Package metrics is a tiny, dependency-free implementation of Prometheus
+// style counters, gauges and histograms, rendered in the text exposition
+// format so any Prometheus server (or curl) can scrape them.
+//
+// It deliberately covers only what the demos in this module need:
+//
+//	reg := metrics.NewRegistry()
+//	requests := reg.NewCounter("http_requests_total", "Requests served.", "code")
+//	requests.With("200").Inc()
+//	http.Handle("/metrics", reg)
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 10s.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is anything the registry can render.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds metrics and serves them on /metrics.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Render writes every metric in registration order.
+func (r *Registry) Render(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// ServeHTTP makes the registry usable as the /metrics handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Render(w)
+}
+
+// desc is the name, help text and label names shared by every series of a
+// metric, together with the series themselves keyed by label values.
+type desc struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       any // *atomicFloat for counters and gauges, *histogram for histograms
+}
+
+func newDesc(name, help, typ string, labelNames []string) *desc {
+	return &desc{name: name, help: help, typ: typ, labelNames: labelNames, series: make(map[string]*series)}
+}
+
+// get returns the series for labelValues, creating it with newValue.
+func (d *desc) get(labelValues []string, newValue func() any) any {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...), value: newValue()}
+		d.series[key] = s
+	}
+	return s.value
+}
+
+// sorted returns the series ordered by label values, for stable output.
+func (d *desc) sorted() []*series {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]*series, 0, len(d.series))
+	for _, s := range d.series {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return strings.Join(out[i].labelValues, "\xff") < strings.Join(out[j].labelValues, "\xff")
+	})
+	return out
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// --- Counter ---
+
+// Counter is a value that only goes up, e.g. requests served.
+type Counter struct {
+	d *desc
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{d: newDesc(name, help, "counter", labelNames)}
+	r.register(c)
+	return c
+}
+
+// With returns the series for the given label values.
+func (c *Counter) With(labelValues ...string) *CounterValue {
+	return &CounterValue{v: c.d.get(labelValues, func() any { return new(atomicFloat) }).(*atomicFloat)}
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.d.writeHeader(w)
+	for _, s := range c.d.sorted() {
+		writeSample(w, c.d.name, c.d.labelNames, s.labelValues, s.value.(*atomicFloat).load())
+	}
+}
+
+// CounterValue is one labelled series of a Counter.
+type CounterValue struct {
+	v *atomicFloat
+}
+
+func (c *CounterValue) Inc()          { c.v.add(1) }
+func (c *CounterValue) Add(v float64) { c.v.add(v) }
+
+// --- Gauge ---
+
+// Gauge is a value that goes up and down, e.g. requests in flight.
+type Gauge struct {
+	d *desc
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{d: newDesc(name, help, "gauge", labelNames)}
+	r.register(g)
+	return g
+}
+
+// With returns the series for the given label values.
+func (g *Gauge) With(labelValues ...string) *GaugeValue {
+	return &GaugeValue{v: g.d.get(labelValues, func() any { return new(atomicFloat) }).(*atomicFloat)}
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.d.writeHeader(w)
+	for _, s := range g.d.sorted() {
+		writeSample(w, g.d.name, g.d.labelNames, s.labelValues, s.value.(*atomicFloat).load())
+	}
+}
+
+// GaugeValue is one labelled series of a Gauge.
+type GaugeValue struct {
+	v *atomicFloat
+}
+
+func (g *GaugeValue) Set(v float64) { g.v.store(v) }
+func (g *GaugeValue) Inc()          { g.v.add(1) }
+func (g *GaugeValue) Dec()          { g.v.add(-1) }
+
+// --- GaugeFunc ---
+
+// GaugeFunc is a gauge computed at scrape time, for state that already
+// lives elsewhere (health flags, queue lengths) and would otherwise have
+// to be mirrored into a Gauge on every change.
+type GaugeFunc struct {
+	d       *desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, labelNames []string, collect func(emit func(value float64, labelValues ...string))) *GaugeFunc {
+	g := &GaugeFunc{d: newDesc(name, help, "gauge", labelNames), collect: collect}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.d.writeHeader(w)
+	g.collect(func(value float64, labelValues ...string) {
+		writeSample(w, g.d.name, g.d.labelNames, labelValues, value)
+	})
+}
+
+// --- Histogram ---
+
+// Histogram counts observations (e.g. latencies) into cumulative buckets.
+type Histogram struct {
+	d       *desc
+	buckets []float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{d: newDesc(name, help, "histogram", labelNames), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// With returns the series for the given label values.
+func (h *Histogram) With(labelValues ...string) *HistogramValue {
+	v := h.d.get(labelValues, func() any {
+		return &histogram{counts: make([]uint64, len(h.buckets))}
+	}).(*histogram)
+	return &HistogramValue{h: v, buckets: h.buckets}
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.d.writeHeader(w)
+	labelNames := append(append([]string(nil), h.d.labelNames...), "le")
+	for _, s := range h.d.sorted() {
+		hist := s.value.(*histogram)
+		hist.mu.Lock()
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			labelValues := append(append([]string(nil), s.labelValues...), formatFloat(upper))
+			writeSample(w, h.d.name+"_bucket", labelNames, labelValues, float64(cumulative))
+		}
+		labelValues := append(append([]string(nil), s.labelValues...), "+Inf")
+		writeSample(w, h.d.name+"_bucket", labelNames, labelValues, float64(hist.count))
+		writeSample(w, h.d.name+"_sum", h.d.labelNames, s.labelValues, hist.sum)
+		writeSample(w, h.d.name+"_count", h.d.labelNames, s.labelValues, float64(hist.count))
+		hist.mu.Unlock()
+	}
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // Non-cumulative count per bucket
+	count  uint64
+	sum    float64
+}
+
+// HistogramValue is one labelled series of a Histogram.
+type HistogramValue struct {
+	h       *histogram
+	buckets []float64
+}
+
+func (h *HistogramValue) Observe(v float64) {
+	// Index of the first bucket whose upper bound is >= v.
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.h.mu.Lock()
+	defer h.h.mu.Unlock()
+	if i < len(h.h.counts) {
+		h.h.counts[i]++
+	}
+	h.h.count++
+	h.h.sum += v
+}
+
+// --- Helpers ---
+
+// atomicFloat is a float64 updated with compare-and-swap.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) load() float64   { return math.Float64frombits(f.bits.Load()) }
+func (f *atomicFloat) store(v float64) { f.bits.Store(math.Float64bits(v)) }
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// writeSample writes one line: name{label="value",...} 42
+func writeSample(w io.Writer, name string, labelNames, labelValues []string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if len(labelNames) > 0 {
+		sb.WriteByte('{')
+		for i, ln := range labelNames {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(ln)
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabel(labelValues[i]))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(formatFloat(value))
+	sb.WriteByte('\n')
+	io.WriteString(w, sb.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}